@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/aaarkadev/collectalertagent/internal/alerts"
 	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/grpcapi"
 	"github.com/aaarkadev/collectalertagent/internal/handlers"
+	"github.com/aaarkadev/collectalertagent/internal/listeners"
 	"github.com/aaarkadev/collectalertagent/internal/servers"
 	"github.com/aaarkadev/collectalertagent/internal/types"
 	"github.com/go-chi/chi/v5"
@@ -22,25 +25,95 @@ func main() {
 
 	config := configs.InitServerConfig()
 
+	if config.MigrateOnly {
+		err := servers.Migrate(mainCtx, &config)
+		if err != nil {
+			log.Fatalln(types.NewTimeError(fmt.Errorf("migrate fail: %w", err)))
+		}
+		log.Println(types.NewTimeError(fmt.Errorf("END")))
+		return
+	}
+
 	repo, serverData := servers.Init(mainCtx, &config)
 	defer func() {
 		servers.StopServer(mainCtx, repo)
 	}()
 
+	if len(config.StatsdAddress) > 0 {
+		statsd := listeners.StatsdListener{Repo: repo, Config: &config}
+		err := statsd.Start(mainCtx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer statsd.Stop(mainCtx)
+	}
+	if len(config.GraphiteAddress) > 0 {
+		graphite := listeners.GraphiteListener{Repo: repo, Config: &config}
+		err := graphite.Start(mainCtx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer graphite.Stop(mainCtx)
+	}
+	if len(config.GRPCAddress) > 0 {
+		grpcServer := grpcapi.Server{Repo: repo, Broker: serverData.Broker, Config: &config}
+		err := grpcServer.Start(mainCtx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer grpcServer.Stop(mainCtx)
+	}
+	alertRules, err := servers.LoadAlertRules(&config)
+	if err != nil {
+		log.Fatalln(types.NewTimeError(fmt.Errorf("alert rules fail: %w", err)))
+	}
+	if len(alertRules) > 0 {
+		engine := &alerts.Engine{Repo: repo, Rules: alertRules, Interval: config.AlertInterval}
+		dispatcher := servers.NewDispatcher(&config)
+		if dispatcher != nil {
+			err := dispatcher.Start(mainCtx)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			// deferred first, so it stops after the engine and delivers its last changes
+			defer dispatcher.Stop(mainCtx)
+			engine.OnChange = dispatcher.Dispatch
+			serverData.Notifications = dispatcher
+		}
+		err := engine.Start(mainCtx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer engine.Stop(mainCtx)
+		serverData.Alerts = engine
+	}
+
 	router := chi.NewRouter()
 	router.Use(servers.GzipMiddleware)
 	router.Use(servers.UnGzipMiddleware)
+	router.Use(servers.ClientMiddleware)
 
-	router.Post("/update/{type}/{name}/{value}", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerUpdateRaw))
-	router.Post("/update/", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerUpdateJSON))
-	router.Post("/updates/", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerUpdatesJSON))
+	router.Post("/update/{type}/{name}/{value}", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.Idempotent(handlers.HandlerUpdateRaw)))
+	router.Post("/update/", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.Idempotent(handlers.HandlerUpdateJSON)))
+	router.Post("/updates/", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.Idempotent(handlers.HandlerUpdatesJSON)))
+	router.Post("/write", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerInfluxWrite))
+	router.Post("/v1/metrics", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerOTLPMetrics))
 
 	router.Get("/value/{type}/{name}", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerFuncOneRaw))
+	router.Delete("/value/{type}/{name}", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerDeleteRaw))
 	router.Post("/value/", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerFuncOneJSON))
+	router.Get("/history/{type}/{name}", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerHistory))
 	router.Get("/", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerFuncAll))
+	router.Get("/metrics", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerPrometheus))
+	router.Get("/api/metrics", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerAPIMetrics))
+	router.Delete("/api/metrics", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerAPIDeleteMetrics))
+	router.Get("/api/alerts", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerAPIAlerts))
+	router.Get("/api/notifications", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerAPINotifications))
+	router.Get("/stream", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerStream))
 	router.Get("/ping", servers.BindServerDataToHandler(mainCtx, &serverData, handlers.HandlerPingDB))
 
-	servers.StartServer(mainCtx, config, router)
+	// open /stream responses would hold Shutdown until its timeout
+	servers.StartServer(mainCtx, config, router, serverData.Broker.Close)
 
 	log.Println(types.NewTimeError(fmt.Errorf("END")))
 }
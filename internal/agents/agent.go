@@ -3,6 +3,8 @@ package agents
 import (
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -76,6 +78,7 @@ func updateOne(m types.Metrics, statStructReflect reflect.Value) (types.Metrics,
 func UpdatePsMetrics(rep repositories.Repo) bool {
 	memInfo, _ := mem.VirtualMemory()
 	cpuPercents, _ := cpu.Percent(time.Second, true)
+	collectedAt := time.Now()
 
 	for _, mElem := range rep.GetAll() {
 		if !isPsMetrica(mElem) {
@@ -103,6 +106,7 @@ func UpdatePsMetrics(rep repositories.Repo) bool {
 		if err != nil {
 			log.Println(types.NewTimeError(fmt.Errorf("agent.UpdatePsMetrics(): fail: %w", err)))
 		}
+		mElem.SetTime(collectedAt)
 		err = rep.Set(mElem)
 		if err != nil {
 			log.Println(types.NewTimeError(fmt.Errorf("agent.UpdatePsMetrics(): fail: %w", err)))
@@ -134,6 +138,7 @@ func startJob(mainCtx context.Context, wg *sync.WaitGroup, interval time.Duratio
 func UpdateOsMetrics(rep repositories.Repo) bool {
 	var osStats = runtime.MemStats{}
 	runtime.ReadMemStats(&osStats)
+	collectedAt := time.Now()
 	reflectVal := reflect.ValueOf(&osStats)
 	if reflectVal.Kind() == reflect.Ptr {
 		reflectVal = reflectVal.Elem()
@@ -150,6 +155,7 @@ func UpdateOsMetrics(rep repositories.Repo) bool {
 		if err != nil {
 			log.Println(types.NewTimeError(fmt.Errorf("agent.UpdatelMetrics(): fail: %w", err)))
 		}
+		mElem.SetTime(collectedAt)
 		err = rep.Set(mElem)
 		if err != nil {
 			log.Println(types.NewTimeError(fmt.Errorf("agent.UpdatelMetrics(): fail: %w", err)))
@@ -232,6 +238,11 @@ func Init(mainCtx context.Context, config *configs.AgentConfig) repositories.Rep
 	return &rep
 }
 
+const (
+	sendAttempts   = 3
+	sendRetryDelay = time.Second
+)
+
 func SendMetricsJSON(rep repositories.Repo, config configs.AgentConfig) {
 	client := &http.Client{}
 	client.Timeout = configs.GlobalDefaultTimeout
@@ -251,29 +262,58 @@ func SendMetricsJSON(rep repositories.Repo, config configs.AgentConfig) {
 		log.Fatalln(types.NewTimeError(fmt.Errorf("agent.SendMetricsJSON(): fail: %w", err)))
 	}
 	url := fmt.Sprintf("http://%v/updates/", config.SendAddress)
+	// the same key on every attempt lets the server drop a retry of an applied batch
+	idempotencyKey := newIdempotencyKey()
+
+	for attempt := 1; attempt <= sendAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * sendRetryDelay)
+		}
+		isRetryable, err := postMetricsJSON(client, url, txtM, idempotencyKey)
+		if err == nil {
+			return
+		}
+		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsJSON(): warn: attempt %d: %w", attempt, err)))
+		if !isRetryable {
+			return
+		}
+	}
+}
+
+func postMetricsJSON(client *http.Client, url string, txtM []byte, idempotencyKey string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), configs.GlobalDefaultTimeout)
 	defer cancel()
 
 	req, rqErr := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(txtM))
 	if rqErr != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsJSON(): warn: %w", rqErr)))
-		return
+		return false, rqErr
 	}
 	req.Header.Set("Content-Type", "Content-Type: application/json")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
 
 	response, doErr := client.Do(req)
 	if doErr != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsJSON(): warn: %w", doErr)))
-		return
+		return true, doErr
 	}
 
 	_, ioErr := io.Copy(io.Discard, response.Body)
 	defer response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return true, fmt.Errorf("status %v", response.Status)
+	}
 	if ioErr != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsJSON(): warn: %w", ioErr)))
-		return
+		return false, ioErr
 	}
+	return false, nil
+}
 
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
 }
 
 func sendMetricsRaw(rep repositories.Repo, config configs.AgentConfig) {
@@ -344,6 +384,10 @@ func StartAgent(mainCtx context.Context, rep repositories.Repo, config configs.A
 	})
 	wg.Add(1)
 	startJob(mainCtx, &wg, config.ReportInterval, func() {
+		if config.Transport == "grpc" {
+			SendMetricsGRPC(rep, config)
+			return
+		}
 		SendMetricsJSON(rep, config)
 	})
 
@@ -0,0 +1,44 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/grpcapi"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// SendMetricsGRPC is the gRPC counterpart of SendMetricsJSON.
+func SendMetricsGRPC(rep repositories.Repo, config configs.AgentConfig) {
+	sendM := rep.GetAll()
+	if len(sendM) < 1 {
+		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsGRPC(): warn: empty repo")))
+		return
+	}
+	for i := range sendM {
+		sendM[i].GenHash(config.HashKey)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configs.GlobalDefaultTimeout)
+	defer cancel()
+
+	conn, err := grpcapi.Dial(ctx, config.GRPCAddress)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsGRPC(): warn: %w", err)))
+		return
+	}
+	defer conn.Close()
+
+	client := grpcapi.NewMetricsClient(conn)
+	resp, err := client.UpdateBatch(ctx, &grpcapi.UpdateBatchRequest{Metrics: grpcapi.NewMetrics(sendM)})
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsGRPC(): warn: %w", err)))
+		return
+	}
+	if resp.GetRejected() > 0 {
+		log.Println(types.NewTimeError(fmt.Errorf("agent.SendMetricsGRPC(): warn: server rejected %d metrics", resp.GetRejected())))
+	}
+}
@@ -0,0 +1,294 @@
+package alerts
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/storages"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+func testAlert(state State) Alert {
+	firedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	return Alert{
+		Rule:        "FreeMemory < 500MB",
+		ID:          "FreeMemory",
+		MType:       "gauge",
+		Labels:      types.Labels{"host": "web1"},
+		State:       state,
+		Value:       100,
+		Threshold:   500 << 20,
+		ActiveSince: firedAt,
+		FiredAt:     &firedAt,
+	}
+}
+
+// runDispatcher delivers alerts through notifiers and returns the notification log.
+func runDispatcher(t *testing.T, d *Dispatcher, alerts ...Alert) []LogEntry {
+	ctx := context.Background()
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	d.Dispatch(alerts)
+	d.Stop(ctx)
+	return d.Log()
+}
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("FreeMemory{host=web1} < 500MB for 5m")
+	if err != nil {
+		t.Fatalf("ParseRule() = %v", err)
+	}
+	if rule.IDPattern != "FreeMemory" || rule.Labels["host"] != "web1" || rule.Op != "<" || rule.Threshold != 500<<20 || rule.For != 5*time.Minute {
+		t.Errorf("rule = %+v", rule)
+	}
+	for _, bad := range []string{"FreeMemory", "FreeMemory < 5XB", "CPU[ > 90", "CPU > 90 for soon"} {
+		if _, err := ParseRule(bad); err == nil {
+			t.Errorf("ParseRule(%q) accepted", bad)
+		}
+	}
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	ctx := context.Background()
+	repo := &storages.MemStorage{}
+	repo.Init(ctx)
+	rule, err := ParseRule("Load > 5 for 1m")
+	if err != nil {
+		t.Fatalf("ParseRule() = %v", err)
+	}
+	e := &Engine{Repo: repo, Rules: []Rule{rule}, ResolvedRetention: 10 * time.Minute}
+
+	const deleted = -1
+	start := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name        string
+		at          time.Duration
+		value       float64
+		wantChanged []State
+		// wantState is the alert state after the step, "" when there is no alert
+		wantState State
+	}{
+		{"over threshold", 0, 10, []State{StatePending}, StatePending},
+		{"still pending before For", 30 * time.Second, 10, nil, StatePending},
+		{"back under while pending", 40 * time.Second, 1, nil, ""},
+		{"over again", 50 * time.Second, 10, []State{StatePending}, StatePending},
+		{"fires after For", 110 * time.Second, 10, []State{StateFiring}, StateFiring},
+		{"NaN keeps firing", 120 * time.Second, math.NaN(), nil, StateFiring},
+		{"series deleted", 130 * time.Second, deleted, []State{StateResolved}, StateResolved},
+		{"re-fires after resolved", 140 * time.Second, 10, []State{StatePending}, StatePending},
+		{"fires again", 200 * time.Second, 10, []State{StateFiring}, StateFiring},
+		{"under threshold", 210 * time.Second, 1, []State{StateResolved}, StateResolved},
+		{"resolved kept within retention", 210*time.Second + 9*time.Minute, 1, nil, StateResolved},
+		{"resolved pruned after retention", 210*time.Second + 10*time.Minute, 1, nil, ""},
+	}
+	for _, step := range steps {
+		if step.value == deleted {
+			repo.Delete(ctx, []string{"Load"})
+		} else {
+			repo.Set(*testGauge(step.value))
+		}
+		changed := e.Evaluate(start.Add(step.at))
+
+		gotChanged := []State{}
+		for _, a := range changed {
+			gotChanged = append(gotChanged, a.State)
+		}
+		if len(gotChanged) != len(step.wantChanged) || (len(gotChanged) > 0 && gotChanged[0] != step.wantChanged[0]) {
+			t.Errorf("%v: changed %v, want %v", step.name, gotChanged, step.wantChanged)
+		}
+		gotState := State("")
+		if all := e.Alerts(); len(all) > 0 {
+			gotState = all[0].State
+		}
+		if gotState != step.wantState {
+			t.Errorf("%v: state %q, want %q", step.name, gotState, step.wantState)
+		}
+	}
+}
+
+func testGauge(v float64) *types.Metrics {
+	m, _ := types.NewMetric("Load", types.GaugeType, types.OsSource)
+	m.Set(v)
+	return m
+}
+
+func TestWebhookNotifierSignsBody(t *testing.T) {
+	key := []byte("secret")
+	received := make(chan Message, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != "sha256="+Sign(key, body) {
+			t.Errorf("signature %q does not match body", r.Header.Get(SignatureHeader))
+		}
+		msg := Message{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Errorf("body %s: %v", body, err)
+		}
+		received <- msg
+	}))
+	defer server.Close()
+
+	d := &Dispatcher{
+		Notifiers:       []Notifier{&WebhookNotifier{URL: server.URL, HashKey: key}},
+		SubjectTemplate: "{{.State}} {{.ID}}",
+	}
+	entries := runDispatcher(t, d, testAlert(StatePending), testAlert(StateFiring))
+
+	msg := <-received
+	if msg.Subject != "firing FreeMemory" || msg.Alert.Labels["host"] != "web1" {
+		t.Errorf("message = %+v", msg)
+	}
+	if len(entries) != 1 || entries[0].Status != DeliverySent {
+		t.Errorf("log = %+v, want one sent firing alert", entries)
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	d := &Dispatcher{
+		Notifiers:  []Notifier{&WebhookNotifier{URL: server.URL}},
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+	}
+	entries := runDispatcher(t, d, testAlert(StateFiring))
+	if len(entries) != 1 || entries[0].Status != DeliverySent || entries[0].Attempts != 3 {
+		t.Errorf("log = %+v, want sent on the 3rd attempt", entries)
+	}
+
+	// 4xx answers are not retried
+	d = &Dispatcher{
+		Notifiers:  []Notifier{&WebhookNotifier{URL: server.URL + "/gone"}},
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+	}
+	entries = runDispatcher(t, d, testAlert(StateFiring))
+	if len(entries) != 1 || entries[0].Status != DeliveryFailed || entries[0].Attempts != 1 {
+		t.Errorf("log = %+v, want one failed attempt", entries)
+	}
+}
+
+func TestDispatcherRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	d := &Dispatcher{
+		Notifiers:  []Notifier{&WebhookNotifier{URL: server.URL}},
+		RateLimit:  1,
+		RatePeriod: time.Hour,
+	}
+	entries := runDispatcher(t, d, testAlert(StateFiring), testAlert(StateFiring), testAlert(StateResolved))
+	want := []string{DeliverySent, DeliveryRateLimited, DeliverySent}
+	if len(entries) != len(want) {
+		t.Fatalf("log = %+v, want %v", entries, want)
+	}
+	for i, status := range want {
+		if entries[i].Status != status {
+			t.Errorf("log = %+v, want %v: resolved messages are not rate limited", entries, want)
+			break
+		}
+	}
+	// a second Stop, e.g. a deferred one after an explicit one, is a no-op
+	d.Stop(context.Background())
+}
+
+// smtpStandIn accepts one session and returns the DATA it received.
+func smtpStandIn(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	data := make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		reply("220 stand-in ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 stand-in")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var sb strings.Builder
+				for {
+					dataLine, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if dataLine == ".\r\n" {
+						break
+					}
+					sb.WriteString(dataLine)
+				}
+				data <- sb.String()
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), data
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, data := smtpStandIn(t)
+
+	d := &Dispatcher{
+		Notifiers:    []Notifier{&SMTPNotifier{Address: addr, From: "alerts@example.com", To: []string{"ops@example.com"}}},
+		BodyTemplate: "{{.ID}} is {{.Value}}, threshold {{.Threshold}}",
+	}
+	entries := runDispatcher(t, d, testAlert(StateFiring))
+	if len(entries) != 1 || entries[0].Status != DeliverySent {
+		t.Fatalf("log = %+v, want one sent mail", entries)
+	}
+
+	mail := <-data
+	if !strings.Contains(mail, "To: ops@example.com\r\n") {
+		t.Errorf("mail has no To header:\n%s", mail)
+	}
+	if !strings.Contains(mail, "Subject: [firing] FreeMemory < 500MB: FreeMemory{host=\"web1\"}\r\n") {
+		t.Errorf("mail has no default subject:\n%s", mail)
+	}
+	if !strings.Contains(mail, "\r\n\r\nFreeMemory is 100, threshold 5.24288e+08") {
+		t.Errorf("mail has no templated body:\n%s", mail)
+	}
+}
@@ -0,0 +1,231 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+type State string
+
+const (
+	// StatePending holds while the condition is true for less than the rule For.
+	StatePending State = "pending"
+	// StateFiring holds while the condition stays true after For.
+	StateFiring State = "firing"
+	// StateResolved is a firing alert whose condition went false or whose series is gone.
+	StateResolved State = "resolved"
+)
+
+// DefaultResolvedRetention is how long resolved alerts stay visible.
+const DefaultResolvedRetention = 15 * time.Minute
+
+// Alert is the state of one rule for one series.
+type Alert struct {
+	Rule        string       `json:"rule"`
+	ID          string       `json:"id"`
+	MType       string       `json:"type"`
+	Labels      types.Labels `json:"labels,omitempty"`
+	State       State        `json:"state"`
+	Value       float64      `json:"value"`
+	Threshold   float64      `json:"threshold"`
+	ActiveSince time.Time    `json:"active_since"`
+	FiredAt     *time.Time   `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time   `json:"resolved_at,omitempty"`
+	EvaluatedAt time.Time    `json:"evaluated_at"`
+}
+
+// Engine evaluates Rules against Repo every Interval and keeps alert state in memory.
+type Engine struct {
+	Repo     repositories.Repo
+	Rules    []Rule
+	Interval time.Duration
+	// ResolvedRetention defaults to DefaultResolvedRetention
+	ResolvedRetention time.Duration
+	// OnChange, when set, gets the alerts changed by each scheduled evaluation, e.g. Dispatcher.Dispatch
+	OnChange func(changed []Alert)
+
+	mu sync.RWMutex
+	// alerts are keyed by rule index and series key
+	alerts   map[string]*Alert
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func (e *Engine) Start(mainCtx context.Context) error {
+	if e.Repo == nil || e.Interval <= 0 {
+		return types.NewTimeError(fmt.Errorf("alerts.Engine.Start(): fail: need Repo and a positive Interval"))
+	}
+	e.mu.Lock()
+	e.alerts = make(map[string]*Alert)
+	e.mu.Unlock()
+	e.done = make(chan struct{})
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		evalTicker := time.NewTicker(e.Interval)
+		defer evalTicker.Stop()
+		for {
+			select {
+			case <-evalTicker.C:
+				changed := e.Evaluate(time.Now())
+				if e.OnChange != nil && len(changed) > 0 {
+					e.OnChange(changed)
+				}
+			case <-e.done:
+				return
+			case <-mainCtx.Done():
+				return
+			}
+		}
+	}()
+	log.Println(types.NewTimeError(fmt.Errorf("alerts.Engine.Start(): %d rules every %v", len(e.Rules), e.Interval)))
+	return nil
+}
+
+func (e *Engine) Stop(mainCtx context.Context) {
+	if e.done == nil {
+		return
+	}
+	e.stopOnce.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+	})
+}
+
+// Evaluate runs every rule once at now and returns the alerts that changed state.
+func (e *Engine) Evaluate(now time.Time) []Alert {
+	metrics := e.Repo.GetAll()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.alerts == nil {
+		e.alerts = make(map[string]*Alert)
+	}
+
+	retention := e.ResolvedRetention
+	if retention <= 0 {
+		retention = DefaultResolvedRetention
+	}
+	changed := []Alert{}
+	seen := make(map[string]struct{})
+	for ri, rule := range e.Rules {
+		for _, m := range metrics {
+			if !rule.Match(m) {
+				continue
+			}
+			k := fmt.Sprintf("%d\x00%s", ri, m.Key())
+			seen[k] = struct{}{}
+			v := m.Point().Value
+			if math.IsNaN(v) {
+				// no verdict, the alert keeps its state
+				continue
+			}
+			a, ok := e.alerts[k]
+			if rule.Check(v) {
+				if !ok || a.State == StateResolved {
+					a = &Alert{Rule: rule.Name, ID: m.ID, MType: m.MType, Labels: m.Labels.Copy(), State: StatePending, ActiveSince: now}
+					e.alerts[k] = a
+					changed = append(changed, *a)
+				}
+				a.Value = v
+				a.Threshold = rule.Threshold
+				a.EvaluatedAt = now
+				if a.State == StatePending && now.Sub(a.ActiveSince) >= rule.For {
+					firedAt := now
+					a.State = StateFiring
+					a.FiredAt = &firedAt
+					changed = append(changed, *a)
+				}
+				continue
+			}
+			if ok {
+				a.Value = v
+				a.EvaluatedAt = now
+				if e.resolve(k, a, now) {
+					changed = append(changed, *a)
+				}
+			}
+		}
+	}
+
+	for k, a := range e.alerts {
+		if _, ok := seen[k]; !ok && a.State != StateResolved {
+			// the series was deleted or expired
+			a.EvaluatedAt = now
+			if e.resolve(k, a, now) {
+				changed = append(changed, *a)
+			}
+		}
+		if a.State == StateResolved && now.Sub(*a.ResolvedAt) >= retention {
+			delete(e.alerts, k)
+		}
+	}
+	return changed
+}
+
+// resolve ends a pending or firing alert, true when a firing one became resolved; caller holds mu.
+func (e *Engine) resolve(k string, a *Alert, now time.Time) bool {
+	switch a.State {
+	case StatePending:
+		delete(e.alerts, k)
+	case StateFiring:
+		resolvedAt := now
+		a.State = StateResolved
+		a.ResolvedAt = &resolvedAt
+		return true
+	}
+	return false
+}
+
+// Alerts returns alerts in the given states, all states when none are given; firing first, then by rule and series.
+func (e *Engine) Alerts(states ...State) []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	res := []Alert{}
+	for _, a := range e.alerts {
+		if len(states) > 0 && !hasState(states, a.State) {
+			continue
+		}
+		res = append(res, *a)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].State != res[j].State {
+			return stateOrder(res[i].State) < stateOrder(res[j].State)
+		}
+		if res[i].Rule != res[j].Rule {
+			return res[i].Rule < res[j].Rule
+		}
+		return types.SeriesKey(res[i].ID, res[i].Labels) < types.SeriesKey(res[j].ID, res[j].Labels)
+	})
+	return res
+}
+
+func hasState(states []State, s State) bool {
+	for _, st := range states {
+		if st == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stateOrder(s State) int {
+	switch s {
+	case StateFiring:
+		return 0
+	case StatePending:
+		return 1
+	}
+	return 2
+}
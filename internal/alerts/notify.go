@@ -0,0 +1,281 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+const (
+	DefaultSubjectTemplate = `[{{.State}}] {{.Rule}}: {{.ID}}{{.Labels}}`
+	DefaultBodyTemplate    = `{{.ID}}{{.Labels}} = {{.Value}}, rule "{{.Rule}}" is {{.State}}.
+Active since: {{.ActiveSince.Format "2006-01-02 15:04:05 MST"}}
+{{- if .ResolvedAt}}
+Resolved at: {{.ResolvedAt.Format "2006-01-02 15:04:05 MST"}}{{end}}
+`
+)
+
+const (
+	// notifyQueueSize messages wait for delivery before new ones are dropped.
+	notifyQueueSize = 1024
+	// notifyLogSize entries are kept in the notification log.
+	notifyLogSize = 1000
+)
+
+// Delivery outcomes in the notification log.
+const (
+	DeliverySent        = "sent"
+	DeliveryFailed      = "failed"
+	DeliveryRateLimited = "rate_limited"
+	DeliveryDropped     = "dropped"
+)
+
+// Message is one rendered alert notification.
+type Message struct {
+	Alert   Alert  `json:"alert"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier delivers messages to one channel.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, msg Message) error
+}
+
+// PermanentError marks a delivery failure that retrying cannot fix, e.g. a 4xx answer.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// LogEntry is one delivery attempt outcome.
+type LogEntry struct {
+	Time     time.Time `json:"time"`
+	Notifier string    `json:"notifier"`
+	Rule     string    `json:"rule"`
+	Key      string    `json:"key"`
+	State    State     `json:"state"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Dispatcher renders firing and resolved alerts and delivers them to every notifier
+// with retries and a per-notifier rate limit, each notifier has its own queue so a slow one does not hold up the rest.
+type Dispatcher struct {
+	Notifiers []Notifier
+	// SubjectTemplate and BodyTemplate are text/template over Alert, empty ones use the defaults
+	SubjectTemplate string
+	BodyTemplate    string
+	// Retries is the number of attempts after the first, RetryDelay doubles after each
+	Retries    int
+	RetryDelay time.Duration
+	// RateLimit firing messages per RatePeriod and notifier, 0 is unlimited; resolved ones are never
+	// held back, so an alert that got through is not left open at the receiver
+	RateLimit  int
+	RatePeriod time.Duration
+
+	subject  *template.Template
+	body     *template.Template
+	queues   []chan Message
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+
+	logMu sync.Mutex
+	log   []LogEntry
+	// logNext is the ring position of the next entry once log is full
+	logNext int
+}
+
+func (d *Dispatcher) Start(mainCtx context.Context) error {
+	subjectText, bodyText := d.SubjectTemplate, d.BodyTemplate
+	if len(subjectText) < 1 {
+		subjectText = DefaultSubjectTemplate
+	}
+	if len(bodyText) < 1 {
+		bodyText = DefaultBodyTemplate
+	}
+	var err error
+	d.subject, err = template.New("subject").Parse(subjectText)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("alerts.Dispatcher.Start(): subject template fail: %w", err))
+	}
+	d.body, err = template.New("body").Parse(bodyText)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("alerts.Dispatcher.Start(): body template fail: %w", err))
+	}
+	if d.RatePeriod <= 0 {
+		d.RatePeriod = time.Minute
+	}
+
+	d.done = make(chan struct{})
+	d.queues = make([]chan Message, len(d.Notifiers))
+	for i, n := range d.Notifiers {
+		d.queues[i] = make(chan Message, notifyQueueSize)
+		d.wg.Add(1)
+		go d.deliverLoop(mainCtx, n, d.queues[i])
+	}
+	return nil
+}
+
+// Stop delivers what is queued, pending retries are cut short after configs.GlobalDefaultTimeout.
+func (d *Dispatcher) Stop(mainCtx context.Context) {
+	if d.done == nil {
+		return
+	}
+	d.stopOnce.Do(func() {
+		for _, q := range d.queues {
+			close(q)
+		}
+		drained := make(chan struct{})
+		go func() {
+			d.wg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(configs.GlobalDefaultTimeout):
+			close(d.done)
+			<-drained
+		}
+	})
+}
+
+// Dispatch queues firing and resolved alerts, pending ones are not worth a message.
+func (d *Dispatcher) Dispatch(changed []Alert) {
+	for _, a := range changed {
+		if a.State != StateFiring && a.State != StateResolved {
+			continue
+		}
+		msg, err := d.render(a)
+		if err != nil {
+			log.Println(types.NewTimeError(fmt.Errorf("alerts.Dispatcher.Dispatch(): fail: %w", err)))
+			continue
+		}
+		for i, q := range d.queues {
+			select {
+			case q <- msg:
+			default:
+				d.record(d.Notifiers[i].Name(), msg.Alert, DeliveryDropped, 0, fmt.Errorf("queue full"))
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) render(a Alert) (Message, error) {
+	var subject, body strings.Builder
+	if err := d.subject.Execute(&subject, a); err != nil {
+		return Message{}, err
+	}
+	if err := d.body.Execute(&body, a); err != nil {
+		return Message{}, err
+	}
+	return Message{Alert: a, Subject: strings.TrimSpace(subject.String()), Body: body.String()}, nil
+}
+
+func (d *Dispatcher) deliverLoop(mainCtx context.Context, n Notifier, q chan Message) {
+	defer d.wg.Done()
+	sent := []time.Time{}
+	for msg := range q {
+		now := time.Now()
+		if d.RateLimit > 0 && msg.Alert.State != StateResolved {
+			// sliding window of the last RatePeriod
+			kept := sent[:0]
+			for _, t := range sent {
+				if now.Sub(t) < d.RatePeriod {
+					kept = append(kept, t)
+				}
+			}
+			sent = kept
+			if len(sent) >= d.RateLimit {
+				d.record(n.Name(), msg.Alert, DeliveryRateLimited, 0, fmt.Errorf("%d messages per %v", d.RateLimit, d.RatePeriod))
+				continue
+			}
+			sent = append(sent, now)
+		}
+		attempts, err := d.deliver(mainCtx, n, msg)
+		if err != nil {
+			d.record(n.Name(), msg.Alert, DeliveryFailed, attempts, err)
+			continue
+		}
+		d.record(n.Name(), msg.Alert, DeliverySent, attempts, nil)
+	}
+}
+
+// deliver tries msg up to 1+Retries times, returns the attempts made.
+func (d *Dispatcher) deliver(mainCtx context.Context, n Notifier, msg Message) (int, error) {
+	delay := d.RetryDelay
+	attempt := 0
+	for {
+		attempt++
+		err := n.Notify(mainCtx, msg)
+		if err == nil {
+			return attempt, nil
+		}
+		var permanent *PermanentError
+		if errors.As(err, &permanent) || attempt > d.Retries {
+			return attempt, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-d.done:
+			return attempt, err
+		case <-mainCtx.Done():
+			return attempt, err
+		}
+		delay *= 2
+	}
+}
+
+func (d *Dispatcher) record(notifier string, a Alert, status string, attempts int, err error) {
+	entry := LogEntry{
+		Time:     time.Now(),
+		Notifier: notifier,
+		Rule:     a.Rule,
+		Key:      types.SeriesKey(a.ID, a.Labels),
+		State:    a.State,
+		Status:   status,
+		Attempts: attempts,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		log.Println(types.NewTimeError(fmt.Errorf("alerts.Dispatcher: %v %v %v %v: %w", notifier, entry.Key, a.State, status, err)))
+	}
+
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	if len(d.log) < notifyLogSize {
+		d.log = append(d.log, entry)
+		return
+	}
+	d.log[d.logNext] = entry
+	d.logNext = (d.logNext + 1) % notifyLogSize
+}
+
+// Log returns the notification log, oldest first.
+func (d *Dispatcher) Log() []LogEntry {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+
+	res := make([]LogEntry, 0, len(d.log))
+	res = append(res, d.log[d.logNext:]...)
+	res = append(res, d.log[:d.logNext]...)
+	return res
+}
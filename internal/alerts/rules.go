@@ -0,0 +1,137 @@
+package alerts
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// Rule fires for every series whose ID matches IDPattern, whose labels include Labels
+// and whose value satisfies Op Threshold for at least For.
+type Rule struct {
+	Name      string
+	IDPattern string
+	Labels    types.Labels
+	Op        string
+	Threshold float64
+	For       time.Duration
+}
+
+// ruleRe reads "ID[{k=v,...}] op number[unit] [for duration]".
+var ruleRe = regexp.MustCompile(`^([^\s{<>=!]+)(\{[^}]*\})?\s*(<=|>=|==|!=|<|>)\s*([-+]?[0-9.]+(?:[eE][-+]?[0-9]+)?)\s*([A-Za-z%]*)(?:\s+for\s+(\S+))?$`)
+
+// ruleUnits scale thresholds, byte units are powers of 1024 as reported by the agent memory metrics.
+var ruleUnits = map[string]float64{
+	"":   1,
+	"%":  1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ParseRule reads one rule, e.g. "FreeMemory < 500MB for 5m" or "CPUutilization*{host=web1} > 90".
+// The ID is a path.Match glob, labels must match exactly.
+func ParseRule(s string) (Rule, error) {
+	s = strings.TrimSpace(s)
+	parts := ruleRe.FindStringSubmatch(s)
+	if parts == nil {
+		return Rule{}, fmt.Errorf("rule %q: want \"ID[{label=value}] op threshold[unit] [for duration]\"", s)
+	}
+	rule := Rule{Name: s, IDPattern: parts[1], Op: parts[3]}
+	if _, err := path.Match(rule.IDPattern, ""); err != nil {
+		return Rule{}, fmt.Errorf("rule %q: bad ID pattern: %w", s, err)
+	}
+	if len(parts[2]) > 0 {
+		labels, err := parseRuleLabels(strings.Trim(parts[2], "{}"))
+		if err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %w", s, err)
+		}
+		rule.Labels = labels
+	}
+	threshold, err := strconv.ParseFloat(parts[4], 64)
+	if err != nil || math.IsInf(threshold, 0) {
+		return Rule{}, fmt.Errorf("rule %q: bad threshold %q", s, parts[4])
+	}
+	scale, ok := ruleUnits[strings.ToUpper(parts[5])]
+	if !ok {
+		return Rule{}, fmt.Errorf("rule %q: unknown unit %q", s, parts[5])
+	}
+	rule.Threshold = threshold * scale
+	if len(parts[6]) > 0 {
+		rule.For, err = time.ParseDuration(parts[6])
+		if err != nil || rule.For < 0 {
+			return Rule{}, fmt.Errorf("rule %q: bad for duration %q", s, parts[6])
+		}
+	}
+	return rule, nil
+}
+
+// ParseRules reads rules separated by ';' or new lines, blank entries and '#' comments are skipped.
+func ParseRules(s string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, line := range strings.FieldsFunc(s, func(c rune) bool { return c == ';' || c == '\n' }) {
+		line = strings.TrimSpace(line)
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRuleLabels(s string) (types.Labels, error) {
+	labels := types.Labels{}
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) < 1 {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad label matcher %q", pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+	if !labels.IsValid() {
+		return nil, fmt.Errorf("bad labels %v", labels)
+	}
+	return labels, nil
+}
+
+// Match reports whether the rule applies to m.
+func (r Rule) Match(m types.Metrics) bool {
+	if ok, _ := path.Match(r.IDPattern, m.ID); !ok {
+		return false
+	}
+	return m.Labels.Match(r.Labels)
+}
+
+// Check compares v with the threshold.
+func (r Rule) Check(v float64) bool {
+	switch r.Op {
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "==":
+		return v == r.Threshold
+	case "!=":
+		return v != r.Threshold
+	}
+	return false
+}
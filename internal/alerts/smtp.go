@@ -0,0 +1,74 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier mails every Message to To through the server at Address (host:port).
+// Auth is used when Username is set, STARTTLS when the server offers it.
+type SMTPNotifier struct {
+	Address  string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (n *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, msg Message) error {
+	if len(n.To) < 1 {
+		return &PermanentError{Err: fmt.Errorf("smtp: no recipients")}
+	}
+	var auth smtp.Auth
+	if len(n.Username) > 0 {
+		host, _, err := net.SplitHostPort(n.Address)
+		if err != nil {
+			return &PermanentError{Err: err}
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(n.Address, auth, n.From, n.To, n.mail(msg))
+	}()
+	select {
+	case err := <-errCh:
+		var replyErr *textproto.Error
+		if errors.As(err, &replyErr) && replyErr.Code >= 500 {
+			return &PermanentError{Err: fmt.Errorf("smtp %v: %w", n.Address, err)}
+		}
+		if err != nil {
+			return fmt.Errorf("smtp %v: %w", n.Address, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mail builds an RFC 5322 plain text message with CRLF line ends.
+func (n *SMTPNotifier) mail(msg Message) []byte {
+	var sb strings.Builder
+	sb.WriteString("From: " + n.From + "\r\n")
+	sb.WriteString("To: " + strings.Join(n.To, ", ") + "\r\n")
+	sb.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	sb.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	sb.WriteString("\r\n")
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	sb.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(sb.String())
+}
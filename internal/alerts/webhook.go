@@ -0,0 +1,72 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+)
+
+// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the body under the server HashKey.
+const SignatureHeader = "X-Signature-256"
+
+// WebhookNotifier POSTs every Message as JSON to URL.
+type WebhookNotifier struct {
+	URL     string
+	HashKey []byte
+	Client  *http.Client
+}
+
+func (n *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, configs.GlobalDefaultTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.HashKey) > 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(n.HashKey, body))
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook %v: status %v", n.URL, resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// Sign returns the hex HMAC-SHA256 of body, receivers compare it with SignatureHeader.
+func Sign(key []byte, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
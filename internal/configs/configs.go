@@ -14,8 +14,53 @@ type ServerConfig struct {
 	StoreInterval time.Duration
 	StoreFileName string
 	IsRestore     bool
+	StoreWAL      bool
 	HashKey       []byte
 	DSN           string
+	MaxSampleAge  time.Duration
+	MaxSampleSkew time.Duration
+	HistorySize   int
+	MigrateOnly   bool
+	// StatsdAddress enables the StatsD UDP listener when set
+	StatsdAddress       string
+	StatsdFlushInterval time.Duration
+	// GraphiteAddress enables the Graphite plaintext TCP listener when set
+	GraphiteAddress   string
+	GraphiteTemplates string
+	GraphiteMaxConns  int
+	// InfluxCounterFields are ',' separated ID globs, matching integer fields are cumulative counters
+	InfluxCounterFields string
+	// GRPCAddress enables the gRPC API when set
+	GRPCAddress string
+	// StreamSlowPolicy is "drop" or "disconnect" for /stream and gRPC Subscribe consumers that fall behind
+	StreamSlowPolicy string
+	// IdempotencyTTL is how long Idempotency-Key responses are replayed, 0 disables it
+	IdempotencyTTL time.Duration
+	// SeriesTTL evicts series without updates for this long from every storage, 0 keeps them forever
+	SeriesTTL time.Duration
+	// MaxSeries and MaxClientSeries cap distinct series overall and per client address, 0 is unlimited
+	MaxSeries       int
+	MaxClientSeries int
+	// SeriesAllowlist are ',' separated ID globs new series must match, empty allows all
+	SeriesAllowlist string
+	// AlertRules are ';' separated rules, AlertRulesFile holds one rule per line; see alerts.ParseRule
+	AlertRules     string
+	AlertRulesFile string
+	AlertInterval  time.Duration
+	// NotifyWebhookURL gets firing and resolved alerts as JSON signed with HashKey
+	NotifyWebhookURL string
+	// NotifySMTPAddress (host:port) mails them from NotifySMTPFrom to the ',' separated NotifySMTPTo
+	NotifySMTPAddress  string
+	NotifySMTPFrom     string
+	NotifySMTPTo       string
+	NotifySMTPUser     string
+	NotifySMTPPassword string
+	// NotifySubject and NotifyBody are text/template over the alert, empty for the defaults
+	NotifySubject string
+	NotifyBody    string
+	NotifyRetries int
+	// NotifyRateLimit is messages per minute and channel, 0 is unlimited
+	NotifyRateLimit int
 }
 
 type AgentConfig struct {
@@ -25,6 +70,9 @@ type AgentConfig struct {
 	HashKey        []byte
 	DSN            string
 	RateLimit      uint64
+	// Transport is "http" (JSON to /updates/) or "grpc" (UpdateBatch to GRPCAddress)
+	Transport   string
+	GRPCAddress string
 }
 
 func InitServerConfig() ServerConfig {
@@ -42,6 +90,8 @@ func InitServerConfig() ServerConfig {
 	defaultStoreFile := "/tmp/devops-metrics-db.json"
 	flag.StringVar(&config.StoreFileName, "f", defaultStoreFile, "store filepath")
 
+	flag.BoolVar(&config.StoreWAL, "wal", false, "append updates to a write-ahead log next to the store file")
+
 	defaultHashKey := ""
 	HashKeyStr := ""
 	flag.StringVar(&HashKeyStr, "k", defaultHashKey, "hash key")
@@ -49,6 +99,57 @@ func InitServerConfig() ServerConfig {
 	defaultDSN := ""
 	flag.StringVar(&config.DSN, "d", defaultDSN, "db DSN string")
 
+	flag.BoolVar(&config.MigrateOnly, "migrate-only", false, "apply DB schema migrations and exit")
+
+	flag.DurationVar(&config.MaxSampleAge, "max-age", 0, "reject samples older than this, 0 to accept all")
+	flag.DurationVar(&config.MaxSampleSkew, "max-future", 0, "reject samples newer than now plus this, 0 to accept all")
+
+	defaultHistorySize := 360
+	flag.IntVar(&config.HistorySize, "history", defaultHistorySize, "points of history kept per series, 0 to disable")
+
+	flag.StringVar(&config.StatsdAddress, "statsd", "", "StatsD UDP address to listen on, empty to disable")
+	defaultStatsdFlushInterval := 10 * time.Second
+	flag.DurationVar(&config.StatsdFlushInterval, "statsd-flush", defaultStatsdFlushInterval, "aggregate StatsD samples and flush on this interval, 0 to write every sample")
+
+	flag.StringVar(&config.GraphiteAddress, "graphite", "", "Graphite plaintext TCP address to listen on, empty to disable")
+	flag.StringVar(&config.GraphiteTemplates, "graphite-templates", "", "';' separated Graphite templates, e.g. \"servers.* .host.measurement*\"")
+	defaultGraphiteMaxConns := 100
+	flag.IntVar(&config.GraphiteMaxConns, "graphite-max-conns", defaultGraphiteMaxConns, "max concurrent Graphite connections")
+
+	flag.StringVar(&config.InfluxCounterFields, "influx-counters", "", "',' separated measurement_field globs whose integer values are cumulative counters, others are gauges")
+
+	flag.StringVar(&config.GRPCAddress, "grpc", "", "gRPC address to listen on, empty to disable")
+
+	defaultStreamSlowPolicy := "drop"
+	flag.StringVar(&config.StreamSlowPolicy, "stream-slow", defaultStreamSlowPolicy, "slow stream subscriber policy: drop updates or disconnect")
+
+	defaultIdempotencyTTL := time.Hour
+	flag.DurationVar(&config.IdempotencyTTL, "idempotency-ttl", defaultIdempotencyTTL, "how long Idempotency-Key responses are kept, 0 to disable")
+
+	flag.DurationVar(&config.SeriesTTL, "series-ttl", 0, "evict series without updates for this long, 0 to keep them forever")
+
+	flag.IntVar(&config.MaxSeries, "max-series", 0, "max distinct series stored, 0 for no limit")
+	flag.IntVar(&config.MaxClientSeries, "max-client-series", 0, "max distinct series one client address may create, 0 for no limit")
+	flag.StringVar(&config.SeriesAllowlist, "series-allow", "", "',' separated ID globs new series must match, empty to allow all")
+
+	flag.StringVar(&config.AlertRules, "alert-rules", "", "';' separated alert rules, e.g. \"FreeMemory < 500MB for 5m; CPUutilization* > 90\"")
+	flag.StringVar(&config.AlertRulesFile, "alert-rules-file", "", "file with one alert rule per line, '#' starts a comment")
+	defaultAlertInterval := 15 * time.Second
+	flag.DurationVar(&config.AlertInterval, "alert-interval", defaultAlertInterval, "alert rules evaluation interval")
+
+	flag.StringVar(&config.NotifyWebhookURL, "notify-webhook", "", "URL to POST alert notifications to, empty to disable")
+	flag.StringVar(&config.NotifySMTPAddress, "notify-smtp", "", "SMTP server host:port for alert emails, empty to disable")
+	flag.StringVar(&config.NotifySMTPFrom, "notify-smtp-from", "collectalertagent@localhost", "alert email sender")
+	flag.StringVar(&config.NotifySMTPTo, "notify-smtp-to", "", "',' separated alert email recipients")
+	flag.StringVar(&config.NotifySMTPUser, "notify-smtp-user", "", "SMTP auth user, empty for no auth")
+	flag.StringVar(&config.NotifySMTPPassword, "notify-smtp-password", "", "SMTP auth password")
+	flag.StringVar(&config.NotifySubject, "notify-subject", "", "alert notification subject text/template, empty for the default")
+	flag.StringVar(&config.NotifyBody, "notify-body", "", "alert notification body text/template, empty for the default")
+	defaultNotifyRetries := 3
+	flag.IntVar(&config.NotifyRetries, "notify-retries", defaultNotifyRetries, "notification retries after the first attempt")
+	defaultNotifyRateLimit := 60
+	flag.IntVar(&config.NotifyRateLimit, "notify-rate", defaultNotifyRateLimit, "max notifications per minute and channel, 0 for no limit")
+
 	flag.Parse()
 
 	config.HashKey = []byte(HashKeyStr)
@@ -76,6 +177,10 @@ func InitServerConfig() ServerConfig {
 			config.IsRestore = false
 		}
 	}
+	envVal, envFound = os.LookupEnv("STORE_WAL")
+	if envFound {
+		config.StoreWAL = envVal == "true"
+	}
 	envVal, envFound = os.LookupEnv("KEY")
 	if envFound {
 		config.HashKey = []byte(envVal)
@@ -86,6 +191,167 @@ func InitServerConfig() ServerConfig {
 		config.DSN = envVal
 	}
 
+	envVal, envFound = os.LookupEnv("MIGRATE_ONLY")
+	if envFound {
+		config.MigrateOnly = envVal == "true"
+	}
+
+	envVal, envFound = os.LookupEnv("MAX_SAMPLE_AGE")
+	if envFound {
+		envDur, err := time.ParseDuration(envVal)
+		if err == nil {
+			config.MaxSampleAge = envDur
+		}
+	}
+	envVal, envFound = os.LookupEnv("MAX_SAMPLE_FUTURE")
+	if envFound {
+		envDur, err := time.ParseDuration(envVal)
+		if err == nil {
+			config.MaxSampleSkew = envDur
+		}
+	}
+	envVal, envFound = os.LookupEnv("HISTORY_SIZE")
+	if envFound {
+		sizeParsed, err := strconv.Atoi(envVal)
+		if err == nil && sizeParsed >= 0 {
+			config.HistorySize = sizeParsed
+		}
+	}
+	envVal, envFound = os.LookupEnv("STATSD_ADDRESS")
+	if envFound {
+		config.StatsdAddress = envVal
+	}
+	envVal, envFound = os.LookupEnv("STATSD_FLUSH_INTERVAL")
+	if envFound {
+		envDur, err := time.ParseDuration(envVal)
+		if err == nil {
+			config.StatsdFlushInterval = envDur
+		}
+	}
+	envVal, envFound = os.LookupEnv("GRAPHITE_ADDRESS")
+	if envFound {
+		config.GraphiteAddress = envVal
+	}
+	envVal, envFound = os.LookupEnv("GRAPHITE_TEMPLATES")
+	if envFound {
+		config.GraphiteTemplates = envVal
+	}
+	envVal, envFound = os.LookupEnv("GRAPHITE_MAX_CONNS")
+	if envFound {
+		connsParsed, err := strconv.Atoi(envVal)
+		if err == nil && connsParsed > 0 {
+			config.GraphiteMaxConns = connsParsed
+		}
+	}
+	envVal, envFound = os.LookupEnv("INFLUX_COUNTERS")
+	if envFound {
+		config.InfluxCounterFields = envVal
+	}
+	envVal, envFound = os.LookupEnv("GRPC_ADDRESS")
+	if envFound {
+		config.GRPCAddress = envVal
+	}
+	envVal, envFound = os.LookupEnv("STREAM_SLOW_POLICY")
+	if envFound {
+		config.StreamSlowPolicy = envVal
+	}
+	if config.StreamSlowPolicy != "disconnect" {
+		config.StreamSlowPolicy = defaultStreamSlowPolicy
+	}
+	envVal, envFound = os.LookupEnv("IDEMPOTENCY_TTL")
+	if envFound {
+		envDur, err := time.ParseDuration(envVal)
+		if err == nil {
+			config.IdempotencyTTL = envDur
+		}
+	}
+	envVal, envFound = os.LookupEnv("SERIES_TTL")
+	if envFound {
+		envDur, err := time.ParseDuration(envVal)
+		if err == nil {
+			config.SeriesTTL = envDur
+		}
+	}
+	envVal, envFound = os.LookupEnv("MAX_SERIES")
+	if envFound {
+		maxParsed, err := strconv.Atoi(envVal)
+		if err == nil && maxParsed >= 0 {
+			config.MaxSeries = maxParsed
+		}
+	}
+	envVal, envFound = os.LookupEnv("MAX_CLIENT_SERIES")
+	if envFound {
+		maxParsed, err := strconv.Atoi(envVal)
+		if err == nil && maxParsed >= 0 {
+			config.MaxClientSeries = maxParsed
+		}
+	}
+	envVal, envFound = os.LookupEnv("SERIES_ALLOW")
+	if envFound {
+		config.SeriesAllowlist = envVal
+	}
+	envVal, envFound = os.LookupEnv("ALERT_RULES")
+	if envFound {
+		config.AlertRules = envVal
+	}
+	envVal, envFound = os.LookupEnv("ALERT_RULES_FILE")
+	if envFound {
+		config.AlertRulesFile = envVal
+	}
+	envVal, envFound = os.LookupEnv("ALERT_INTERVAL")
+	if envFound {
+		envDur, err := time.ParseDuration(envVal)
+		if err == nil && envDur > 0 {
+			config.AlertInterval = envDur
+		}
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_WEBHOOK_URL")
+	if envFound {
+		config.NotifyWebhookURL = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_SMTP_ADDRESS")
+	if envFound {
+		config.NotifySMTPAddress = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_SMTP_FROM")
+	if envFound {
+		config.NotifySMTPFrom = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_SMTP_TO")
+	if envFound {
+		config.NotifySMTPTo = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_SMTP_USER")
+	if envFound {
+		config.NotifySMTPUser = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_SMTP_PASSWORD")
+	if envFound {
+		config.NotifySMTPPassword = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_SUBJECT")
+	if envFound {
+		config.NotifySubject = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_BODY")
+	if envFound {
+		config.NotifyBody = envVal
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_RETRIES")
+	if envFound {
+		retriesParsed, err := strconv.Atoi(envVal)
+		if err == nil && retriesParsed >= 0 {
+			config.NotifyRetries = retriesParsed
+		}
+	}
+	envVal, envFound = os.LookupEnv("NOTIFY_RATE_LIMIT")
+	if envFound {
+		rateParsed, err := strconv.Atoi(envVal)
+		if err == nil && rateParsed >= 0 {
+			config.NotifyRateLimit = rateParsed
+		}
+	}
+
 	return config
 }
 
@@ -112,6 +378,12 @@ func InitAgentConfig() AgentConfig {
 	defaultRateLimit := uint64(1)
 	flag.Uint64Var(&config.RateLimit, "l", defaultRateLimit, "send rate limit")
 
+	defaultTransport := "http"
+	flag.StringVar(&config.Transport, "t", defaultTransport, "report transport: http or grpc")
+
+	defaultGRPCAddress := "127.0.0.1:3200"
+	flag.StringVar(&config.GRPCAddress, "g", defaultGRPCAddress, "server gRPC address for grpc transport")
+
 	flag.Parse()
 
 	config.HashKey = []byte(HashKeyStr)
@@ -156,5 +428,15 @@ func InitAgentConfig() AgentConfig {
 
 	}
 
+	envVal, envFound = os.LookupEnv("TRANSPORT")
+	if envFound {
+		config.Transport = envVal
+	}
+
+	envVal, envFound = os.LookupEnv("GRPC_ADDRESS")
+	if envFound {
+		config.GRPCAddress = envVal
+	}
+
 	return config
 }
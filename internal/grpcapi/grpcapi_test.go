@@ -0,0 +1,220 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/handlers"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/storages"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var testKey = []byte("secret")
+
+// startBufconn serves a Server over an in-memory listener and returns a client for it.
+func startBufconn(t *testing.T, config *configs.ServerConfig) MetricsClient {
+	ctx := context.Background()
+	mem := &storages.MemStorage{}
+	mem.Init(ctx)
+	broker := repositories.NewBroker()
+	s := &Server{
+		Repo:   repositories.NewPublishing(mem, broker),
+		Broker: broker,
+		Config: config,
+	}
+	ln := bufconn.Listen(1 << 20)
+	s.serve(ln)
+	t.Cleanup(func() { s.Stop(ctx) })
+
+	conn, err := Dial(ctx, "bufconn", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return ln.DialContext(ctx)
+	}))
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewMetricsClient(conn)
+}
+
+func signedCounter(id string, delta int64, labels types.Labels) *Metric {
+	m, _ := types.NewMetric(id, types.CounterType, types.IncrementSource)
+	m.Set(delta)
+	m.Labels = labels
+	m.Timestamp = 1700000000000
+	m.GenHash(testKey)
+	return NewMetric(*m)
+}
+
+func TestUpdateBatchRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client := startBufconn(t, &configs.ServerConfig{HashKey: testKey})
+
+	latency, _ := types.NewHistogram("Latency", []float64{1, 10}, types.OsSource)
+	latency.Observe(0.5)
+	latency.Observe(20)
+	latency.GenHash(testKey)
+	forged := signedCounter("Forged", 1, nil)
+	forged.Hash = "00"
+
+	resp, err := client.UpdateBatch(ctx, &UpdateBatchRequest{Metrics: []*Metric{
+		signedCounter("PollCount", 2, types.Labels{"host": "a"}),
+		signedCounter("PollCount", 3, types.Labels{"host": "a"}),
+		NewMetric(*latency),
+		forged,
+	}})
+	if err != nil {
+		t.Fatalf("UpdateBatch() = %v", err)
+	}
+	if resp.GetRejected() != 1 || len(resp.GetMetrics()) != 2 {
+		t.Fatalf("response = %v, want 2 stored series and 1 rejected", resp)
+	}
+	for _, pm := range resp.GetMetrics() {
+		if err := pm.Metrics().CheckHash(testKey); err != nil {
+			t.Errorf("%v: %v", pm.GetId(), err)
+		}
+	}
+
+	got, err := client.GetMetric(ctx, &GetMetricRequest{Id: "PollCount", Type: "counter", Labels: map[string]string{"host": "a"}})
+	if err != nil || got.GetDelta() != 5 {
+		t.Fatalf("GetMetric() = %v, %v; want delta 5", got, err)
+	}
+	got, err = client.GetMetric(ctx, &GetMetricRequest{Id: "Latency"})
+	if err != nil || got.GetDelta() != 2 || got.GetValue() != 20.5 || len(got.GetCounts()) != 3 || got.GetCounts()[2] != 1 {
+		t.Fatalf("GetMetric() = %v, %v; want the histogram", got, err)
+	}
+	if _, err := client.GetMetric(ctx, &GetMetricRequest{Id: "Forged"}); err == nil {
+		t.Errorf("GetMetric() found a rejected metric")
+	}
+
+	list, err := client.ListMetrics(ctx, &MetricsFilter{Type: "histogram"})
+	if err != nil || len(list.GetMetrics()) != 1 || list.GetMetrics()[0].GetId() != "Latency" {
+		t.Errorf("ListMetrics() = %v, %v; want Latency", list, err)
+	}
+}
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := startBufconn(t, &configs.ServerConfig{HashKey: testKey})
+
+	stream, err := client.Subscribe(ctx, &MetricsFilter{Ids: []string{"PollCount"}})
+	if err != nil {
+		t.Fatalf("Subscribe() = %v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("Header() = %v", err)
+	}
+
+	for _, delta := range []int64{2, 3} {
+		_, err := client.UpdateBatch(ctx, &UpdateBatchRequest{Metrics: []*Metric{
+			signedCounter("PollCount", delta, nil),
+			signedCounter("Other", 1, nil),
+		}})
+		if err != nil {
+			t.Fatalf("UpdateBatch() = %v", err)
+		}
+	}
+	for _, want := range []int64{2, 5} {
+		pm, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		m := pm.Metrics()
+		if m.ID != "PollCount" || m.GetDelta() != want || m.CheckHash(testKey) != nil {
+			t.Errorf("Recv() = %v, want signed PollCount %d", pm, want)
+		}
+	}
+}
+
+func TestUpdateBatchResults(t *testing.T) {
+	ctx := context.Background()
+	client := startBufconn(t, &configs.ServerConfig{HashKey: testKey, MaxSampleAge: time.Hour})
+
+	signAt := func(pm *Metric, at time.Time) *Metric {
+		pm.Timestamp = at.UnixMilli()
+		m := pm.Metrics()
+		m.GenHash(testKey)
+		pm.Hash = m.Hash
+		return pm
+	}
+	sign := func(pm *Metric) *Metric {
+		return signAt(pm, time.Now())
+	}
+	counter := func(id string, delta int64) *Metric {
+		return sign(&Metric{Id: id, Type: string(types.CounterType), Delta: &delta})
+	}
+	gauge := func(id string, v float64) *Metric {
+		return sign(&Metric{Id: id, Type: string(types.GaugeType), Value: &v})
+	}
+	count, sum := int64(5), 1.0
+	// the counts add up to 2, not to the total count 5
+	badHistogram := sign(&Metric{Id: "Latency", Type: string(types.HistogramType), Delta: &count, Value: &sum, Buckets: []float64{1}, Counts: []int64{1, 1}})
+	noDelta := sign(&Metric{Id: "NoDelta", Type: string(types.CounterType)})
+	oneDelta := int64(1)
+	old := signAt(&Metric{Id: "Old", Type: string(types.CounterType), Delta: &oneDelta}, time.Now().Add(-2*time.Hour))
+
+	if _, err := client.UpdateBatch(ctx, &UpdateBatchRequest{Metrics: []*Metric{gauge("Stored", 1)}}); err != nil {
+		t.Fatalf("UpdateBatch() = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		metrics []*Metric
+		want    []string
+	}{
+		{"best-effort", "", []*Metric{counter("PollCount", 1), badHistogram, noDelta, old, counter("Stored", 1), gauge("Alloc", 2)},
+			[]string{handlers.ItemAccepted, handlers.ItemRejected, handlers.ItemRejected, handlers.ItemRejected, handlers.ItemRejected, handlers.ItemAccepted}},
+		{"atomic with an invalid item", handlers.BatchAtomic, []*Metric{counter("PollCount", 1), noDelta},
+			[]string{handlers.ItemNotApplied, handlers.ItemRejected}},
+		{"atomic refused by the storage", handlers.BatchAtomic, []*Metric{counter("PollCount", 1), counter("Stored", 1)},
+			[]string{handlers.ItemNotApplied, handlers.ItemRejected}},
+		{"atomic", handlers.BatchAtomic, []*Metric{counter("PollCount", 1), gauge("Alloc", 3)},
+			[]string{handlers.ItemAccepted, handlers.ItemAccepted}},
+	}
+	for _, tt := range tests {
+		resp, err := client.UpdateBatch(ctx, &UpdateBatchRequest{Metrics: tt.metrics, Mode: tt.mode})
+		if err != nil {
+			t.Fatalf("%v: UpdateBatch() = %v", tt.name, err)
+		}
+		rejected := 0
+		if len(resp.GetResults()) != len(tt.want) {
+			t.Fatalf("%v: results = %v, want %d", tt.name, resp.GetResults(), len(tt.want))
+		}
+		for i, res := range resp.GetResults() {
+			if int(res.GetIndex()) != i || res.GetStatus() != tt.want[i] || res.GetId() != tt.metrics[i].GetId() {
+				t.Errorf("%v: results[%d] = %v, want %v", tt.name, i, res, tt.want[i])
+			}
+			if res.GetStatus() == handlers.ItemRejected && len(res.GetError()) < 1 {
+				t.Errorf("%v: results[%d] = %v, want an error", tt.name, i, res)
+			}
+			if res.GetStatus() != handlers.ItemAccepted {
+				rejected++
+			}
+		}
+		if int(resp.GetRejected()) != rejected {
+			t.Errorf("%v: rejected = %v, want %v", tt.name, resp.GetRejected(), rejected)
+		}
+	}
+
+	got, err := client.GetMetric(ctx, &GetMetricRequest{Id: "PollCount"})
+	if err != nil || got.GetDelta() != 2 {
+		t.Errorf("GetMetric(PollCount) = %v, %v; want 2 from the accepted batches", got, err)
+	}
+	for _, id := range []string{"Latency", "NoDelta", "Old"} {
+		if _, err := client.GetMetric(ctx, &GetMetricRequest{Id: id}); err == nil {
+			t.Errorf("GetMetric(%v) found a rejected metric", id)
+		}
+	}
+	if _, err := client.UpdateBatch(ctx, &UpdateBatchRequest{Mode: "all"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpdateBatch() with an unknown mode = %v, want InvalidArgument", err)
+	}
+}
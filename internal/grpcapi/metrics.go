@@ -0,0 +1,68 @@
+package grpcapi
+
+import (
+	"context"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
+
+// Dial connects to a Metrics server without TLS, like the HTTP API; NewMetricsClient wraps the connection.
+func Dial(ctx context.Context, address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	return grpc.DialContext(ctx, address, opts...)
+}
+
+// NewMetric converts m to its wire form, every field is kept so the HMAC still verifies.
+func NewMetric(m types.Metrics) *Metric {
+	return &Metric{
+		Id:        m.ID,
+		Type:      m.MType,
+		Delta:     m.Delta,
+		Value:     m.Value,
+		Buckets:   m.Buckets,
+		Counts:    m.Counts,
+		Labels:    m.Labels,
+		Timestamp: m.Timestamp,
+		Hash:      m.Hash,
+	}
+}
+
+// NewMetrics converts a batch with NewMetric.
+func NewMetrics(metrics []types.Metrics) []*Metric {
+	res := make([]*Metric, 0, len(metrics))
+	for _, m := range metrics {
+		res = append(res, NewMetric(m))
+	}
+	return res
+}
+
+// Metrics converts pm back, empty lists and labels become nil as in JSON.
+func (pm *Metric) Metrics() types.Metrics {
+	m := types.Metrics{
+		ID:        pm.GetId(),
+		MType:     pm.GetType(),
+		Delta:     pm.Delta,
+		Value:     pm.Value,
+		Timestamp: pm.GetTimestamp(),
+		Hash:      pm.GetHash(),
+	}
+	if len(pm.GetBuckets()) > 0 {
+		m.Buckets = pm.GetBuckets()
+	}
+	if len(pm.GetCounts()) > 0 {
+		m.Counts = pm.GetCounts()
+	}
+	if len(pm.GetLabels()) > 0 {
+		m.Labels = pm.GetLabels()
+	}
+	return m
+}
+
+func (f *MetricsFilter) filter() repositories.Filter {
+	return repositories.Filter{MType: types.DataType(f.GetType()), IDs: f.GetIds(), Labels: f.GetLabels()}
+}
@@ -0,0 +1,172 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/handlers"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// subscribeBuffer updates queued per subscriber before new ones are dropped.
+const subscribeBuffer = 256
+
+// Server serves the Metrics service over the same Repo as the HTTP router.
+type Server struct {
+	UnimplementedMetricsServer
+	Repo   repositories.Repo
+	Broker *repositories.Broker
+	Config *configs.ServerConfig
+	server *grpc.Server
+}
+
+var _ MetricsServer = (*Server)(nil)
+
+func (s *Server) Start(mainCtx context.Context) error {
+	ln, err := net.Listen("tcp", s.Config.GRPCAddress)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("grpcapi.Server.Start(): fail: %w", err))
+	}
+	s.serve(ln)
+	log.Println(types.NewTimeError(fmt.Errorf("grpcapi.Server: listen tcp %v", ln.Addr())))
+	return nil
+}
+
+func (s *Server) serve(ln net.Listener) {
+	s.server = grpc.NewServer()
+	RegisterMetricsServer(s.server, s)
+
+	go func() {
+		if err := s.server.Serve(ln); err != nil {
+			log.Println(types.NewTimeError(fmt.Errorf("grpcapi.Server.serve(): fail: %w", err)))
+		}
+	}()
+}
+
+// Stop waits for unary calls to finish and ends subscriptions.
+func (s *Server) Stop(mainCtx context.Context) {
+	if s.server == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(configs.GlobalDefaultTimeout):
+		s.server.Stop()
+	}
+}
+
+// UpdateBatch validates and applies the batch like /updates/ and reports every item,
+// only a storage failure not tied to an item fails the call.
+func (s *Server) UpdateBatch(ctx context.Context, in *UpdateBatchRequest) (*UpdateBatchResponse, error) {
+	mode := in.GetMode()
+	if len(mode) < 1 {
+		mode = handlers.BatchBestEffort
+	}
+	if mode != handlers.BatchAtomic && mode != handlers.BatchBestEffort {
+		return nil, status.Errorf(codes.InvalidArgument, "mode %q, want %v or %v", mode, handlers.BatchAtomic, handlers.BatchBestEffort)
+	}
+	metrics := make([]types.Metrics, 0, len(in.GetMetrics()))
+	for _, pm := range in.GetMetrics() {
+		metrics = append(metrics, pm.Metrics())
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		client, _, splitErr := net.SplitHostPort(p.Addr.String())
+		if splitErr != nil {
+			client = p.Addr.String()
+		}
+		ctx = repositories.WithClient(ctx, client)
+	}
+	batch, err := handlers.UpdateBatch(ctx, s.Repo, s.Config, metrics, mode)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if batch.Accepted > 0 {
+		s.Repo.FlushDB(ctx)
+	}
+	if batch.Rejected > 0 {
+		log.Println(types.NewTimeError(fmt.Errorf("grpcapi.UpdateBatch(): %v mode, %d accepted, %d rejected", mode, batch.Accepted, batch.Rejected)))
+	}
+
+	resp := &UpdateBatchResponse{Metrics: []*Metric{}, Rejected: int32(batch.Rejected), Results: make([]*ItemResult, 0, len(batch.Results))}
+	seen := map[string]struct{}{}
+	for i, res := range batch.Results {
+		resp.Results = append(resp.Results, &ItemResult{Index: int32(res.Index), Id: res.ID, Type: res.MType, Status: res.Status, Error: res.Error})
+		if res.Status != handlers.ItemAccepted {
+			continue
+		}
+		key := metrics[i].Key()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		stored, err := s.Repo.Get(key)
+		if err != nil {
+			continue
+		}
+		stored.GenHash(s.Config.HashKey)
+		resp.Metrics = append(resp.Metrics, NewMetric(stored))
+	}
+	return resp, nil
+}
+
+func (s *Server) GetMetric(ctx context.Context, in *GetMetricRequest) (*Metric, error) {
+	key := types.SeriesKey(in.GetId(), in.GetLabels())
+	m, err := s.Repo.Get(key)
+	if err != nil || (len(in.GetType()) > 0 && m.MType != in.GetType()) {
+		return nil, status.Errorf(codes.NotFound, "metric %v not found", key)
+	}
+	m.GenHash(s.Config.HashKey)
+	return NewMetric(m), nil
+}
+
+func (s *Server) ListMetrics(ctx context.Context, in *MetricsFilter) (*ListMetricsResponse, error) {
+	metrics, err := s.Repo.List(ctx, in.filter())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	for i := range metrics {
+		metrics[i].GenHash(s.Config.HashKey)
+	}
+	return &ListMetricsResponse{Metrics: NewMetrics(metrics)}, nil
+}
+
+func (s *Server) Subscribe(in *MetricsFilter, stream Metrics_SubscribeServer) error {
+	sub := s.Broker.Subscribe(in.filter(), subscribeBuffer, repositories.SlowPolicy(s.Config.StreamSlowPolicy))
+	defer s.Broker.Unsubscribe(sub)
+	// the headers tell the client that updates from now on reach it
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-sub.Overflow:
+			return status.Errorf(codes.ResourceExhausted, "subscriber too slow, %d updates dropped", sub.Dropped())
+		case m, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			m.GenHash(s.Config.HashKey)
+			if err := stream.Send(NewMetric(m)); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aaarkadev/collectalertagent/internal/alerts"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+type apiAlertsResponse struct {
+	Alerts []alerts.Alert `json:"alerts"`
+}
+
+type apiNotificationsResponse struct {
+	Notifications []alerts.LogEntry `json:"notifications"`
+}
+
+// HandlerAPIAlerts lists alerts as JSON on GET /api/alerts.
+// By default only active (pending and firing) alerts, ?state= takes ',' separated states or "all".
+func HandlerAPIAlerts(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil {
+		repoErr := types.NewTimeError(fmt.Errorf("HandlerAPIAlerts(): serverData fail"))
+		http.Error(w, repoErr.Error(), http.StatusBadRequest)
+		log.Fatalln(repoErr)
+		return
+	}
+
+	states := []alerts.State{alerts.StatePending, alerts.StateFiring}
+	if stateParam := r.URL.Query().Get("state"); len(stateParam) > 0 {
+		states = nil
+		if stateParam != "all" {
+			for _, s := range strings.Split(stateParam, ",") {
+				state := alerts.State(strings.TrimSpace(s))
+				if state != alerts.StatePending && state != alerts.StateFiring && state != alerts.StateResolved {
+					http.Error(w, "wrong state, want pending, firing, resolved or all", http.StatusBadRequest)
+					return
+				}
+				states = append(states, state)
+			}
+		}
+	}
+
+	resp := apiAlertsResponse{Alerts: []alerts.Alert{}}
+	if serverData.Alerts != nil {
+		resp.Alerts = serverData.Alerts.Alerts(states...)
+	}
+
+	txtM, err := json.Marshal(resp)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerAPIAlerts(): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(txtM)
+}
+
+// HandlerAPINotifications returns the alert notification log, oldest first, on GET /api/notifications.
+func HandlerAPINotifications(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil {
+		repoErr := types.NewTimeError(fmt.Errorf("HandlerAPINotifications(): serverData fail"))
+		http.Error(w, repoErr.Error(), http.StatusBadRequest)
+		log.Fatalln(repoErr)
+		return
+	}
+
+	resp := apiNotificationsResponse{Notifications: []alerts.LogEntry{}}
+	if serverData.Notifications != nil {
+		resp.Notifications = serverData.Notifications.Log()
+	}
+
+	txtM, err := json.Marshal(resp)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerAPINotifications(): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(txtM)
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiListParams are the /api/metrics query params, anything else is a label filter.
+var apiListParams = []string{"type", "id", "regex", "sort", "limit", "cursor"}
+
+type apiMetricsResponse struct {
+	Metrics    []types.Metrics `json:"metrics"`
+	Total      int             `json:"total"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// apiCursor is the position after the last returned series: its sort value and key.
+type apiCursor struct {
+	Sort  string  `json:"s,omitempty"`
+	Value float64 `json:"v,omitempty"`
+	Key   string  `json:"k"`
+}
+
+// apiSortKey orders series by one field, ties are broken by series key.
+type apiSortKey struct {
+	s string
+	v float64
+}
+
+// HandlerAPIMetrics lists series as JSON on GET /api/metrics.
+// Filters: type, id (glob), regex (on ID) and label=value params; sort: id, type, value or updated, "-" for descending;
+// pages of limit items continue from next_cursor, which stays valid while series are added.
+func HandlerAPIMetrics(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil || serverData.Repo == nil {
+		repoErr := types.NewTimeError(fmt.Errorf("HandlerAPIMetrics(): Repo fail"))
+		http.Error(w, repoErr.Error(), http.StatusBadRequest)
+		log.Fatalln(repoErr)
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := apiFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sortBy := query.Get("sort")
+	if len(sortBy) < 1 {
+		sortBy = "id"
+	}
+	isDesc := strings.HasPrefix(sortBy, "-")
+	sortField := strings.TrimPrefix(sortBy, "-")
+	if sortField != "id" && sortField != "type" && sortField != "value" && sortField != "updated" {
+		http.Error(w, "wrong sort, want id, type, value or updated", http.StatusBadRequest)
+		return
+	}
+	limit := apiDefaultLimit
+	if len(query.Get("limit")) > 0 {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			http.Error(w, fmt.Sprintf("wrong limit, want 1..%d", apiMaxLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	var cursor *apiCursor
+	if len(query.Get("cursor")) > 0 {
+		cursor, err = decodeAPICursor(query.Get("cursor"))
+		if err != nil {
+			http.Error(w, "wrong cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	matched, err := filter.list(r.Context(), serverData.Repo)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerAPIMetrics(): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+
+	keys := make(map[string]apiSortKey, len(matched))
+	for i := range matched {
+		keys[matched[i].Key()] = apiSortKeyOf(&matched[i], sortField)
+	}
+	less := func(aKey string, a apiSortKey, bKey string, b apiSortKey) bool {
+		if a != b {
+			if isDesc {
+				a, b = b, a
+			}
+			if a.s != b.s {
+				return a.s < b.s
+			}
+			return a.v < b.v
+		}
+		return aKey < bKey
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		iKey, jKey := matched[i].Key(), matched[j].Key()
+		return less(iKey, keys[iKey], jKey, keys[jKey])
+	})
+
+	resp := apiMetricsResponse{Metrics: []types.Metrics{}, Total: len(matched)}
+	start := 0
+	if cursor != nil {
+		after := apiSortKey{s: cursor.Sort, v: cursor.Value}
+		start = sort.Search(len(matched), func(i int) bool {
+			k := matched[i].Key()
+			return less(cursor.Key, after, k, keys[k])
+		})
+	}
+	end := start + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	for _, m := range matched[start:end] {
+		m.GenHash(serverData.Config.HashKey)
+		resp.Metrics = append(resp.Metrics, m)
+	}
+	if end < len(matched) {
+		last := matched[end-1].Key()
+		resp.NextCursor = encodeAPICursor(apiCursor{Sort: keys[last].s, Value: keys[last].v, Key: last})
+	}
+
+	txtM, err := json.Marshal(resp)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerAPIMetrics(): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(txtM)
+}
+
+// apiFilter is the series selection shared by listing and bulk delete.
+type apiFilter struct {
+	repositories.Filter
+	idGlob  string
+	idRegex *regexp.Regexp
+}
+
+func apiFilterFromQuery(r *http.Request) (apiFilter, error) {
+	query := r.URL.Query()
+	filter := apiFilter{
+		Filter: repositories.Filter{
+			MType:  types.DataType(query.Get("type")),
+			Labels: labelsFromQuery(r, apiListParams...),
+		},
+		idGlob: query.Get("id"),
+	}
+	if len(filter.MType) > 0 && !filter.MType.IsValid() {
+		return filter, fmt.Errorf("wrong type")
+	}
+	if _, err := path.Match(filter.idGlob, ""); err != nil {
+		return filter, fmt.Errorf("wrong id glob: %v", err)
+	}
+	if len(query.Get("regex")) > 0 {
+		idRegex, err := regexp.Compile(query.Get("regex"))
+		if err != nil {
+			return filter, fmt.Errorf("wrong regex: %v", err)
+		}
+		filter.idRegex = idRegex
+	}
+	return filter, nil
+}
+
+// isEmpty is true when the filter selects every series.
+func (f apiFilter) isEmpty() bool {
+	return len(f.MType) < 1 && len(f.Labels) < 1 && len(f.idGlob) < 1 && f.idRegex == nil
+}
+
+func (f apiFilter) list(ctx context.Context, repo repositories.Repo) ([]types.Metrics, error) {
+	metrics, err := repo.List(ctx, f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	matched := metrics[:0]
+	for _, m := range metrics {
+		if len(f.idGlob) > 0 {
+			if ok, _ := path.Match(f.idGlob, m.ID); !ok {
+				continue
+			}
+		}
+		if f.idRegex != nil && !f.idRegex.MatchString(m.ID) {
+			continue
+		}
+		matched = append(matched, m)
+	}
+	return matched, nil
+}
+
+func apiSortKeyOf(m *types.Metrics, field string) apiSortKey {
+	switch field {
+	case "type":
+		return apiSortKey{s: m.MType}
+	case "value":
+		return apiSortKey{v: m.Point().Value}
+	case "updated":
+		return apiSortKey{v: float64(m.Timestamp)}
+	}
+	// id order is the series key order, kept in the sort value so that "-id" reverses it
+	return apiSortKey{s: m.Key()}
+}
+
+func encodeAPICursor(c apiCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAPICursor(s string) (*apiCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &apiCursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
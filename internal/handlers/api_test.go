@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+func apiList(t *testing.T, serverData *servers.ServerHandlerData, query url.Values) apiMetricsResponse {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/metrics?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	HandlerAPIMetrics(context.Background(), w, r, serverData)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %v = %v %v", r.URL, w.Code, w.Body.String())
+	}
+	resp := apiMetricsResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHandlerAPIMetricsPaging(t *testing.T) {
+	for _, sortBy := range []string{"id", "-id", "value", "-value"} {
+		t.Run(sortBy, func(t *testing.T) {
+			serverData := newTestServerData(t)
+			for i := 0; i < 20; i++ {
+				// values repeat, so ties are broken by key
+				serverData.Repo.Set(*testGauge(fmt.Sprintf("s%02d", i), float64(i%4), nil))
+			}
+			// before reports whether a comes before b in the requested order
+			before := func(a, b types.Metrics) bool {
+				if sortBy == "value" || sortBy == "-value" {
+					if av, bv := a.Point().Value, b.Point().Value; av != bv {
+						return (av < bv) != (sortBy == "-value")
+					}
+					return a.Key() < b.Key()
+				}
+				return (a.Key() < b.Key()) != (sortBy == "-id")
+			}
+
+			seen := make(map[string]bool)
+			var prev *types.Metrics
+			query := url.Values{"sort": {sortBy}, "limit": {"3"}}
+			for page := 0; ; page++ {
+				resp := apiList(t, serverData, query)
+				if len(resp.Metrics) > 3 {
+					t.Fatalf("page %d has %d series, limit 3", page, len(resp.Metrics))
+				}
+				for i := range resp.Metrics {
+					m := resp.Metrics[i]
+					if seen[m.Key()] {
+						t.Errorf("page %d repeats %v", page, m.Key())
+					}
+					seen[m.Key()] = true
+					if prev != nil && !before(*prev, m) {
+						t.Errorf("page %d: %v after %v", page, m.Key(), prev.Key())
+					}
+					prev = &m
+				}
+				if len(resp.NextCursor) < 1 {
+					break
+				}
+				// series added between pages sort on both sides of the cursor
+				serverData.Repo.Set(*testGauge(fmt.Sprintf("n%02d", page), float64(page%4), nil))
+				serverData.Repo.Set(*testGauge(fmt.Sprintf("t%02d", page), float64(3-page%4), nil))
+				query.Set("cursor", resp.NextCursor)
+			}
+			for i := 0; i < 20; i++ {
+				if key := fmt.Sprintf("s%02d", i); !seen[key] {
+					t.Errorf("%v skipped", key)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerAPIMetricsFilters(t *testing.T) {
+	serverData := newTestServerData(t,
+		testGauge("Alloc", 3, nil),
+		testGauge("Alloc", 1, types.Labels{"host": "a"}),
+		testGauge("HeapAlloc", 2, types.Labels{"host": "b"}),
+		testCounter("PollCount", 5, types.Labels{"host": "a"}),
+		testCounter("requests", 7, nil),
+	)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Alloc", `Alloc{host="a"}`, `HeapAlloc{host="b"}`, `PollCount{host="a"}`, "requests"}},
+		{"type=counter", []string{`PollCount{host="a"}`, "requests"}},
+		{"id=*Alloc", []string{"Alloc", `Alloc{host="a"}`, `HeapAlloc{host="b"}`}},
+		{"id=Alloc", []string{"Alloc", `Alloc{host="a"}`}},
+		{"regex=^[a-z]", []string{"requests"}},
+		{"regex=Alloc$&type=gauge&host=a", []string{`Alloc{host="a"}`}},
+		{"host=a", []string{`Alloc{host="a"}`, `PollCount{host="a"}`}},
+		{"sort=-value", []string{"requests", `PollCount{host="a"}`, "Alloc", `HeapAlloc{host="b"}`, `Alloc{host="a"}`}},
+		{"sort=type&host=a", []string{`PollCount{host="a"}`, `Alloc{host="a"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			resp := apiList(t, serverData, query)
+			if resp.Total != len(tt.want) || len(resp.Metrics) != len(tt.want) {
+				t.Fatalf("got %d of %d series %+v, want %v", len(resp.Metrics), resp.Total, resp.Metrics, tt.want)
+			}
+			for i, m := range resp.Metrics {
+				if m.Key() != tt.want[i] {
+					t.Errorf("metrics[%d] = %v, want %v", i, m.Key(), tt.want[i])
+				}
+			}
+		})
+	}
+
+	for _, query := range []string{"type=summary", "id=[", "regex=(", "sort=name", "limit=0", "limit=1001", "cursor=%25%25"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/metrics?"+query, nil)
+		w := httptest.NewRecorder()
+		HandlerAPIMetrics(context.Background(), w, r, serverData)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v = %v, want 400", query, w.Code)
+		}
+	}
+}
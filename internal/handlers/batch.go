@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+const (
+	// BatchModeHeader selects the /updates/ mode, the "mode" query param does the same.
+	BatchModeHeader = "X-Batch-Mode"
+	// BatchAtomic applies every item or none of them.
+	BatchAtomic = "atomic"
+	// BatchBestEffort applies the valid items and reports the rest.
+	BatchBestEffort = "best-effort"
+)
+
+// Batch item statuses.
+const (
+	ItemAccepted   = "accepted"
+	ItemRejected   = "rejected"
+	ItemNotApplied = "not_applied"
+)
+
+// BatchItemResult is the outcome of one batch item, Index is its position in the batch.
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	MType  string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Mode     string            `json:"mode"`
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// HandlerUpdatesJSON applies a batch and reports every item.
+// Status is 200 when all items are applied, 207 when best-effort applied some and 400 when none were applied.
+// A storage failure not tied to an item is 503, the client may retry the whole batch.
+func HandlerUpdatesJSON(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil || serverData.Repo == nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerUpdatesJSON(1): Repo fail"))
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		log.Fatalln(e)
+		return
+	}
+
+	mode := r.Header.Get(BatchModeHeader)
+	if len(mode) < 1 {
+		mode = r.URL.Query().Get("mode")
+	}
+	if len(mode) < 1 {
+		mode = BatchBestEffort
+	}
+	if mode != BatchAtomic && mode != BatchBestEffort {
+		e := types.NewTimeError(fmt.Errorf("HandlerUpdatesJSON(2): mode %q, want %v or %v", mode, BatchAtomic, BatchBestEffort))
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		log.Println(e)
+		return
+	}
+
+	newMetrics, err := readBatch(r)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerUpdatesJSON(3): %w", err))
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		log.Println(e)
+		return
+	}
+
+	resp, storeErr := UpdateBatch(r.Context(), serverData.Repo, &serverData.Config, newMetrics, mode)
+	if resp.Accepted > 0 {
+		serverData.Repo.FlushDB(mainCtx)
+	}
+
+	status := http.StatusOK
+	switch {
+	case storeErr != nil:
+		status = http.StatusServiceUnavailable
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerUpdatesJSON(4): %w", storeErr)))
+	case resp.Rejected == 0:
+	case resp.Accepted == 0:
+		status = http.StatusBadRequest
+	default:
+		status = http.StatusMultiStatus
+	}
+	if resp.Rejected > 0 {
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerUpdatesJSON(5): %v mode, %d accepted, %d rejected", mode, resp.Accepted, resp.Rejected)))
+	}
+
+	txtM, err := json.Marshal(resp)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerUpdatesJSON(6): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(txtM)
+}
+
+// UpdateBatch validates metrics like single updates and stores them in mode, BatchAtomic or BatchBestEffort.
+// Metrics without a timestamp are stamped. The error is a storage failure not tied to an item,
+// the items it left not applied may be retried.
+func UpdateBatch(ctx context.Context, repo repositories.Repo, config *configs.ServerConfig, metrics []types.Metrics, mode string) (BatchResponse, error) {
+	resp := BatchResponse{Mode: mode, Results: make([]BatchItemResult, len(metrics))}
+	validIdx := []int{}
+	for i := range metrics {
+		resp.Results[i] = BatchItemResult{Index: i, ID: metrics[i].ID, MType: metrics[i].MType, Status: ItemNotApplied}
+		err := checkBatchItem(&metrics[i], config)
+		if err != nil {
+			resp.Results[i].Status = ItemRejected
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+		validIdx = append(validIdx, i)
+	}
+
+	var storeErr error
+	if mode == BatchAtomic {
+		if len(validIdx) == len(metrics) {
+			storeErr = applyBatch(ctx, repo, metrics, validIdx, resp.Results, false)
+		}
+	} else {
+		storeErr = applyBatch(ctx, repo, metrics, validIdx, resp.Results, true)
+	}
+
+	for _, res := range resp.Results {
+		if res.Status == ItemAccepted {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+	return resp, storeErr
+}
+
+// readBatch reads a JSON array of metrics, a single object is a batch of one.
+func readBatch(r *http.Request) ([]types.Metrics, error) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	bodyStr := strings.Trim(string(bodyBytes), " \t\r\n/")
+	if len(bodyStr) < 1 {
+		return nil, fmt.Errorf("empty body")
+	}
+	if strings.HasPrefix(bodyStr, "{") {
+		oneMetric := types.Metrics{}
+		err = json.Unmarshal([]byte(bodyStr), &oneMetric)
+		return []types.Metrics{oneMetric}, err
+	}
+	newMetrics := []types.Metrics{}
+	err = json.Unmarshal([]byte(bodyStr), &newMetrics)
+	return newMetrics, err
+}
+
+// checkBatchItem validates m like a single /update/ and stamps a missing timestamp.
+func checkBatchItem(m *types.Metrics, config *configs.ServerConfig) error {
+	switch {
+	case len(m.ID) < 1:
+		return fmt.Errorf("empty id")
+	case !types.DataType(m.MType).IsValid():
+		return fmt.Errorf("type %q invalid", m.MType)
+	case types.DataType(m.MType) == types.GaugeType && !m.IsValue():
+		return fmt.Errorf("empty value")
+	case types.DataType(m.MType) == types.CounterType && !m.IsDelta():
+		return fmt.Errorf("empty delta")
+	case !m.Labels.IsValid():
+		return fmt.Errorf("labels invalid")
+	}
+	if types.DataType(m.MType) == types.HistogramType {
+		if err := m.CheckBuckets(); err != nil {
+			return err
+		}
+	}
+	if err := m.CheckHash(config.HashKey); err != nil {
+		return err
+	}
+	if err := m.CheckTime(time.Now(), config.MaxSampleAge, config.MaxSampleSkew); err != nil {
+		return errReason(err)
+	}
+	if m.Timestamp == 0 {
+		m.SetTime(time.Now())
+	}
+	return nil
+}
+
+// applyBatch stores metrics[idx] with one SetMany. With dropFailed an item the storage refuses
+// is marked rejected and the rest is retried, otherwise the whole batch stays not applied.
+// An error not tied to an item leaves the remaining items not applied and is returned.
+func applyBatch(ctx context.Context, repo repositories.Repo, metrics []types.Metrics, idx []int, results []BatchItemResult, dropFailed bool) error {
+	for len(idx) > 0 {
+		batch := make([]types.Metrics, len(idx))
+		for i, mi := range idx {
+			batch[i] = metrics[mi]
+		}
+		err := repositories.NewV2(repo).SetMany(ctx, batch)
+		if err == nil {
+			for _, mi := range idx {
+				results[mi].Status = ItemAccepted
+			}
+			return nil
+		}
+
+		var itemErr *repositories.ItemError
+		if !errors.As(err, &itemErr) || itemErr.Index >= len(idx) {
+			for _, mi := range idx {
+				results[mi].Error = err.Error()
+			}
+			return err
+		}
+		failed := idx[itemErr.Index]
+		results[failed].Status = ItemRejected
+		results[failed].Error = errReason(itemErr.Err).Error()
+		if !dropFailed {
+			return nil
+		}
+		idx = append(idx[:itemErr.Index:itemErr.Index], idx[itemErr.Index+1:]...)
+	}
+	return nil
+}
+
+// errReason drops the timestamp prefix of TimeError, results carry their own context.
+func errReason(err error) error {
+	for {
+		te, ok := err.(*types.TimeError)
+		if !ok {
+			return err
+		}
+		err = te.Err
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// downRepo fails every write like a storage that lost its DB.
+type downRepo struct {
+	repositories.Repo
+}
+
+func (r downRepo) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	return types.NewTimeError(errors.New("db down"))
+}
+
+func TestHandlerUpdatesJSON(t *testing.T) {
+	const (
+		gauge   = `{"id":"Alloc","type":"gauge","value":1}`
+		counter = `{"id":"PollCount","type":"counter","delta":2}`
+		invalid = `{"id":"Empty","type":"gauge"}`
+		// Stored is a gauge, the storage refuses it as a counter
+		clash = `{"id":"Stored","type":"counter","delta":1}`
+	)
+	tests := []struct {
+		name   string
+		mode   string
+		body   string
+		isDown bool
+		status int
+		want   []string
+	}{
+		{"best-effort all valid", BatchBestEffort, "[" + gauge + "," + counter + "]", false, http.StatusOK, []string{ItemAccepted, ItemAccepted}},
+		{"best-effort one invalid", BatchBestEffort, "[" + gauge + "," + invalid + "," + counter + "]", false, http.StatusMultiStatus, []string{ItemAccepted, ItemRejected, ItemAccepted}},
+		{"best-effort none valid", BatchBestEffort, "[" + invalid + "," + clash + "]", false, http.StatusBadRequest, []string{ItemRejected, ItemRejected}},
+		{"best-effort storage refuses one", BatchBestEffort, "[" + invalid + "," + gauge + "," + clash + "," + counter + "]", false, http.StatusMultiStatus, []string{ItemRejected, ItemAccepted, ItemRejected, ItemAccepted}},
+		{"best-effort single object", BatchBestEffort, gauge, false, http.StatusOK, []string{ItemAccepted}},
+		{"atomic all valid", BatchAtomic, "[" + gauge + "," + counter + "]", false, http.StatusOK, []string{ItemAccepted, ItemAccepted}},
+		{"atomic one invalid", BatchAtomic, "[" + gauge + "," + invalid + "," + counter + "]", false, http.StatusBadRequest, []string{ItemNotApplied, ItemRejected, ItemNotApplied}},
+		{"atomic storage refuses one", BatchAtomic, "[" + gauge + "," + clash + "," + counter + "]", false, http.StatusBadRequest, []string{ItemNotApplied, ItemRejected, ItemNotApplied}},
+		{"best-effort storage down", BatchBestEffort, "[" + gauge + "," + invalid + "," + counter + "]", true, http.StatusServiceUnavailable, []string{ItemNotApplied, ItemRejected, ItemNotApplied}},
+		{"atomic storage down", BatchAtomic, "[" + gauge + "," + counter + "]", true, http.StatusServiceUnavailable, []string{ItemNotApplied, ItemNotApplied}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverData := newTestServerData(t, testGauge("Stored", 1, nil))
+			if tt.isDown {
+				serverData.Repo = downRepo{Repo: serverData.Repo}
+			}
+			r := httptest.NewRequest(http.MethodPost, "/updates/?mode="+tt.mode, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			HandlerUpdatesJSON(context.Background(), w, r, serverData)
+			if w.Code != tt.status {
+				t.Fatalf("status = %v, want %v: %v", w.Code, tt.status, w.Body.String())
+			}
+
+			resp := BatchResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Mode != tt.mode || len(resp.Results) != len(tt.want) {
+				t.Fatalf("response = %+v, want %v mode and %d results", resp, tt.mode, len(tt.want))
+			}
+			accepted := 0
+			for i, res := range resp.Results {
+				if res.Index != i || res.Status != tt.want[i] {
+					t.Errorf("results[%d] = %+v, want index %d %v", i, res, i, tt.want[i])
+				}
+				if res.Status == ItemRejected && len(res.Error) < 1 {
+					t.Errorf("results[%d] = %+v, want an error", i, res)
+				}
+				if res.Status == ItemAccepted {
+					accepted++
+					if _, err := serverData.Repo.Get(res.ID); err != nil {
+						t.Errorf("results[%d] accepted but %v", i, err)
+					}
+				} else if res.ID != "Stored" {
+					if _, err := serverData.Repo.Get(res.ID); err == nil {
+						t.Errorf("results[%d] = %v but %v stored", i, res.Status, res.ID)
+					}
+				}
+			}
+			if resp.Accepted != accepted || resp.Rejected != len(tt.want)-accepted {
+				t.Errorf("accepted, rejected = %v, %v; want %v, %v", resp.Accepted, resp.Rejected, accepted, len(tt.want)-accepted)
+			}
+		})
+	}
+
+	serverData := newTestServerData(t)
+	r := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader("["+gauge+"]"))
+	r.Header.Set(BatchModeHeader, "all")
+	w := httptest.NewRecorder()
+	HandlerUpdatesJSON(context.Background(), w, r, serverData)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode status = %v, want 400", w.Code)
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"github.com/go-chi/chi/v5"
+)
+
+type apiDeleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// HandlerDeleteRaw removes one series on DELETE /value/{type}/{name}, labels come from the query.
+func HandlerDeleteRaw(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	typeParam := chi.URLParam(r, "type")
+	nameParam := chi.URLParam(r, "name")
+
+	if !types.DataType(typeParam).IsValid() {
+		errStr := "wrong type"
+		http.Error(w, errStr, http.StatusNotImplemented)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerDeleteRaw(): fail: %v", errStr)))
+		return
+	}
+
+	if serverData == nil || serverData.Repo == nil {
+		repoErr := types.NewTimeError(fmt.Errorf("HandlerDeleteRaw(): Repo fail"))
+		http.Error(w, repoErr.Error(), http.StatusBadRequest)
+		log.Fatalln(repoErr)
+		return
+	}
+	repoData := serverData.Repo
+
+	key := types.SeriesKey(nameParam, labelsFromQuery(r))
+	oldVal, err := repoData.Get(key)
+	if err == nil && oldVal.MType != typeParam {
+		err = fmt.Errorf("k[%v]: stored as %v", key, oldVal.MType)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerDeleteRaw(): fail: %w", err)))
+		return
+	}
+
+	deleted, err := repoData.Delete(r.Context(), []string{key})
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerDeleteRaw(): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	if deleted < 1 {
+		http.Error(w, fmt.Sprintf("k[%v]: not found in storage", key), http.StatusNotFound)
+		return
+	}
+	repoData.FlushDB(mainCtx)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("Ok"))
+}
+
+// HandlerAPIDeleteMetrics removes every series matching the /api/metrics filters on DELETE /api/metrics.
+// At least one filter is required, so a bare request cannot wipe the storage.
+func HandlerAPIDeleteMetrics(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil || serverData.Repo == nil {
+		repoErr := types.NewTimeError(fmt.Errorf("HandlerAPIDeleteMetrics(): Repo fail"))
+		http.Error(w, repoErr.Error(), http.StatusBadRequest)
+		log.Fatalln(repoErr)
+		return
+	}
+
+	filter, err := apiFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.isEmpty() {
+		http.Error(w, "empty filter, set type, id, regex or labels", http.StatusBadRequest)
+		return
+	}
+
+	matched, err := filter.list(r.Context(), serverData.Repo)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerAPIDeleteMetrics(): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	keys := make([]string, 0, len(matched))
+	for _, m := range matched {
+		keys = append(keys, m.Key())
+	}
+	resp := apiDeleteResponse{}
+	if len(keys) > 0 {
+		resp.Deleted, err = serverData.Repo.Delete(r.Context(), keys)
+		if err != nil {
+			e := types.NewTimeError(fmt.Errorf("HandlerAPIDeleteMetrics(): %w", err))
+			http.Error(w, e.Error(), http.StatusInternalServerError)
+			log.Println(e)
+			return
+		}
+		serverData.Repo.FlushDB(mainCtx)
+	}
+
+	txtM, err := json.Marshal(resp)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerAPIDeleteMetrics(): %w", err))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(txtM)
+}
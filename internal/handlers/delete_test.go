@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHandlerAPIDeleteMetrics(t *testing.T) {
+	serverData := newTestServerData(t,
+		testGauge("Alloc", 3, nil),
+		testGauge("Alloc", 1, types.Labels{"host": "a"}),
+		testGauge("HeapAlloc", 2, types.Labels{"host": "b"}),
+		testCounter("PollCount", 5, types.Labels{"host": "a"}),
+	)
+	remove := func(query string) (int, int) {
+		r := httptest.NewRequest(http.MethodDelete, "/api/metrics?"+query, nil)
+		w := httptest.NewRecorder()
+		HandlerAPIDeleteMetrics(context.Background(), w, r, serverData)
+		resp := apiDeleteResponse{}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp.Deleted
+	}
+	stored := func() int {
+		all, err := serverData.Repo.List(context.Background(), repositories.Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(all)
+	}
+
+	// no filter, or only paging and sort params, must not wipe the storage
+	for _, query := range []string{"", "sort=id&limit=10", "type=", "regex=("} {
+		if code, _ := remove(query); code != http.StatusBadRequest {
+			t.Errorf("%q = %v, want 400", query, code)
+		}
+	}
+	if n := stored(); n != 4 {
+		t.Fatalf("%d series left after refused deletes, want 4", n)
+	}
+
+	if code, deleted := remove("id=Nothing*"); code != http.StatusOK || deleted != 0 {
+		t.Errorf("no match = %v, %d deleted; want 200, 0", code, deleted)
+	}
+	if code, deleted := remove("host=a&type=gauge"); code != http.StatusOK || deleted != 1 {
+		t.Errorf("host=a gauges = %v, %d deleted; want 200, 1", code, deleted)
+	}
+	if _, err := serverData.Repo.Get(`Alloc{host="a"}`); err == nil {
+		t.Errorf(`Alloc{host="a"} left`)
+	}
+	if code, deleted := remove("regex=Alloc$"); code != http.StatusOK || deleted != 2 {
+		t.Errorf("regex = %v, %d deleted; want 200, 2", code, deleted)
+	}
+	if _, err := serverData.Repo.Get(`PollCount{host="a"}`); err != nil || stored() != 1 {
+		t.Errorf("want only PollCount left, %v", err)
+	}
+}
+
+func TestHandlerDeleteRaw(t *testing.T) {
+	serverData := newTestServerData(t,
+		testGauge("Alloc", 3, nil),
+		testGauge("Alloc", 1, types.Labels{"host": "a"}),
+	)
+	remove := func(mType, name, query string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/value/"+mType+"/"+name+"?"+query, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("type", mType)
+		rctx.URLParams.Add("name", name)
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		HandlerDeleteRaw(context.Background(), w, r, serverData)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		mType  string
+		id     string
+		query  string
+		status int
+	}{
+		{"unknown type", "summary", "Alloc", "", http.StatusNotImplemented},
+		{"stored as gauge", "counter", "Alloc", "", http.StatusNotFound},
+		{"unknown series", "gauge", "Alloc", "host=b", http.StatusNotFound},
+		{"labeled", "gauge", "Alloc", "host=a", http.StatusOK},
+		{"labeled again", "gauge", "Alloc", "host=a", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := remove(tt.mType, tt.id, tt.query); code != tt.status {
+			t.Errorf("%v = %v, want %v", tt.name, code, tt.status)
+		}
+	}
+	// the series without labels is another series
+	if _, err := serverData.Repo.Get("Alloc"); err != nil {
+		t.Errorf("Alloc deleted with its labeled series: %v", err)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net/http"
 	"strings"
 
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
 	"github.com/aaarkadev/collectalertagent/internal/servers"
 	"github.com/aaarkadev/collectalertagent/internal/types"
 	"github.com/go-chi/chi/v5"
@@ -38,9 +40,13 @@ func HandlerFuncAll(mainCtx context.Context, w http.ResponseWriter, r *http.Requ
 	}
 	repoData := serverData.Repo
 
+	labelsFilter := labelsFromQuery(r)
 	tableStr := []string{}
 	for _, v := range repoData.GetAll() {
-		tableStr = append(tableStr, "<tr><td>", v.ID, "</td><td>", v.Get(), "</td></tr>")
+		if !v.Labels.Match(labelsFilter) {
+			continue
+		}
+		tableStr = append(tableStr, "<tr><td>", html.EscapeString(v.Key()), "</td><td>", v.Get(), "</td></tr>")
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -82,7 +88,7 @@ func HandlerFuncOneJSON(mainCtx context.Context, w http.ResponseWriter, r *http.
 		log.Println(types.NewTimeError(fmt.Errorf("HandlerFuncOneJSON(): fail: %w", err)))
 		return
 	}
-	metricVal, foundErr := repoData.Get(metricVal.ID)
+	metricVal, foundErr := repoData.Get(metricVal.Key())
 	if foundErr != nil {
 		http.Error(w, foundErr.Error(), http.StatusNotFound)
 		log.Println(types.NewTimeError(fmt.Errorf("HandlerFuncOneJSON(): fail: %w", foundErr)))
@@ -107,6 +113,11 @@ func HandlerPingDB(mainCtx context.Context, w http.ResponseWriter, r *http.Reque
 		log.Fatalln(repoErr)
 		return
 	}
+	tier := ""
+	if repoTier, ok := repositories.TierOf(serverData.Repo); ok {
+		tier = repoTier
+		w.Header().Set("X-Storage-Tier", tier)
+	}
 	if len(serverData.Config.DSN) < 1 {
 		http.Error(w, "DSN empty or no connection to DB", http.StatusInternalServerError)
 		return
@@ -117,6 +128,9 @@ func HandlerPingDB(mainCtx context.Context, w http.ResponseWriter, r *http.Reque
 		return
 	}
 	w.WriteHeader(http.StatusOK)
+	if len(tier) > 0 {
+		w.Write([]byte(tier))
+	}
 }
 
 func HandlerFuncOneRaw(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
@@ -150,7 +164,7 @@ func HandlerFuncOneRaw(mainCtx context.Context, w http.ResponseWriter, r *http.R
 	}
 	repoData := serverData.Repo
 
-	oldVal, oldValErr := repoData.Get(nameParam)
+	oldVal, oldValErr := repoData.Get(types.SeriesKey(nameParam, labelsFromQuery(r)))
 	if oldValErr != nil {
 		http.Error(w, oldValErr.Error(), http.StatusNotFound)
 		log.Println(types.NewTimeError(fmt.Errorf("HandlerFuncOneRaw(): fail: %w", oldValErr)))
@@ -1 +1,289 @@
 package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/storages"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+func newTestServerData(t *testing.T, metrics ...*types.Metrics) *servers.ServerHandlerData {
+	repo := &storages.MemStorage{}
+	repo.Init(context.Background())
+	for _, m := range metrics {
+		if err := repo.Set(*m); err != nil {
+			t.Fatalf("Set(%v): %v", m.Key(), err)
+		}
+	}
+	return &servers.ServerHandlerData{Repo: repositories.NewCumulative(repo)}
+}
+
+func testGauge(id string, v float64, labels types.Labels) *types.Metrics {
+	m, _ := types.NewMetric(id, types.GaugeType, types.OsSource)
+	m.Set(v)
+	m.Labels = labels
+	return m
+}
+
+func testCounter(id string, delta int64, labels types.Labels) *types.Metrics {
+	m, _ := types.NewMetric(id, types.CounterType, types.IncrementSource)
+	m.Set(delta)
+	m.Labels = labels
+	return m
+}
+
+func scrape(serverData *servers.ServerHandlerData, accept string) string {
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if len(accept) > 0 {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	HandlerPrometheus(context.Background(), w, r, serverData)
+	return w.Body.String()
+}
+
+func TestHandlerPrometheusCollisions(t *testing.T) {
+	latency, _ := types.NewHistogram("Latency", []float64{1}, types.OsSource)
+	latency.Observe(0.5)
+	latency.Labels = types.Labels{"le": "user"}
+	serverData := newTestServerData(t,
+		testCounter("PollCount", 3, nil),
+		testGauge("Alloc", 1.5, types.Labels{"path": "C:\\tmp\n\"x\""}),
+		// both sanitize to alloc_x with the same labels, alloc.x sorts first
+		testGauge("alloc.x", 1, nil),
+		testGauge("alloc_x", 2, nil),
+		latency,
+		// a sample name of the Latency histogram
+		testGauge("Latency_sum", 9, nil),
+	)
+
+	want := `# HELP Alloc Alloc
+# TYPE Alloc gauge
+Alloc{path="C:\\tmp\n\"x\""} 1.5
+# HELP Latency Latency
+# TYPE Latency histogram
+Latency_bucket{exported_le="user",le="1"} 1
+Latency_bucket{exported_le="user",le="+Inf"} 1
+Latency_sum{exported_le="user"} 0.5
+Latency_count{exported_le="user"} 1
+# HELP PollCount PollCount
+# TYPE PollCount counter
+PollCount 3
+# HELP alloc_x alloc.x
+# TYPE alloc_x gauge
+alloc_x 1
+`
+	if got := scrape(serverData, ""); got != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandlerPrometheusOpenMetricsTotal(t *testing.T) {
+	serverData := newTestServerData(t,
+		// both are the req family in OpenMetrics
+		testCounter("req", 1, nil),
+		testCounter("req_total", 2, nil),
+		testCounter("req_total", 4, types.Labels{"code": "500"}),
+		// its name is a sample name of the req counter
+		testGauge("req_total", 5, types.Labels{"code": "200"}),
+	)
+
+	want := `# HELP req req, req_total
+# TYPE req counter
+req_total 1
+req_total{code="500"} 4
+# EOF
+`
+	if got := scrape(serverData, "application/openmetrics-text"); got != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseInfluxLine(t *testing.T) {
+	now := time.Unix(100, 0)
+	point, err := parseInfluxLine(`cpu\ load,host=web\,1,region=eu usage=0.5,busy=t,procs=7i,msg="a b=c, d" 1500`, time.Millisecond, now)
+	if err != nil {
+		t.Fatalf("parseInfluxLine() = %v", err)
+	}
+	if point.measurement != "cpu load" || point.tags["host"] != "web,1" || point.tags["region"] != "eu" {
+		t.Errorf("measurement %q tags %v", point.measurement, point.tags)
+	}
+	if !point.time.Equal(time.UnixMilli(1500)) {
+		t.Errorf("time = %v, want 1.5s after the epoch", point.time)
+	}
+	want := []influxField{
+		{key: "usage", value: 0.5},
+		{key: "busy", value: 1},
+		{key: "procs", value: 7, intValue: 7, isInt: true},
+		{key: "msg", isString: true},
+	}
+	if len(point.fields) != len(want) {
+		t.Fatalf("fields = %+v, want %+v", point.fields, want)
+	}
+	for i, f := range want {
+		if point.fields[i] != f {
+			t.Errorf("field %d = %+v, want %+v", i, point.fields[i], f)
+		}
+	}
+
+	point, err = parseInfluxLine("mem free=1", time.Nanosecond, now)
+	if err != nil || !point.time.Equal(now) {
+		t.Errorf("point without timestamp: %v at %v, want %v", err, point.time, now)
+	}
+
+	for _, bad := range []string{
+		"cpu",
+		",host=a usage=1",
+		"cpu,host usage=1",
+		"cpu usage=",
+		"cpu usage=1x",
+		"cpu usage=NaN",
+		`cpu msg="open`,
+		"cpu usage=1i2",
+		"cpu usage=-1u",
+		"cpu usage=1 soon",
+		"cpu usage=1 1 2",
+	} {
+		if _, err := parseInfluxLine(bad, time.Nanosecond, now); err == nil {
+			t.Errorf("parseInfluxLine(%q) accepted", bad)
+		}
+	}
+}
+
+func TestHandlerInfluxWriteCumulativeCounters(t *testing.T) {
+	serverData := newTestServerData(t)
+	serverData.Config.InfluxCounterFields = "net_*"
+
+	write := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		HandlerInfluxWrite(context.Background(), w, r, serverData)
+		return w.Code
+	}
+	total := func(key string) int64 {
+		m, err := serverData.Repo.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%v) = %v", key, err)
+		}
+		return m.GetDelta()
+	}
+	eth0 := types.SeriesKey("net_bytes", types.Labels{"if": "eth0"})
+
+	// two points of one series in a request count once
+	if code := write("net,if=eth0 bytes=10i\nnet,if=eth0 bytes=15i\nnet,if=eth1 bytes=4i"); code != http.StatusNoContent {
+		t.Fatalf("write = %v", code)
+	}
+	if total(eth0) != 15 || total(types.SeriesKey("net_bytes", types.Labels{"if": "eth1"})) != 4 {
+		t.Errorf("totals = %v, %v; want 15 and 4", total(eth0), total(types.SeriesKey("net_bytes", types.Labels{"if": "eth1"})))
+	}
+	if code := write("net,if=eth0 bytes=25i"); code != http.StatusNoContent || total(eth0) != 25 {
+		t.Errorf("write = %v, total %v; want 25", code, total(eth0))
+	}
+	// the client restarted, the new value counts from zero
+	if code := write("net,if=eth0 bytes=3i"); code != http.StatusNoContent || total(eth0) != 28 {
+		t.Errorf("after reset write = %v, total %v; want 28", code, total(eth0))
+	}
+	// and goes on from the restarted value, not from the stored total
+	if code := write("net,if=eth0 bytes=5i"); code != http.StatusNoContent || total(eth0) != 30 {
+		t.Errorf("after reset write = %v, total %v; want 30", code, total(eth0))
+	}
+	if code := write("net,if=eth0 bytes=-1i"); code != http.StatusBadRequest || total(eth0) != 30 {
+		t.Errorf("negative write = %v, total %v; want 400 and 30", code, total(eth0))
+	}
+	// a deleted series forgets the last value, the next one is the new total
+	if _, err := serverData.Repo.Delete(context.Background(), []string{eth0}); err != nil {
+		t.Fatal(err)
+	}
+	if code := write("net,if=eth0 bytes=7i"); code != http.StatusNoContent || total(eth0) != 7 {
+		t.Errorf("after delete write = %v, total %v; want 7", code, total(eth0))
+	}
+	// integer fields outside the patterns are gauges
+	if code := write("disk used=7i"); code != http.StatusNoContent {
+		t.Fatalf("write = %v", code)
+	}
+	if m, _ := serverData.Repo.Get("disk_used"); m.MType != string(types.GaugeType) || m.GetValue() != 7 {
+		t.Errorf("disk_used = %+v, want gauge 7", m)
+	}
+}
+
+func TestHandlerInfluxWriteConcurrentCounters(t *testing.T) {
+	serverData := newTestServerData(t)
+	serverData.Config.InfluxCounterFields = "net_*"
+
+	// every client resends the same total, it counts once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("net bytes=10i"))
+			HandlerInfluxWrite(context.Background(), httptest.NewRecorder(), r, serverData)
+		}()
+	}
+	wg.Wait()
+	if m, err := serverData.Repo.Get("net_bytes"); err != nil || m.GetDelta() != 10 {
+		t.Errorf("net_bytes = %v, %v; want 10", m.GetDelta(), err)
+	}
+}
+
+func TestHandlerInfluxWritePartial(t *testing.T) {
+	serverData := newTestServerData(t, testCounter("disk_used", 1, nil))
+	serverData.Config.InfluxCounterFields = "net_*"
+	limited, err := repositories.NewLimiting(serverData.Repo, repositories.SeriesLimits{MaxSeries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverData.Repo = limited
+
+	write := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		HandlerInfluxWrite(context.Background(), w, r, serverData)
+		return w
+	}
+
+	// disk_used is stored as a counter, the storage refuses only its line
+	w := write("disk used=0.5\nnet bytes=10i\ncpu usage=0.5\nbad")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "dropped=2") || !strings.Contains(w.Body.String(), "unable to write 'disk used=0.5'") {
+		t.Errorf("write = %v %v, want a partial write of 2 dropped lines", w.Code, w.Body.String())
+	}
+	if m, err := serverData.Repo.Get("net_bytes"); err != nil || m.GetDelta() != 10 {
+		t.Errorf("net_bytes = %v, %v; want 10", m.GetDelta(), err)
+	}
+	if m, err := serverData.Repo.Get("cpu_usage"); err != nil || m.GetValue() != 0.5 {
+		t.Errorf("cpu_usage = %v, %v; want 0.5", m.GetValue(), err)
+	}
+	if m, _ := serverData.Repo.Get("disk_used"); m.MType != string(types.CounterType) || m.GetDelta() != 1 {
+		t.Errorf("disk_used = %+v, want the stored counter", m)
+	}
+
+	// nothing is stored because the series limit is full
+	if w := write("net,if=eth1 bytes=10i\nmem free=2"); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "dropped=2") {
+		t.Errorf("write over the limit = %v %v, want 422", w.Code, w.Body.String())
+	}
+	// the refused total is not remembered, after a slot frees up the next value counts in full
+	if _, err := serverData.Repo.Delete(context.Background(), []string{"cpu_usage"}); err != nil {
+		t.Fatal(err)
+	}
+	eth1 := types.SeriesKey("net_bytes", types.Labels{"if": "eth1"})
+	if code := write("net,if=eth1 bytes=12i").Code; code != http.StatusNoContent {
+		t.Fatalf("write = %v", code)
+	}
+	if m, _ := serverData.Repo.Get(eth1); m.GetDelta() != 12 {
+		t.Errorf("%v = %v, want 12", eth1, m.GetDelta())
+	}
+
+	// the storage failing outside any line is retryable
+	serverData.Repo = downRepo{Repo: serverData.Repo}
+	if w := write("cpu usage=1"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("write to a down storage = %v, want 503", w.Code)
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"github.com/go-chi/chi/v5"
+)
+
+type historyResponse struct {
+	ID     string        `json:"id"`
+	MType  string        `json:"type"`
+	Labels types.Labels  `json:"labels,omitempty"`
+	Points []types.Point `json:"points"`
+}
+
+func HandlerHistory(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+
+	typeParam := chi.URLParam(r, "type")
+	nameParam := chi.URLParam(r, "name")
+
+	if !types.DataType(typeParam).IsValid() {
+		errStr := "wrong type"
+		http.Error(w, errStr, http.StatusNotImplemented)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerHistory(): fail: %v", errStr)))
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now()
+	if len(query.Get("to")) > 0 {
+		t, err := parseTimeParam(query.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println(types.NewTimeError(fmt.Errorf("HandlerHistory(): fail: %w", err)))
+			return
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if len(query.Get("from")) > 0 {
+		t, err := parseTimeParam(query.Get("from"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Println(types.NewTimeError(fmt.Errorf("HandlerHistory(): fail: %w", err)))
+			return
+		}
+		from = t
+	}
+	step := time.Duration(0)
+	if len(query.Get("step")) > 0 {
+		d, err := time.ParseDuration(query.Get("step"))
+		if err != nil || d < 0 {
+			errStr := "wrong step"
+			http.Error(w, errStr, http.StatusBadRequest)
+			log.Println(types.NewTimeError(fmt.Errorf("HandlerHistory(): fail: %v", errStr)))
+			return
+		}
+		step = d
+	}
+	if from.After(to) {
+		errStr := "from after to"
+		http.Error(w, errStr, http.StatusBadRequest)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerHistory(): fail: %v", errStr)))
+		return
+	}
+
+	if serverData == nil || serverData.Repo == nil {
+		repoErr := types.NewTimeError(fmt.Errorf("HandlerHistory(): Repo fail"))
+		http.Error(w, repoErr.Error(), http.StatusBadRequest)
+		log.Fatalln(repoErr)
+		return
+	}
+	repoData := serverData.Repo
+
+	labels := labelsFromQuery(r, "from", "to", "step")
+	key := types.SeriesKey(nameParam, labels)
+	m, err := repoData.Get(key)
+	if err != nil || m.MType != typeParam {
+		errStr := "not found"
+		http.Error(w, errStr, http.StatusNotFound)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerHistory(): fail: %v %v", key, errStr)))
+		return
+	}
+	points, err := repoData.History(key, from, to)
+	if err != nil {
+		points = []types.Point{}
+	}
+
+	txt, err := json.Marshal(historyResponse{
+		ID:     m.ID,
+		MType:  m.MType,
+		Labels: m.Labels,
+		Points: downsample(points, from, step),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerHistory(): fail: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(txt)
+}
+
+// parseTimeParam accepts unix seconds or RFC3339.
+func parseTimeParam(s string) (time.Time, error) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// downsample keeps the last point of every step-wide bucket starting at from.
+func downsample(points []types.Point, from time.Time, step time.Duration) []types.Point {
+	if step <= 0 {
+		return points
+	}
+	stepMs := step.Milliseconds()
+	if stepMs < 1 {
+		return points
+	}
+	fromMs := from.UnixMilli()
+	res := []types.Point{}
+	for _, p := range points {
+		bucketStart := fromMs + (p.Timestamp-fromMs)/stepMs*stepMs
+		bucketPoint := types.Point{Timestamp: bucketStart, Value: p.Value}
+		if len(res) > 0 && res[len(res)-1].Timestamp == bucketStart {
+			res[len(res)-1] = bucketPoint
+			continue
+		}
+		res = append(res, bucketPoint)
+	}
+	return res
+}
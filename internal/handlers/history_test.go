@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/storages"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHandlerHistory(t *testing.T) {
+	repo := &storages.MemStorage{HistorySize: 10}
+	repo.Init(context.Background())
+	// Alloc has a point every second from 1 to 5, its labeled series one at 3
+	for sec := int64(1); sec <= 5; sec++ {
+		m := testGauge("Alloc", float64(sec), nil)
+		m.Timestamp = sec * 1000
+		repo.Set(*m)
+	}
+	labeled := testGauge("Alloc", 30, types.Labels{"host": "a"})
+	labeled.Timestamp = 3000
+	repo.Set(*labeled)
+	serverData := &servers.ServerHandlerData{Repo: repositories.NewCumulative(repo)}
+
+	get := func(mType, name, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/history/"+mType+"/"+name+"?"+query, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("type", mType)
+		rctx.URLParams.Add("name", name)
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		HandlerHistory(context.Background(), w, r, serverData)
+		return w
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"bounds are inclusive", "from=2&to=4", "[{2000 2} {3000 3} {4000 4}]"},
+		{"single instant", "from=2&to=2", "[{2000 2}]"},
+		{"rfc3339", "from=" + time.UnixMilli(4000).UTC().Format(time.RFC3339) + "&to=" + time.UnixMilli(9000).UTC().Format(time.RFC3339), "[{4000 4} {5000 5}]"},
+		{"empty range", "from=6&to=9", "[]"},
+		{"default last hour", "", "[]"},
+		{"step keeps the last point of a bucket", "from=1&to=5&step=2s", "[{1000 2} {3000 4} {5000 5}]"},
+		{"labels select the series", "from=0&to=9&host=a", "[{3000 30}]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get("gauge", "Alloc", tt.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %v %v", w.Code, w.Body.String())
+			}
+			resp := historyResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Points == nil || fmt.Sprint(resp.Points) != tt.want {
+				t.Errorf("points = %v, want %v", resp.Points, tt.want)
+			}
+			if resp.ID != "Alloc" || resp.MType != string(types.GaugeType) {
+				t.Errorf("series = %v %v", resp.ID, resp.MType)
+			}
+		})
+	}
+
+	errs := []struct {
+		name   string
+		mType  string
+		id     string
+		query  string
+		status int
+	}{
+		{"unknown series", "gauge", "HeapAlloc", "", http.StatusNotFound},
+		{"unknown labels", "gauge", "Alloc", "host=b", http.StatusNotFound},
+		{"stored as gauge", "counter", "Alloc", "", http.StatusNotFound},
+		{"unknown type", "summary", "Alloc", "", http.StatusNotImplemented},
+		{"from after to", "gauge", "Alloc", "from=5&to=4", http.StatusBadRequest},
+		{"wrong from", "gauge", "Alloc", "from=yesterday", http.StatusBadRequest},
+		{"negative step", "gauge", "Alloc", "step=-1s", http.StatusBadRequest},
+	}
+	for _, tt := range errs {
+		if w := get(tt.mType, tt.id, tt.query); w.Code != tt.status {
+			t.Errorf("%v = %v, want %v", tt.name, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marks a response repeated from an earlier request.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyKeyMaxLen     = 128
+)
+
+type handlerFunc func(context.Context, http.ResponseWriter, *http.Request, *servers.ServerHandlerData)
+
+// idempotencyInFlight holds keys being processed, a retry that races the original waits for it.
+var idempotencyInFlight = struct {
+	mu   sync.Mutex
+	keys map[string]chan struct{}
+}{keys: make(map[string]chan struct{})}
+
+// recordedResponse buffers a handler response so it can be stored before it is sent.
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recordedResponse) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recordedResponse) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *recordedResponse) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+// Idempotent makes next safe to retry: a request repeating an Idempotency-Key seen within
+// Config.IdempotencyTTL gets the stored response instead of being applied again.
+// Responses are kept by the storage, so replays survive a restart with restore enabled.
+func Idempotent(next handlerFunc) handlerFunc {
+	return func(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if len(key) < 1 || serverData == nil || serverData.Config.IdempotencyTTL <= 0 {
+			next(mainCtx, w, r, serverData)
+			return
+		}
+		store, ok := repositories.IdempotencyOf(serverData.Repo)
+		if !ok {
+			next(mainCtx, w, r, serverData)
+			return
+		}
+		if len(key) > idempotencyKeyMaxLen {
+			http.Error(w, fmt.Sprintf("%v longer than %d", IdempotencyKeyHeader, idempotencyKeyMaxLen), http.StatusBadRequest)
+			return
+		}
+
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		requestHash := fmt.Sprintf("%x", sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), bodyBytes...)))
+		storeKey := r.URL.Path + " " + key
+
+		if !acquireIdempotencyKey(r.Context(), storeKey) {
+			http.Error(w, "request canceled", http.StatusServiceUnavailable)
+			return
+		}
+		defer releaseIdempotencyKey(storeKey)
+
+		if resp, found := store.LoadResponse(storeKey); found {
+			if resp.RequestHash != requestHash {
+				e := types.NewTimeError(fmt.Errorf("Idempotent(): key %q reused for a different request", key))
+				http.Error(w, e.Error(), http.StatusUnprocessableEntity)
+				log.Println(e)
+				return
+			}
+			if len(resp.ContentType) > 0 {
+				w.Header().Set("Content-Type", resp.ContentType)
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(resp.Status)
+			w.Write([]byte(resp.Body))
+			return
+		}
+
+		rec := &recordedResponse{header: http.Header{}, status: http.StatusOK}
+		next(mainCtx, rec, r, serverData)
+
+		// 5xx may be transient, let the client retry it for real
+		if rec.status < http.StatusInternalServerError {
+			store.SaveResponse(mainCtx, storeKey, repositories.StoredResponse{
+				RequestHash: requestHash,
+				Status:      rec.status,
+				ContentType: rec.header.Get("Content-Type"),
+				Body:        rec.body.String(),
+				ExpiresAt:   time.Now().Add(serverData.Config.IdempotencyTTL).UnixMilli(),
+			})
+		}
+
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+func acquireIdempotencyKey(ctx context.Context, key string) bool {
+	for {
+		idempotencyInFlight.mu.Lock()
+		done, busy := idempotencyInFlight.keys[key]
+		if !busy {
+			idempotencyInFlight.keys[key] = make(chan struct{})
+			idempotencyInFlight.mu.Unlock()
+			return true
+		}
+		idempotencyInFlight.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func releaseIdempotencyKey(key string) {
+	idempotencyInFlight.mu.Lock()
+	defer idempotencyInFlight.mu.Unlock()
+	close(idempotencyInFlight.keys[key])
+	delete(idempotencyInFlight.keys, key)
+}
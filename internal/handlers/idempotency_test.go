@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+)
+
+// countingHandler answers with the number of times it ran.
+func countingHandler(calls *int32, status int) handlerFunc {
+	return func(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+		n := atomic.AddInt32(calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "call %d", n)
+	}
+}
+
+func idempotentRequest(handler handlerFunc, serverData *servers.ServerHandlerData, key string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	handler(context.Background(), w, r, serverData)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	serverData := newTestServerData(t)
+	serverData.Config.IdempotencyTTL = time.Hour
+	var calls int32
+	handler := Idempotent(countingHandler(&calls, http.StatusOK))
+
+	first := idempotentRequest(handler, serverData, "k1", "body")
+	replay := idempotentRequest(handler, serverData, "k1", "body")
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if replay.Code != first.Code || replay.Body.String() != "call 1" || replay.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("replay = %v %q %v, want the first response", replay.Code, replay.Body.String(), replay.Header())
+	}
+	if first.Header().Get(IdempotentReplayedHeader) != "" || replay.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("%v = %q, %q; want only the replay marked", IdempotentReplayedHeader, first.Header().Get(IdempotentReplayedHeader), replay.Header().Get(IdempotentReplayedHeader))
+	}
+
+	// the key is reused for a different body
+	if w := idempotentRequest(handler, serverData, "k1", "other"); w.Code != http.StatusUnprocessableEntity || calls != 1 {
+		t.Errorf("reused key = %v after %d calls, want 422 and 1 call", w.Code, calls)
+	}
+	// other keys and requests without a key run the handler
+	idempotentRequest(handler, serverData, "k2", "body")
+	idempotentRequest(handler, serverData, "", "body")
+	if calls != 3 {
+		t.Errorf("handler ran %d times, want 3", calls)
+	}
+}
+
+func TestIdempotentServerErrorNotStored(t *testing.T) {
+	serverData := newTestServerData(t)
+	serverData.Config.IdempotencyTTL = time.Hour
+	var calls int32
+	handler := Idempotent(countingHandler(&calls, http.StatusServiceUnavailable))
+
+	idempotentRequest(handler, serverData, "k1", "body")
+	if w := idempotentRequest(handler, serverData, "k1", "body"); w.Body.String() != "call 2" {
+		t.Errorf("retry = %q, want the handler to run again", w.Body.String())
+	}
+}
+
+func TestIdempotentTTL(t *testing.T) {
+	serverData := newTestServerData(t)
+	serverData.Config.IdempotencyTTL = 20 * time.Millisecond
+	var calls int32
+	handler := Idempotent(countingHandler(&calls, http.StatusOK))
+
+	idempotentRequest(handler, serverData, "k1", "body")
+	if w := idempotentRequest(handler, serverData, "k1", "body"); w.Body.String() != "call 1" {
+		t.Fatalf("replay = %q, want call 1", w.Body.String())
+	}
+	time.Sleep(30 * time.Millisecond)
+	// the stored response expired, the same key applies again, even with another body
+	if w := idempotentRequest(handler, serverData, "k1", "other"); w.Code != http.StatusOK || w.Body.String() != "call 2" {
+		t.Errorf("after TTL = %v %q, want call 2", w.Code, w.Body.String())
+	}
+}
+
+func TestIdempotentConcurrent(t *testing.T) {
+	serverData := newTestServerData(t)
+	serverData.Config.IdempotencyTTL = time.Hour
+	var calls int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := Idempotent(func(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(entered)
+			<-release
+		}
+		w.Write([]byte("done"))
+	})
+
+	const n = 4
+	resps := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resps[0] = idempotentRequest(handler, serverData, "k1", "body")
+	}()
+	<-entered
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i] = idempotentRequest(handler, serverData, "k1", "body")
+		}(i)
+	}
+	// the retries wait for the key held by the first request
+	time.Sleep(20 * time.Millisecond)
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("handler ran %d times while the first request was in flight", c)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+	for i, w := range resps {
+		if w.Code != http.StatusOK || w.Body.String() != "done" {
+			t.Errorf("request %d = %v %q", i, w.Code, w.Body.String())
+		}
+		if isReplay := w.Header().Get(IdempotentReplayedHeader) == "true"; isReplay != (i > 0) {
+			t.Errorf("request %d replayed = %v", i, isReplay)
+		}
+	}
+
+	// a waiter gives up when its request is canceled
+	entered, release = make(chan struct{}), make(chan struct{})
+	calls = 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		idempotentRequest(handler, serverData, "k2", "body")
+	}()
+	<-entered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader("body")).WithContext(ctx)
+	r.Header.Set(IdempotencyKeyHeader, "k2")
+	w := httptest.NewRecorder()
+	handler(context.Background(), w, r, serverData)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled waiter = %v, want 503", w.Code)
+	}
+	close(release)
+	wg.Wait()
+}
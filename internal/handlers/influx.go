@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+type influxField struct {
+	key      string
+	value    float64
+	intValue int64
+	isInt    bool
+	isString bool
+}
+
+type influxPoint struct {
+	measurement string
+	tags        types.Labels
+	fields      []influxField
+	time        time.Time
+}
+
+// HandlerInfluxWrite accepts Influx line protocol on POST /write.
+// Points are stored as measurement_field series with tags as labels; float and bool fields are gauges,
+// integer fields are cumulative counters when the ID matches Config.InfluxCounterFields and gauges otherwise.
+// Lines the parser or the storage refuses are dropped and reported as a partial write, the rest is stored.
+func HandlerInfluxWrite(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil || serverData.Repo == nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerInfluxWrite(): Repo fail"))
+		influxError(w, http.StatusInternalServerError, e.Error())
+		log.Fatalln(e)
+		return
+	}
+
+	precision, err := influxPrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		influxError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	tx := repositories.BeginCumulative(serverData.Repo)
+	defer tx.Rollback()
+	counters := &influxCounters{repo: serverData.Repo, tx: tx}
+	validMetrics := []types.Metrics{}
+	// metricLines holds the index in lines of every valid metric
+	metricLines := []int{}
+	lines := []string{}
+	lineErrors := []string{}
+	dropped := 0
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseInfluxLine(line, precision, now)
+		if err == nil {
+			var metrics []types.Metrics
+			metrics, err = influxPointMetrics(point, counters, serverData)
+			if err == nil {
+				for range metrics {
+					metricLines = append(metricLines, len(lines))
+				}
+				validMetrics = append(validMetrics, metrics...)
+				lines = append(lines, line)
+			}
+		}
+		if err != nil {
+			dropped++
+			lineErrors = append(lineErrors, fmt.Sprintf("unable to parse '%s': %v", line, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		influxError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	refused, err := influxStore(r.Context(), serverData.Repo, validMetrics, metricLines)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerInfluxWrite(): %w", err))
+		influxError(w, http.StatusServiceUnavailable, e.Error())
+		log.Println(e)
+		return
+	}
+	for i, m := range validMetrics {
+		if _, ok := refused[metricLines[i]]; ok {
+			tx.Forget(m.Key())
+		}
+	}
+	tx.Commit()
+	if len(refused) < len(lines) {
+		serverData.Repo.FlushDB(mainCtx)
+	}
+	var refusedErr error
+	for i, line := range lines {
+		if lineErr, ok := refused[i]; ok {
+			dropped++
+			lineErrors = append(lineErrors, fmt.Sprintf("unable to write '%s': %v", line, lineErr))
+			refusedErr = lineErr
+		}
+	}
+
+	if dropped > 0 {
+		msg := fmt.Sprintf("partial write: %s dropped=%d", strings.Join(lineErrors, "; "), dropped)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerInfluxWrite(): %v", msg)))
+		status := http.StatusBadRequest
+		if len(refused) > 0 && len(refused) == len(lines) {
+			// nothing was stored, e.g. every line is over the series limit
+			status = writeErrStatus(refusedErr)
+		}
+		influxError(w, status, msg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// influxError writes the 1.x error body Telegraf and client libraries read.
+func influxError(w http.ResponseWriter, status int, msg string) {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func influxPrecision(p string) (time.Duration, error) {
+	switch p {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q", p)
+}
+
+// influxStore writes metrics with one SetMany. A line with a metric the storage refuses is dropped
+// and the rest retried, like a best-effort batch; refused maps the dropped lines to their errors.
+// An error not tied to a metric is returned and nothing is stored.
+func influxStore(ctx context.Context, repo repositories.Repo, metrics []types.Metrics, metricLines []int) (map[int]error, error) {
+	refused := map[int]error{}
+	for len(metrics) > 0 {
+		err := repositories.NewV2(repo).SetMany(ctx, metrics)
+		if err == nil {
+			return refused, nil
+		}
+		var itemErr *repositories.ItemError
+		if !errors.As(err, &itemErr) || itemErr.Index >= len(metrics) {
+			return refused, err
+		}
+		line := metricLines[itemErr.Index]
+		refused[line] = errReason(itemErr.Err)
+		keptMetrics := make([]types.Metrics, 0, len(metrics))
+		keptLines := make([]int, 0, len(metrics))
+		for i, m := range metrics {
+			if metricLines[i] != line {
+				keptMetrics = append(keptMetrics, m)
+				keptLines = append(keptLines, metricLines[i])
+			}
+		}
+		metrics, metricLines = keptMetrics, keptLines
+	}
+	return refused, nil
+}
+
+// influxCounters turns cumulative counter fields into deltas against the last value the client sent,
+// like OTLP cumulative sums; a value below it means the client restarted and counts from zero.
+type influxCounters struct {
+	repo repositories.Repo
+	tx   *repositories.CumulativeTx
+}
+
+// delta returns the increase of key up to total, take records total once the point is accepted.
+// A series not seen since start-up goes on from its stored total.
+func (c *influxCounters) delta(key string, total int64) (int64, error) {
+	if total < 0 {
+		return 0, fmt.Errorf("%v: negative counter %d", key, total)
+	}
+	last, found := c.tx.Last(key)
+	old := last.Metric.GetDelta()
+	if !found {
+		stored, err := c.repo.Get(key)
+		if err == nil {
+			if types.DataType(stored.MType) != types.CounterType {
+				return 0, fmt.Errorf("%v: stored as %v, got %v", key, stored.MType, types.CounterType)
+			}
+			old, found = stored.GetDelta(), true
+		}
+	}
+	if found && total >= old {
+		return total - old, nil
+	}
+	return total, nil
+}
+
+func (c *influxCounters) take(totals map[string]types.Metrics) {
+	for key, m := range totals {
+		c.tx.Save(key, repositories.CumulativePoint{Metric: m})
+	}
+}
+
+func influxPointMetrics(point influxPoint, counters *influxCounters, serverData *servers.ServerHandlerData) ([]types.Metrics, error) {
+	metrics := []types.Metrics{}
+	totals := map[string]types.Metrics{}
+	for _, f := range point.fields {
+		if f.isString {
+			continue
+		}
+		id := point.measurement + "_" + f.key
+		mType := types.GaugeType
+		source := types.OsSource
+		if f.isInt && isInfluxCounter(id, serverData.Config.InfluxCounterFields) {
+			mType, source = types.CounterType, types.IncrementSource
+		}
+		m, err := types.NewMetric(id, mType, source)
+		if err != nil {
+			return nil, err
+		}
+		m.Labels = point.tags.Copy()
+		m.SetTime(point.time)
+		err = m.CheckTime(time.Now(), serverData.Config.MaxSampleAge, serverData.Config.MaxSampleSkew)
+		if err != nil {
+			return nil, err
+		}
+		if mType == types.CounterType {
+			var delta int64
+			delta, err = counters.delta(m.Key(), f.intValue)
+			if err == nil {
+				total := f.intValue
+				totals[m.Key()] = types.Metrics{ID: id, MType: string(types.CounterType), Delta: &total}
+				err = m.Set(delta)
+			}
+		} else {
+			err = m.Set(f.value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, *m)
+	}
+	counters.take(totals)
+	return metrics, nil
+}
+
+func isInfluxCounter(id string, patterns string) bool {
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) < 1 {
+			continue
+		}
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseInfluxLine parses measurement[,tag=v...] field=v[,field=v...] [timestamp].
+func parseInfluxLine(line string, precision time.Duration, now time.Time) (influxPoint, error) {
+	point := influxPoint{time: now}
+	sections := splitInflux(line, ' ', true)
+	if len(sections) < 2 {
+		return point, fmt.Errorf("missing fields")
+	}
+	if len(sections) > 3 {
+		return point, fmt.Errorf("unexpected %q", sections[3])
+	}
+
+	keyParts := splitInflux(sections[0], ',', false)
+	point.measurement = unescapeInflux(keyParts[0])
+	if len(point.measurement) < 1 {
+		return point, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range keyParts[1:] {
+		kv := splitInflux(tag, '=', false)
+		if len(kv) != 2 || len(kv[0]) < 1 {
+			return point, fmt.Errorf("bad tag %q", tag)
+		}
+		if point.tags == nil {
+			point.tags = types.Labels{}
+		}
+		point.tags[types.LabelName(unescapeInflux(kv[0]))] = unescapeInflux(kv[1])
+	}
+
+	for _, field := range splitInflux(sections[1], ',', true) {
+		kv := splitInflux(field, '=', true)
+		if len(kv) != 2 || len(kv[0]) < 1 {
+			return point, fmt.Errorf("bad field %q", field)
+		}
+		f, err := parseInfluxValue(kv[1])
+		if err != nil {
+			return point, fmt.Errorf("field %q: %w", kv[0], err)
+		}
+		f.key = unescapeInflux(kv[0])
+		point.fields = append(point.fields, f)
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("bad timestamp %q", sections[2])
+		}
+		point.time = time.Unix(0, 0).Add(time.Duration(ts) * precision)
+	}
+	return point, nil
+}
+
+func parseInfluxValue(v string) (influxField, error) {
+	f := influxField{}
+	switch {
+	case len(v) < 1:
+		return f, fmt.Errorf("empty value")
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+			return f, fmt.Errorf("unterminated string")
+		}
+		f.isString = true
+		return f, nil
+	case v == "t", v == "T", v == "true", v == "True", v == "TRUE":
+		f.value = 1
+		return f, nil
+	case v == "f", v == "F", v == "false", v == "False", v == "FALSE":
+		f.value = 0
+		return f, nil
+	case strings.HasSuffix(v, "i"):
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("bad integer %q", v)
+		}
+		f.value, f.intValue, f.isInt = float64(i), i, true
+		return f, nil
+	case strings.HasSuffix(v, "u"):
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil || u > math.MaxInt64 {
+			return f, fmt.Errorf("bad unsigned %q", v)
+		}
+		f.value, f.intValue, f.isInt = float64(u), int64(u), true
+		return f, nil
+	}
+	fl, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(fl) || math.IsInf(fl, 0) {
+		return f, fmt.Errorf("bad float %q", v)
+	}
+	f.value = fl
+	return f, nil
+}
+
+// splitInflux splits on sep outside backslash escapes and, with withQuotes, outside "strings".
+// Escapes are kept, unescapeInflux removes them.
+func splitInflux(s string, sep byte, withQuotes bool) []string {
+	parts := []string{}
+	start := 0
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case withQuotes && s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+			if sep == '=' {
+				// only the first '=' separates key and value
+				return append(parts, s[start:])
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
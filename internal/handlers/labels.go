@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// labelsFromQuery reads ?name=value pairs as metric labels, skipping reserved params.
+func labelsFromQuery(r *http.Request, reserved ...string) types.Labels {
+	labels := types.Labels{}
+	for k, v := range r.URL.Query() {
+		if len(v) < 1 || isReservedParam(k, reserved) {
+			continue
+		}
+		labels[k] = v[0]
+	}
+	if len(labels) < 1 {
+		return nil
+	}
+	return labels
+}
+
+func isReservedParam(k string, reserved []string) bool {
+	for _, r := range reserved {
+		if k == r {
+			return true
+		}
+	}
+	return false
+}
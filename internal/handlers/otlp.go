@@ -0,0 +1,388 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpProtobuf = "application/x-protobuf"
+	otlpJSON     = "application/json"
+)
+
+// otlpBatch converts data points, cumulative values become deltas against the last point of the series.
+type otlpBatch struct {
+	repo       repositories.Repo
+	cumulative *repositories.CumulativeTx
+	metrics    []types.Metrics
+	current    map[string]types.Metrics
+	rejected   int64
+	lastErr    error
+}
+
+// HandlerOTLPMetrics is the OTLP/HTTP receiver on POST /v1/metrics.
+// Resource and data point attributes are labels, Sum and Gauge points are counters or gauges,
+// explicit bucket Histograms are histograms; other point kinds are rejected as partial success.
+func HandlerOTLPMetrics(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != otlpProtobuf && contentType != otlpJSON {
+		otlpError(w, otlpProtobuf, http.StatusUnsupportedMediaType, codes.InvalidArgument, fmt.Errorf("unsupported content type %q", contentType))
+		return
+	}
+	if serverData == nil || serverData.Repo == nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerOTLPMetrics(): Repo fail"))
+		otlpError(w, contentType, http.StatusInternalServerError, codes.Internal, e)
+		log.Fatalln(e)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		otlpError(w, contentType, http.StatusBadRequest, codes.InvalidArgument, err)
+		return
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	if contentType == otlpJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, req)
+	} else {
+		err = proto.Unmarshal(body, req)
+	}
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerOTLPMetrics(): bad request: %w", err))
+		otlpError(w, contentType, http.StatusBadRequest, codes.InvalidArgument, e)
+		log.Println(e)
+		return
+	}
+
+	tx := repositories.BeginCumulative(serverData.Repo)
+	defer tx.Rollback()
+	batch := otlpBatch{repo: serverData.Repo, cumulative: tx, current: map[string]types.Metrics{}}
+	for _, rm := range req.GetResourceMetrics() {
+		resourceLabels := otlpLabels(nil, rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				batch.addMetric(m, resourceLabels, serverData)
+			}
+		}
+	}
+
+	err = repositories.NewV2(serverData.Repo).SetMany(r.Context(), batch.metrics)
+	if err != nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerOTLPMetrics(): %w", err))
+		code := codes.InvalidArgument
+		if errors.Is(err, repositories.ErrSeriesLimit) {
+			// not retryable, unlike ResourceExhausted
+			code = codes.FailedPrecondition
+		} else if errors.Is(err, repositories.ErrSeriesNotAllowed) {
+			code = codes.PermissionDenied
+		}
+		otlpError(w, contentType, writeErrStatus(err), code, e)
+		log.Println(e)
+		return
+	}
+	tx.Commit()
+	serverData.Repo.FlushDB(mainCtx)
+
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if batch.rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: batch.rejected,
+			ErrorMessage:       batch.lastErr.Error(),
+		}
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerOTLPMetrics(): rejected %d points, last: %w", batch.rejected, batch.lastErr)))
+	}
+	otlpWrite(w, contentType, http.StatusOK, resp)
+}
+
+func otlpWrite(w http.ResponseWriter, contentType string, httpStatus int, msg proto.Message) {
+	var body []byte
+	var err error
+	if contentType == otlpJSON {
+		body, err = protojson.Marshal(msg)
+	} else {
+		body, err = proto.Marshal(msg)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(httpStatus)
+	w.Write(body)
+}
+
+// otlpError answers with a google.rpc.Status as the OTLP/HTTP spec asks.
+func otlpError(w http.ResponseWriter, contentType string, httpStatus int, code codes.Code, err error) {
+	otlpWrite(w, contentType, httpStatus, status.New(code, err.Error()).Proto())
+}
+
+func (b *otlpBatch) reject(err error) {
+	b.rejected++
+	b.lastErr = err
+}
+
+func (b *otlpBatch) addMetric(m *metricspb.Metric, resourceLabels types.Labels, serverData *servers.ServerHandlerData) {
+	name := m.GetName()
+	switch {
+	case m.GetGauge() != nil:
+		for _, dp := range m.GetGauge().GetDataPoints() {
+			b.addNumber(name, dp, resourceLabels, false, false, true, serverData)
+		}
+	case m.GetSum() != nil:
+		sum := m.GetSum()
+		isCumulative := sum.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+		for _, dp := range sum.GetDataPoints() {
+			b.addNumber(name, dp, resourceLabels, sum.GetIsMonotonic(), isCumulative, false, serverData)
+		}
+	case m.GetHistogram() != nil:
+		h := m.GetHistogram()
+		isCumulative := h.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+		for _, dp := range h.GetDataPoints() {
+			b.addHistogram(name, dp, resourceLabels, isCumulative, serverData)
+		}
+	case m.GetExponentialHistogram() != nil:
+		for range m.GetExponentialHistogram().GetDataPoints() {
+			b.reject(fmt.Errorf("%v: exponential histogram not supported", name))
+		}
+	case m.GetSummary() != nil:
+		for range m.GetSummary().GetDataPoints() {
+			b.reject(fmt.Errorf("%v: summary not supported", name))
+		}
+	}
+}
+
+// stored is the series value after points already taken into this batch.
+func (b *otlpBatch) stored(key string, mType types.DataType) (types.Metrics, bool, error) {
+	old, found := b.current[key]
+	if !found {
+		var err error
+		old, err = b.repo.Get(key)
+		found = err == nil
+	}
+	if found && types.DataType(old.MType) != mType {
+		return old, found, fmt.Errorf("%v: stored as %v, got %v", key, old.MType, mType)
+	}
+	return old, found, nil
+}
+
+func (b *otlpBatch) add(m *types.Metrics, pointTime uint64, serverData *servers.ServerHandlerData) error {
+	if pointTime > 0 {
+		m.SetTime(time.Unix(0, int64(pointTime)))
+	} else {
+		m.SetTime(time.Now())
+	}
+	err := m.CheckTime(time.Now(), serverData.Config.MaxSampleAge, serverData.Config.MaxSampleSkew)
+	if err != nil {
+		return err
+	}
+	cur, found := b.current[m.Key()]
+	if !found {
+		cur, _ = b.repo.Get(m.Key())
+		if len(cur.MType) < 1 {
+			cur = m.GetMetric()
+			b.current[m.Key()] = cur
+			b.metrics = append(b.metrics, *m)
+			return nil
+		}
+	}
+	err = cur.SetMetric(*m)
+	if err != nil {
+		return err
+	}
+	b.current[m.Key()] = cur
+	b.metrics = append(b.metrics, *m)
+	return nil
+}
+
+// addNumber stores monotonic int sums as counters, everything else as gauges;
+// delta gauges from non-monotonic or double sums add to the stored value.
+func (b *otlpBatch) addNumber(name string, dp *metricspb.NumberDataPoint, resourceLabels types.Labels, isMonotonic bool, isCumulative bool, isGauge bool, serverData *servers.ServerHandlerData) {
+	labels := otlpLabels(resourceLabels, dp.GetAttributes())
+	key := types.SeriesKey(name, labels)
+	_, isInt := dp.GetValue().(*metricspb.NumberDataPoint_AsInt)
+
+	var m *types.Metrics
+	var last *repositories.CumulativePoint
+	var err error
+	if isMonotonic && isInt {
+		m, err = types.NewMetric(name, types.CounterType, types.IncrementSource)
+		if err == nil {
+			var old types.Metrics
+			var found bool
+			old, found, err = b.stored(key, types.CounterType)
+			delta := dp.GetAsInt()
+			if err == nil && isCumulative {
+				total := delta
+				last = &repositories.CumulativePoint{
+					Start:  dp.GetStartTimeUnixNano(),
+					Metric: types.Metrics{ID: name, MType: string(types.CounterType), Delta: &total},
+				}
+				base, ok := b.lastPoint(key, last.Start, old, found)
+				// a new start time or a value below the last one means the client restarted
+				if ok && base.Start == last.Start && total >= base.Metric.GetDelta() {
+					delta -= base.Metric.GetDelta()
+				}
+			}
+			if err == nil {
+				err = m.Set(delta)
+			}
+		}
+	} else {
+		value := dp.GetAsDouble()
+		if isInt {
+			value = float64(dp.GetAsInt())
+		}
+		m, err = types.NewMetric(name, types.GaugeType, types.OsSource)
+		if err == nil {
+			var old types.Metrics
+			var found bool
+			old, found, err = b.stored(key, types.GaugeType)
+			if err == nil && !isGauge && !isCumulative && found {
+				value += old.GetValue()
+			}
+		}
+		if err == nil {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				err = fmt.Errorf("%v: bad value %v", key, value)
+			} else {
+				err = m.Set(value)
+			}
+		}
+	}
+	if err == nil {
+		m.Labels = labels
+		err = b.add(m, dp.GetTimeUnixNano(), serverData)
+	}
+	if err != nil {
+		b.reject(err)
+		return
+	}
+	if last != nil {
+		b.cumulative.Save(key, *last)
+	}
+}
+
+// lastPoint is the previous cumulative point of key. A series not seen since start-up
+// falls back to its stored value, as if the client had sent it in the same run.
+func (b *otlpBatch) lastPoint(key string, start uint64, stored types.Metrics, found bool) (repositories.CumulativePoint, bool) {
+	last, ok := b.cumulative.Last(key)
+	if ok || !found {
+		return last, ok
+	}
+	return repositories.CumulativePoint{Start: start, Metric: stored}, true
+}
+
+func (b *otlpBatch) addHistogram(name string, dp *metricspb.HistogramDataPoint, resourceLabels types.Labels, isCumulative bool, serverData *servers.ServerHandlerData) {
+	labels := otlpLabels(resourceLabels, dp.GetAttributes())
+	key := types.SeriesKey(name, labels)
+	m := &types.Metrics{ID: name, MType: string(types.HistogramType), Labels: labels}
+	m.Buckets = append(types.Float64List(nil), dp.GetExplicitBounds()...)
+	m.Counts = make(types.Int64List, len(dp.GetBucketCounts()))
+	for i, c := range dp.GetBucketCounts() {
+		m.Counts[i] = int64(c)
+	}
+	count := int64(dp.GetCount())
+	sum := dp.GetSum()
+
+	var last *repositories.CumulativePoint
+	err := m.CheckBuckets()
+	if err == nil {
+		var old types.Metrics
+		var found bool
+		old, found, err = b.stored(key, types.HistogramType)
+		if err == nil && isCumulative {
+			totalCount, totalSum := count, sum
+			last = &repositories.CumulativePoint{
+				Start: dp.GetStartTimeUnixNano(),
+				Metric: types.Metrics{ID: name, MType: string(types.HistogramType), Buckets: m.Buckets,
+					Counts: append(types.Int64List(nil), m.Counts...), Delta: &totalCount, Value: &totalSum},
+			}
+			base, ok := b.lastPoint(key, last.Start, old, found)
+			if ok && base.Start == last.Start && isHistogramContinued(base.Metric, m) {
+				for i := range m.Counts {
+					m.Counts[i] -= base.Metric.Counts[i]
+				}
+				count -= base.Metric.GetDelta()
+				sum -= base.Metric.GetValue()
+			}
+		}
+	}
+	if err == nil {
+		m.Delta = &count
+		m.Value = &sum
+		err = b.add(m, dp.GetTimeUnixNano(), serverData)
+	}
+	if err != nil {
+		b.reject(fmt.Errorf("%v: %w", key, err))
+		return
+	}
+	if last != nil {
+		b.cumulative.Save(key, *last)
+	}
+}
+
+// isHistogramContinued reports whether cumulative newM grew from old with the same buckets.
+func isHistogramContinued(old types.Metrics, newM *types.Metrics) bool {
+	if len(old.Buckets) != len(newM.Buckets) || len(old.Counts) != len(newM.Counts) {
+		return false
+	}
+	for i := range old.Buckets {
+		if old.Buckets[i] != newM.Buckets[i] {
+			return false
+		}
+	}
+	for i := range old.Counts {
+		if newM.Counts[i] < old.Counts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// otlpLabels adds attributes to a copy of base, names like service.name become service_name.
+func otlpLabels(base types.Labels, attrs []*commonpb.KeyValue) types.Labels {
+	labels := base.Copy()
+	for _, kv := range attrs {
+		if labels == nil {
+			labels = types.Labels{}
+		}
+		labels[types.LabelName(kv.GetKey())] = otlpValue(kv.GetValue())
+	}
+	return labels
+}
+
+func otlpValue(v *commonpb.AnyValue) string {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return val.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(val.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(val.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(val.DoubleValue, 'g', -1, 64)
+	case nil:
+		return ""
+	}
+	body, _ := protojson.Marshal(v)
+	return string(body)
+}
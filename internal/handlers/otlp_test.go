@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpDelta      = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	otlpCumulative = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+)
+
+func exportOTLP(t *testing.T, serverData *servers.ServerHandlerData, metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceResponse {
+	t.Helper()
+	req := &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+	}}}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+	r.Header.Set("Content-Type", otlpProtobuf)
+	w := httptest.NewRecorder()
+	HandlerOTLPMetrics(context.Background(), w, r, serverData)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export = %v %v", w.Code, w.Body.String())
+	}
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if err := proto.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func otlpSum(name string, temporality metricspb.AggregationTemporality, start uint64, v int64) *metricspb.Metric {
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+		AggregationTemporality: temporality,
+		IsMonotonic:            true,
+		DataPoints: []*metricspb.NumberDataPoint{{
+			StartTimeUnixNano: start,
+			Value:             &metricspb.NumberDataPoint_AsInt{AsInt: v},
+		}},
+	}}}
+}
+
+func otlpHistogram(name string, temporality metricspb.AggregationTemporality, start uint64, counts ...uint64) *metricspb.Metric {
+	count := uint64(0)
+	for _, c := range counts {
+		count += c
+	}
+	sum := float64(count)
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+		AggregationTemporality: temporality,
+		DataPoints: []*metricspb.HistogramDataPoint{{
+			StartTimeUnixNano: start,
+			ExplicitBounds:    []float64{1},
+			BucketCounts:      counts,
+			Count:             count,
+			Sum:               &sum,
+		}},
+	}}}
+}
+
+func TestHandlerOTLPMetricsTemporality(t *testing.T) {
+	serverData := newTestServerData(t)
+
+	exportOTLP(t, serverData, otlpSum("requests", otlpDelta, 0, 5), otlpSum("bytes", otlpCumulative, 100, 10))
+	exportOTLP(t, serverData, otlpSum("requests", otlpDelta, 0, 5), otlpSum("bytes", otlpCumulative, 100, 15))
+
+	for key, want := range map[string]int64{"requests": 10, "bytes": 15} {
+		m, err := serverData.Repo.Get(key)
+		if err != nil || m.MType != string(types.CounterType) || m.GetDelta() != want {
+			t.Errorf("%v = %+v, %v; want counter %d", key, m, err, want)
+		}
+	}
+
+	exportOTLP(t, serverData, otlpHistogram("latency", otlpCumulative, 100, 1, 2))
+	exportOTLP(t, serverData, otlpHistogram("latency", otlpCumulative, 100, 2, 3))
+	exportOTLP(t, serverData, otlpHistogram("spans", otlpDelta, 0, 1, 2))
+	exportOTLP(t, serverData, otlpHistogram("spans", otlpDelta, 0, 1, 2))
+	for key, want := range map[string][]int64{"latency": {2, 3}, "spans": {2, 4}} {
+		m, err := serverData.Repo.Get(key)
+		if err != nil || len(m.Counts) != 2 || m.Counts[0] != want[0] || m.Counts[1] != want[1] || m.GetDelta() != want[0]+want[1] {
+			t.Errorf("%v = %+v, %v; want counts %v", key, m, err, want)
+		}
+	}
+}
+
+func TestHandlerOTLPMetricsCumulativeReset(t *testing.T) {
+	serverData := newTestServerData(t)
+	total := func(key string) int64 {
+		m, err := serverData.Repo.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%v) = %v", key, err)
+		}
+		return m.GetDelta()
+	}
+
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 100, 10))
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 100, 15))
+	// the client restarted with a new start time, its value counts from zero
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 200, 3))
+	if total("bytes") != 18 {
+		t.Errorf("after restart total = %v, want 18", total("bytes"))
+	}
+	// later points go on from the restarted value, not from the stored total
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 200, 5))
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 200, 9))
+	if total("bytes") != 24 {
+		t.Errorf("total = %v, want 24", total("bytes"))
+	}
+	// within one start time only a drop is a reset
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 200, 2))
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 200, 4))
+	if total("bytes") != 28 {
+		t.Errorf("after drop total = %v, want 28", total("bytes"))
+	}
+
+	exportOTLP(t, serverData, otlpHistogram("latency", otlpCumulative, 100, 4, 4))
+	exportOTLP(t, serverData, otlpHistogram("latency", otlpCumulative, 200, 1, 0))
+	exportOTLP(t, serverData, otlpHistogram("latency", otlpCumulative, 200, 2, 1))
+	if m, _ := serverData.Repo.Get("latency"); len(m.Counts) != 2 || m.Counts[0] != 6 || m.Counts[1] != 5 || m.GetDelta() != 11 {
+		t.Errorf("latency = %+v, want counts [6 5]", m)
+	}
+
+	// a deleted series forgets its last point, the next value is the new total
+	if _, err := serverData.Repo.Delete(context.Background(), []string{"bytes"}); err != nil {
+		t.Fatal(err)
+	}
+	exportOTLP(t, serverData, otlpSum("bytes", otlpCumulative, 200, 6))
+	if total("bytes") != 6 {
+		t.Errorf("after delete total = %v, want 6", total("bytes"))
+	}
+}
+
+func TestHandlerOTLPMetricsRejectedPoints(t *testing.T) {
+	serverData := newTestServerData(t)
+
+	exponential := &metricspb.Metric{Name: "exp", Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+		DataPoints: []*metricspb.ExponentialHistogramDataPoint{{Count: 1}, {Count: 2}},
+	}}}
+	summary := &metricspb.Metric{Name: "sum", Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+		DataPoints: []*metricspb.SummaryDataPoint{{Count: 1}},
+	}}}
+	resp := exportOTLP(t, serverData, exponential, summary, otlpSum("requests", otlpDelta, 0, 1))
+
+	if resp.GetPartialSuccess().GetRejectedDataPoints() != 3 || len(resp.GetPartialSuccess().GetErrorMessage()) < 1 {
+		t.Errorf("partial success = %v, want 3 rejected points", resp.GetPartialSuccess())
+	}
+	if m, err := serverData.Repo.Get("requests"); err != nil || m.GetDelta() != 1 {
+		t.Errorf("requests = %+v, %v; want the accepted point stored", m, err)
+	}
+	for _, key := range []string{"exp", "sum"} {
+		if _, err := serverData.Repo.Get(key); err == nil {
+			t.Errorf("%v stored", key)
+		}
+	}
+}
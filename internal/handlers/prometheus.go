@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+const (
+	promSeriesName   = "collectalertagent_series"
+	promRejectedName = "collectalertagent_series_rejected"
+)
+
+const (
+	promContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// promFamily groups series sharing one sanitized metric name.
+type promFamily struct {
+	name   string
+	mType  types.DataType
+	ids    []string
+	series []types.Metrics
+}
+
+// promReservedLabels are label names the exposition sets itself, user labels with them are renamed.
+var promReservedLabels = map[string]struct{}{"le": {}, "quantile": {}}
+
+func HandlerPrometheus(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil || serverData.Repo == nil {
+		repoErr := types.NewTimeError(fmt.Errorf("HandlerPrometheus(): Repo fail"))
+		http.Error(w, repoErr.Error(), http.StatusBadRequest)
+		log.Fatalln(repoErr)
+		return
+	}
+
+	isOpenMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+
+	var sb strings.Builder
+	for _, f := range promFamilies(serverData.Repo.GetAll(), isOpenMetrics) {
+		writePromFamily(&sb, f, isOpenMetrics)
+	}
+	if stats, ok := repositories.SeriesStatsOf(serverData.Repo); ok {
+		writePromSeriesStats(&sb, stats, isOpenMetrics)
+	}
+	if isOpenMetrics {
+		sb.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", promContentType)
+	}
+	io.WriteString(w, sb.String())
+}
+
+// promFamilies groups metrics by sanitized name in name order. Different IDs can sanitize to one name,
+// so a family whose name or sample names are already taken is dropped, and so is a series whose
+// label set repeats within its family; the first one in name, labels and ID order is kept.
+func promFamilies(metrics []types.Metrics, isOpenMetrics bool) []*promFamily {
+	families := map[string]*promFamily{}
+	for _, m := range metrics {
+		name := promName(m.ID)
+		if isOpenMetrics && types.DataType(m.MType) == types.CounterType {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{name: name, mType: types.DataType(m.MType)}
+			families[name] = f
+		}
+		if f.mType != types.DataType(m.MType) {
+			log.Println(types.NewTimeError(fmt.Errorf("HandlerPrometheus(): skip %v: type %v clashes with %v", m.Key(), m.MType, f.mType)))
+			continue
+		}
+		f.series = append(f.series, m)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the limiter metrics are always ours
+	taken := map[string]string{promSeriesName: promSeriesName, promRejectedName: promRejectedName, promRejectedName + "_total": promRejectedName}
+	res := make([]*promFamily, 0, len(names))
+	for _, name := range names {
+		f := families[name]
+		sampleNames := f.sampleNames(isOpenMetrics)
+		clash := ""
+		for _, sampleName := range sampleNames {
+			if owner, ok := taken[sampleName]; ok {
+				clash = owner
+				break
+			}
+		}
+		if len(clash) > 0 {
+			log.Println(types.NewTimeError(fmt.Errorf("HandlerPrometheus(): skip %v: names clash with %v", name, clash)))
+			continue
+		}
+		for _, sampleName := range sampleNames {
+			taken[sampleName] = name
+		}
+		f.dedupe()
+		res = append(res, f)
+	}
+	return res
+}
+
+// sampleNames returns the family name and every sample name it writes.
+func (f *promFamily) sampleNames(isOpenMetrics bool) []string {
+	switch f.mType {
+	case types.CounterType:
+		if isOpenMetrics {
+			return []string{f.name, f.name + "_total"}
+		}
+	case types.HistogramType:
+		return []string{f.name, f.name + "_bucket", f.name + "_sum", f.name + "_count"}
+	}
+	return []string{f.name}
+}
+
+// dedupe keeps one series per label set and sorts the series by labels.
+func (f *promFamily) dedupe() {
+	type labeled struct {
+		labels string
+		m      types.Metrics
+	}
+	all := make([]labeled, 0, len(f.series))
+	for _, m := range f.series {
+		all = append(all, labeled{labels: promLabels(m.Labels, "", ""), m: m})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].labels != all[j].labels {
+			return all[i].labels < all[j].labels
+		}
+		return all[i].m.ID < all[j].m.ID
+	})
+
+	f.series = f.series[:0]
+	ids := map[string]struct{}{}
+	for i, s := range all {
+		if i > 0 && s.labels == all[i-1].labels {
+			log.Println(types.NewTimeError(fmt.Errorf("HandlerPrometheus(): skip %v: same series as %v", s.m.Key(), f.series[len(f.series)-1].Key())))
+			continue
+		}
+		f.series = append(f.series, s.m)
+		ids[s.m.ID] = struct{}{}
+	}
+	f.ids = make([]string, 0, len(ids))
+	for id := range ids {
+		f.ids = append(f.ids, id)
+	}
+	sort.Strings(f.ids)
+}
+
+func writePromFamily(sb *strings.Builder, f *promFamily, isOpenMetrics bool) {
+	fmt.Fprintf(sb, "# HELP %s %s\n", f.name, promEscapeHelp(strings.Join(f.ids, ", ")))
+	fmt.Fprintf(sb, "# TYPE %s %s\n", f.name, f.mType)
+
+	for _, m := range f.series {
+		switch f.mType {
+		case types.CounterType:
+			sampleName := f.name
+			if isOpenMetrics {
+				sampleName += "_total"
+			}
+			fmt.Fprintf(sb, "%s%s %d\n", sampleName, promLabels(m.Labels, "", ""), m.GetDelta())
+		case types.HistogramType:
+			cumulative := int64(0)
+			for i, bound := range m.Buckets {
+				if i < len(m.Counts) {
+					cumulative += m.Counts[i]
+				}
+				fmt.Fprintf(sb, "%s_bucket%s %d\n", f.name, promLabels(m.Labels, "le", promFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", f.name, promLabels(m.Labels, "le", "+Inf"), m.GetDelta())
+			fmt.Fprintf(sb, "%s_sum%s %s\n", f.name, promLabels(m.Labels, "", ""), promFloat(m.GetValue()))
+			fmt.Fprintf(sb, "%s_count%s %d\n", f.name, promLabels(m.Labels, "", ""), m.GetDelta())
+		default:
+			fmt.Fprintf(sb, "%s%s %s\n", f.name, promLabels(m.Labels, "", ""), promFloat(m.GetValue()))
+		}
+	}
+}
+
+// writePromSeriesStats exposes the series limiter counters next to the stored metrics.
+func writePromSeriesStats(sb *strings.Builder, stats repositories.SeriesStats, isOpenMetrics bool) {
+	fmt.Fprintf(sb, "# HELP %s %s\n", promSeriesName, "Distinct series stored.")
+	fmt.Fprintf(sb, "# TYPE %s gauge\n", promSeriesName)
+	fmt.Fprintf(sb, "%s %d\n", promSeriesName, stats.Series)
+
+	// OpenMetrics names the counter family without the _total of its samples
+	name := promRejectedName + "_total"
+	if isOpenMetrics {
+		name = promRejectedName
+	}
+	fmt.Fprintf(sb, "# HELP %s %s\n", name, "Writes refused by series limits.")
+	fmt.Fprintf(sb, "# TYPE %s counter\n", name)
+	reasons := make([]string, 0, len(stats.Rejected))
+	for reason := range stats.Rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(sb, "%s_total%s %d\n", promRejectedName, promLabels(types.Labels{"reason": reason}, "", ""), stats.Rejected[reason])
+	}
+}
+
+// promName maps an ID to [a-zA-Z_:][a-zA-Z0-9_:]*
+func promName(id string) string {
+	var sb strings.Builder
+	for i, c := range id {
+		switch {
+		case c == '_', c == ':', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			sb.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(c)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	if sb.Len() < 1 {
+		return "_"
+	}
+	return sb.String()
+}
+
+// promLabels renders {k="v",...}, extraName is appended last (used for le).
+// User labels named le or quantile become exported_le and exported_quantile.
+func promLabels(labels types.Labels, extraName string, extraValue string) string {
+	pairs := []string{}
+	for _, k := range labels.Names() {
+		name := promName(k)
+		if _, ok := promReservedLabels[name]; ok {
+			name = "exported_" + name
+			for _, found := labels[name]; found; _, found = labels[name] {
+				name = "exported_" + name
+			}
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, promEscapeLabel(labels[k])))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) < 1 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promEscapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func promEscapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+const (
+	// streamBuffer updates queued per /stream client before the slow-consumer policy applies.
+	streamBuffer = 256
+	// streamKeepAlive comment interval, keeps proxies from closing idle streams.
+	streamKeepAlive = 15 * time.Second
+)
+
+// HandlerStream pushes accepted updates as Server-Sent Events on GET /stream?id=&type=.
+// Each event carries the stored value of the series in the /value/ JSON format;
+// a client that falls behind loses updates or, with the disconnect policy, gets an overflow event and is closed.
+func HandlerStream(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
+	if serverData == nil || serverData.Broker == nil {
+		e := types.NewTimeError(fmt.Errorf("HandlerStream(): Broker fail"))
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		log.Println(e)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := repositories.Filter{
+		MType:  types.DataType(query.Get("type")),
+		IDs:    query["id"],
+		Labels: labelsFromQuery(r, "id", "type"),
+	}
+	if len(filter.MType) > 0 && !filter.MType.IsValid() {
+		http.Error(w, "wrong type", http.StatusBadRequest)
+		return
+	}
+
+	sub := serverData.Broker.Subscribe(filter, streamBuffer, repositories.SlowPolicy(serverData.Config.StreamSlowPolicy))
+	defer serverData.Broker.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": stream\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	eventID := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-mainCtx.Done():
+			return
+		case <-sub.Overflow:
+			fmt.Fprintf(w, "event: overflow\ndata: {\"dropped\":%d}\n\n", sub.Dropped())
+			flusher.Flush()
+			log.Println(types.NewTimeError(fmt.Errorf("HandlerStream(): %v too slow, disconnected", r.RemoteAddr)))
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case m, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			m.GenHash(serverData.Config.HashKey)
+			txtM, err := json.Marshal(m)
+			if err != nil {
+				log.Println(types.NewTimeError(fmt.Errorf("HandlerStream(): %w", err)))
+				continue
+			}
+			eventID++
+			_, err = fmt.Fprintf(w, "id: %d\nevent: metric\ndata: %s\n\n", eventID, txtM)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/servers"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// streamWriter records a /stream response, metric events wait for gate to be closed.
+type streamWriter struct {
+	mu     sync.Mutex
+	header http.Header
+	buf    bytes.Buffer
+	gate   chan struct{}
+}
+
+func newStreamWriter(isBlocked bool) *streamWriter {
+	w := &streamWriter{header: make(http.Header), gate: make(chan struct{})}
+	if !isBlocked {
+		close(w.gate)
+	}
+	return w
+}
+
+func (w *streamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamWriter) WriteHeader(status int) {}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("event: metric")) {
+		<-w.gate
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *streamWriter) Flush() {}
+
+func (w *streamWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// events returns the data of every event of kind sent so far.
+func (w *streamWriter) events(kind string) []string {
+	data := []string{}
+	for _, event := range strings.Split(w.String(), "\n\n") {
+		if !strings.Contains(event, "event: "+kind+"\n") {
+			continue
+		}
+		data = append(data, event[strings.Index(event, "data: ")+len("data: "):])
+	}
+	return data
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newStreamServerData(t *testing.T, policy repositories.SlowPolicy) *servers.ServerHandlerData {
+	serverData := newTestServerData(t)
+	serverData.Broker = repositories.NewBroker()
+	serverData.Repo = repositories.NewPublishing(serverData.Repo, serverData.Broker)
+	serverData.Config.StreamSlowPolicy = string(policy)
+	return serverData
+}
+
+// startStream runs HandlerStream until the returned cancel, as a client going away, and waits for it to subscribe.
+func startStream(t *testing.T, serverData *servers.ServerHandlerData, query string, w *streamWriter) (cancel func(), done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/stream?"+query, nil).WithContext(ctx)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		HandlerStream(context.Background(), w, r, serverData)
+	}()
+	waitFor(t, "the stream to open", func() bool { return strings.HasPrefix(w.String(), ": stream") })
+	return cancel, finished
+}
+
+func TestHandlerStreamFilters(t *testing.T) {
+	tests := []struct {
+		query string
+		// last matches the filter, it is written after the others
+		last *types.Metrics
+		want []string
+	}{
+		{"", testGauge("Alloc", 9, nil), []string{"Alloc", `Alloc{host="a"}`, `PollCount{host="a"}`, "requests"}},
+		{"type=counter", testCounter("requests", 9, nil), []string{`PollCount{host="a"}`, "requests"}},
+		{"id=Alloc&id=requests", testGauge("Alloc", 9, nil), []string{"Alloc", `Alloc{host="a"}`, "requests"}},
+		{"host=a", testGauge("Alloc", 9, types.Labels{"host": "a"}), []string{`Alloc{host="a"}`, `PollCount{host="a"}`}},
+		{"id=Alloc&host=a", testGauge("Alloc", 9, types.Labels{"host": "a"}), []string{`Alloc{host="a"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			serverData := newStreamServerData(t, repositories.SlowDrop)
+			w := newStreamWriter(false)
+			cancel, done := startStream(t, serverData, tt.query, w)
+
+			serverData.Repo.Set(*testGauge("Alloc", 1, nil))
+			serverData.Repo.Set(*testGauge("Alloc", 2, types.Labels{"host": "a"}))
+			serverData.Repo.SetMany(context.Background(), []types.Metrics{
+				*testCounter("PollCount", 3, types.Labels{"host": "a"}),
+				*testCounter("requests", 4, nil),
+			})
+			serverData.Repo.Set(*tt.last)
+			// updates are queued in write order, once the last one is sent nothing else is coming
+			waitFor(t, "the last update", func() bool { return len(w.events("metric")) > len(tt.want) })
+			cancel()
+			<-done
+
+			got := []string{}
+			for _, data := range w.events("metric") {
+				m := types.Metrics{}
+				if err := json.Unmarshal([]byte(data), &m); err != nil {
+					t.Fatalf("event %q: %v", data, err)
+				}
+				got = append(got, m.Key())
+			}
+			want := append(tt.want, tt.last.Key())
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("streamed %v, want %v", got, want)
+			}
+		})
+	}
+
+	serverData := newStreamServerData(t, repositories.SlowDrop)
+	r := httptest.NewRequest(http.MethodGet, "/stream?type=summary", nil)
+	rec := httptest.NewRecorder()
+	HandlerStream(context.Background(), rec, r, serverData)
+	if rec.Code != http.StatusBadRequest || serverData.Broker.Subscribers() != 0 {
+		t.Errorf("wrong type = %v with %d subscribers, want 400", rec.Code, serverData.Broker.Subscribers())
+	}
+}
+
+func TestHandlerStreamOverflow(t *testing.T) {
+	serverData := newStreamServerData(t, repositories.SlowDisconnect)
+	w := newStreamWriter(true)
+	_, done := startStream(t, serverData, "", w)
+
+	// the handler is stuck writing the first update while the buffer fills up
+	metrics := make([]types.Metrics, streamBuffer+10)
+	for i := range metrics {
+		metrics[i] = *testCounter(fmt.Sprintf("c%03d", i), 1, nil)
+	}
+	serverData.Repo.SetMany(context.Background(), metrics)
+	close(w.gate)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client not disconnected")
+	}
+
+	overflow := w.events("overflow")
+	if len(overflow) != 1 || !strings.HasPrefix(overflow[0], `{"dropped":`) || strings.HasPrefix(overflow[0], `{"dropped":0}`) {
+		t.Errorf("overflow events = %v, want one with the dropped count", overflow)
+	}
+	if len(w.events("metric")) > streamBuffer+1 {
+		t.Errorf("%d updates sent, at most %d fit", len(w.events("metric")), streamBuffer+1)
+	}
+	if n := serverData.Broker.Subscribers(); n != 0 {
+		t.Errorf("%d subscribers after the disconnect", n)
+	}
+}
+
+func TestHandlerStreamClientGone(t *testing.T) {
+	serverData := newStreamServerData(t, repositories.SlowDrop)
+	cancelA, doneA := startStream(t, serverData, "", newStreamWriter(false))
+	cancelB, doneB := startStream(t, serverData, "type=gauge", newStreamWriter(false))
+	if n := serverData.Broker.Subscribers(); n != 2 {
+		t.Fatalf("%d subscribers, want 2", n)
+	}
+
+	cancelA()
+	<-doneA
+	if n := serverData.Broker.Subscribers(); n != 1 {
+		t.Errorf("%d subscribers after a client left, want 1", n)
+	}
+	// writes go on for the remaining client
+	serverData.Repo.Set(*testGauge("Alloc", 1, nil))
+	cancelB()
+	<-doneB
+	if n := serverData.Broker.Subscribers(); n != 0 {
+		t.Errorf("%d subscribers after every client left", n)
+	}
+}
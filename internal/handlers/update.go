@@ -3,27 +3,21 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
 	"github.com/aaarkadev/collectalertagent/internal/servers"
 	"github.com/aaarkadev/collectalertagent/internal/types"
 	"github.com/go-chi/chi/v5"
 )
 
-func HandlerUpdatesJSON(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
-	_, err := getHandlerUpdateJSONResponse(mainCtx, w, r, serverData)
-	if err != nil {
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{}`))
-}
-
 func HandlerUpdateJSON(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) {
 	txtM, err := getHandlerUpdateJSONResponse(mainCtx, w, r, serverData)
 	if err != nil {
@@ -33,6 +27,18 @@ func HandlerUpdateJSON(mainCtx context.Context, w http.ResponseWriter, r *http.R
 	w.Write([]byte(txtM))
 }
 
+// writeErrStatus maps a failed write to its status, series limits are told apart from bad input.
+// A full series limit does not clear by waiting, so it is 422 rather than a retryable 429.
+func writeErrStatus(err error) int {
+	if errors.Is(err, repositories.ErrSeriesNotAllowed) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, repositories.ErrSeriesLimit) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
 func getHandlerUpdateJSONResponse(mainCtx context.Context, w http.ResponseWriter, r *http.Request, serverData *servers.ServerHandlerData) (string, error) {
 
 	bodyBytes, err := io.ReadAll(r.Body)
@@ -75,15 +81,44 @@ func getHandlerUpdateJSONResponse(mainCtx context.Context, w http.ResponseWriter
 			log.Println(e)
 			return "", e
 		}
-		tmpHash := updateOneMetric
-		tmpHash.GenHash(serverData.Config.HashKey)
-		if len(updateOneMetric.Hash) > 0 && updateOneMetric.Hash != tmpHash.Hash {
-			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(6): wrong hash"))
+		if types.DataType(updateOneMetric.MType) == types.HistogramType {
+			if err := updateOneMetric.CheckBuckets(); err != nil {
+				e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(6): %w", err))
+				http.Error(w, e.Error(), http.StatusBadRequest)
+				log.Println(e)
+				return "", e
+			}
+		}
+		if !updateOneMetric.Labels.IsValid() {
+			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(7): labels invalid"))
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			log.Println(e)
+			return "", e
+		}
+		err = updateOneMetric.CheckHash(serverData.Config.HashKey)
+		if err != nil {
+			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(8): %w", err))
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			log.Println(e)
+			return "", e
+		}
+		err = updateOneMetric.CheckTime(time.Now(), serverData.Config.MaxSampleAge, serverData.Config.MaxSampleSkew)
+		if err != nil {
+			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(9): %w", err))
 			http.Error(w, e.Error(), http.StatusBadRequest)
 			log.Println(e)
 			return "", e
 		}
-		serverData.Repo.Set(updateOneMetric)
+		if updateOneMetric.Timestamp == 0 {
+			updateOneMetric.SetTime(time.Now())
+		}
+		err = repositories.NewV2(serverData.Repo).SetMany(r.Context(), []types.Metrics{updateOneMetric})
+		if err != nil {
+			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(10): %w", err))
+			http.Error(w, e.Error(), writeErrStatus(err))
+			log.Println(e)
+			return "", e
+		}
 		isUpdateOneMetric = true
 	}
 
@@ -92,29 +127,37 @@ func getHandlerUpdateJSONResponse(mainCtx context.Context, w http.ResponseWriter
 		newMetrics := []types.Metrics{}
 		err = json.Unmarshal([]byte(bodyStr), &newMetrics)
 		if err != nil {
-			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(7): %w", err))
+			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(11): %w", err))
 			http.Error(w, e.Error(), http.StatusBadRequest)
 			log.Println(e)
 			return "", e
 		}
 
+		validMetrics := []types.Metrics{}
 		for _, m := range newMetrics {
-
-			tmpHash := m
-			tmpHash.GenHash(serverData.Config.HashKey)
-
-			if len(m.Hash) > 0 && m.Hash != tmpHash.Hash {
-				e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(8): wrong hash %v", m.ID))
+			err := m.CheckHash(serverData.Config.HashKey)
+			if err != nil {
+				e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(12): %w", err))
 				log.Println(e)
 				continue
 			}
-			err := serverData.Repo.Set(m)
+			err = m.CheckTime(time.Now(), serverData.Config.MaxSampleAge, serverData.Config.MaxSampleSkew)
 			if err != nil {
-				e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(9): %w", err))
-				http.Error(w, e.Error(), http.StatusBadRequest)
+				e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(13): %w", err))
 				log.Println(e)
-				return "", e
+				continue
 			}
+			if m.Timestamp == 0 {
+				m.SetTime(time.Now())
+			}
+			validMetrics = append(validMetrics, m)
+		}
+		err = repositories.NewV2(serverData.Repo).SetMany(r.Context(), validMetrics)
+		if err != nil {
+			e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(14): %w", err))
+			http.Error(w, e.Error(), writeErrStatus(err))
+			log.Println(e)
+			return "", e
 		}
 		hashedMetrics := serverData.Repo.GetAll()
 		for i := range hashedMetrics {
@@ -122,13 +165,13 @@ func getHandlerUpdateJSONResponse(mainCtx context.Context, w http.ResponseWriter
 		}
 		txtM, err = json.Marshal(hashedMetrics)
 	} else {
-		updateOneMetric, _ = serverData.Repo.Get(updateOneMetric.ID)
+		updateOneMetric, _ = serverData.Repo.Get(updateOneMetric.Key())
 		updateOneMetric.GenHash(serverData.Config.HashKey)
 		txtM, err = json.Marshal(updateOneMetric)
 	}
 
 	if err != nil {
-		e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(10): %w", err))
+		e := types.NewTimeError(fmt.Errorf("HandlerUpdateJSON(15): %w", err))
 		http.Error(w, e.Error(), http.StatusBadRequest)
 		log.Println(e)
 		return "", e
@@ -184,11 +227,23 @@ func HandlerUpdateRaw(mainCtx context.Context, w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	labels := labelsFromQuery(r)
+	if !labels.IsValid() {
+		errStr := "wrong labels"
+		http.Error(w, errStr, http.StatusBadRequest)
+		log.Println(types.NewTimeError(fmt.Errorf("HandlerUpdateRaw(): fail: %v", errStr)))
+		return
+	}
+
 	var newM *types.Metrics
 	var newMerr error
-	if types.DataType(typeParam) == types.GaugeType {
+	switch types.DataType(typeParam) {
+	case types.GaugeType:
 		newM, newMerr = types.NewMetric(nameParam, types.DataType(typeParam), types.OsSource)
-	} else {
+	case types.HistogramType:
+		oldM, _ := serverData.Repo.Get(types.SeriesKey(nameParam, labels))
+		newM, newMerr = types.NewHistogram(nameParam, oldM.Buckets, types.OsSource)
+	default:
 		newM, newMerr = types.NewMetric(nameParam, types.DataType(typeParam), types.IncrementSource)
 	}
 	if newMerr != nil {
@@ -196,9 +251,12 @@ func HandlerUpdateRaw(mainCtx context.Context, w http.ResponseWriter, r *http.Re
 		log.Println(newMerr)
 		return
 	}
-	if types.DataType(typeParam) == types.GaugeType {
+	switch types.DataType(typeParam) {
+	case types.GaugeType:
 		err = newM.Set(float64(floatV))
-	} else {
+	case types.HistogramType:
+		err = newM.Observe(float64(floatV))
+	default:
 		err = newM.Set(int64(intV))
 	}
 	if err != nil {
@@ -206,9 +264,11 @@ func HandlerUpdateRaw(mainCtx context.Context, w http.ResponseWriter, r *http.Re
 		log.Println(err)
 		return
 	}
-	err = serverData.Repo.Set(*newM)
+	newM.Labels = labels
+	newM.SetTime(time.Now())
+	err = repositories.NewV2(serverData.Repo).SetMany(r.Context(), []types.Metrics{*newM})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), writeErrStatus(err))
 		log.Println(err)
 		return
 	}
@@ -0,0 +1,302 @@
+package listeners
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// graphiteQueueSize samples parsed but not yet written; when full, readers stop reading their sockets.
+const graphiteQueueSize = 1024
+
+// GraphiteListener reads "path value timestamp" lines over TCP and stores them as gauges,
+// tagged with the connection host for per-client series limits.
+// At most Config.GraphiteMaxConns connections are served, further clients wait in the accept backlog.
+type GraphiteListener struct {
+	Repo      repositories.Repo
+	Config    *configs.ServerConfig
+	templates []graphiteTemplate
+	ln        net.Listener
+	queue     chan graphiteSample
+	connsMu   sync.Mutex
+	conns     map[net.Conn]struct{}
+	isClosed  bool
+	readersWg sync.WaitGroup
+	writerWg  sync.WaitGroup
+}
+
+// graphiteSample is a parsed line and the host that sent it.
+type graphiteSample struct {
+	metric types.Metrics
+	client string
+}
+
+// graphiteTemplate maps path nodes to the ID and labels, e.g. "servers.* .host.measurement*".
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+}
+
+func (l *GraphiteListener) Start(mainCtx context.Context) error {
+	templates, err := ParseGraphiteTemplates(l.Config.GraphiteTemplates)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("GraphiteListener.Start(): fail: %w", err))
+	}
+	l.templates = templates
+
+	ln, err := net.Listen("tcp", l.Config.GraphiteAddress)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("GraphiteListener.Start(): fail: %w", err))
+	}
+	l.ln = ln
+	l.queue = make(chan graphiteSample, graphiteQueueSize)
+	l.conns = make(map[net.Conn]struct{})
+
+	l.writerWg.Add(1)
+	go func() {
+		defer l.writerWg.Done()
+		l.writeLoop(mainCtx)
+	}()
+
+	l.readersWg.Add(1)
+	go func() {
+		defer l.readersWg.Done()
+		l.acceptLoop(mainCtx)
+	}()
+
+	log.Println(types.NewTimeError(fmt.Errorf("GraphiteListener: listen tcp %v", ln.Addr())))
+	return nil
+}
+
+func (l *GraphiteListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Stop closes the listener and open connections, then writes what is still queued.
+func (l *GraphiteListener) Stop(mainCtx context.Context) {
+	if l.ln == nil {
+		return
+	}
+	l.ln.Close()
+	l.connsMu.Lock()
+	l.isClosed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.connsMu.Unlock()
+	l.readersWg.Wait()
+	close(l.queue)
+	l.writerWg.Wait()
+}
+
+func (l *GraphiteListener) acceptLoop(mainCtx context.Context) {
+	maxConns := l.Config.GraphiteMaxConns
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	slots := make(chan struct{}, maxConns)
+	for {
+		slots <- struct{}{}
+		conn, err := l.ln.Accept()
+		if err != nil {
+			<-slots
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println(types.NewTimeError(fmt.Errorf("GraphiteListener.acceptLoop(): fail: %w", err)))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		l.connsMu.Lock()
+		if l.isClosed {
+			l.connsMu.Unlock()
+			conn.Close()
+			<-slots
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.connsMu.Unlock()
+
+		l.readersWg.Add(1)
+		go func() {
+			defer l.readersWg.Done()
+			defer func() { <-slots }()
+			l.readConn(conn)
+			l.connsMu.Lock()
+			delete(l.conns, conn)
+			l.connsMu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (l *GraphiteListener) readConn(conn net.Conn) {
+	client := clientHost(conn.RemoteAddr())
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 1 {
+			continue
+		}
+		m, err := l.parseLine(line, time.Now())
+		if err != nil {
+			log.Println(types.NewTimeError(fmt.Errorf("GraphiteListener: skip %q: %w", line, err)))
+			continue
+		}
+		l.queue <- graphiteSample{metric: m, client: client}
+	}
+	err := scanner.Err()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Println(types.NewTimeError(fmt.Errorf("GraphiteListener.readConn(): %v fail: %w", conn.RemoteAddr(), err)))
+	}
+}
+
+// writeLoop is the only writer, it flushes the repo once per drained burst.
+func (l *GraphiteListener) writeLoop(mainCtx context.Context) {
+	for sample := range l.queue {
+		l.write(mainCtx, sample)
+	drain:
+		for {
+			select {
+			case next, ok := <-l.queue:
+				if !ok {
+					break drain
+				}
+				l.write(mainCtx, next)
+			default:
+				break drain
+			}
+		}
+		l.Repo.FlushDB(mainCtx)
+	}
+}
+
+func (l *GraphiteListener) write(mainCtx context.Context, sample graphiteSample) {
+	err := l.Repo.SetMany(repositories.WithClient(mainCtx, sample.client), []types.Metrics{sample.metric})
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("GraphiteListener.write(): skip %v: %w", sample.metric.Key(), err)))
+	}
+}
+
+func (l *GraphiteListener) parseLine(line string, now time.Time) (types.Metrics, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return types.Metrics{}, fmt.Errorf("want path value [timestamp]")
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return types.Metrics{}, fmt.Errorf("bad value %q", fields[1])
+	}
+	sampleTime := now
+	if len(fields) == 3 && fields[2] != "-1" && fields[2] != "N" {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return types.Metrics{}, fmt.Errorf("bad timestamp %q", fields[2])
+		}
+		sampleTime = time.UnixMilli(int64(ts * 1000))
+	}
+
+	id, labels := applyGraphiteTemplates(l.templates, fields[0])
+	m, err := types.NewMetric(id, types.GaugeType, types.OsSource)
+	if err != nil {
+		return types.Metrics{}, err
+	}
+	m.Set(value)
+	m.Labels = labels
+	m.SetTime(sampleTime)
+	err = m.CheckTime(now, l.Config.MaxSampleAge, l.Config.MaxSampleSkew)
+	if err != nil {
+		return types.Metrics{}, err
+	}
+	return *m, nil
+}
+
+// ParseGraphiteTemplates reads ';' separated "[filter ]template" entries.
+// Template nodes are label names, "measurement" adds the node to the ID,
+// "measurement*" adds all remaining nodes and an empty node skips one.
+func ParseGraphiteTemplates(s string) ([]graphiteTemplate, error) {
+	templates := []graphiteTemplate{}
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) < 1 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("template %q: want [filter ]template", entry)
+		}
+		t := graphiteTemplate{parts: strings.Split(fields[len(fields)-1], ".")}
+		if len(fields) == 2 {
+			t.filter = strings.Split(fields[0], ".")
+		}
+		for i, p := range t.parts {
+			switch {
+			case p == "", p == "measurement":
+			case p == "measurement*":
+				if i != len(t.parts)-1 {
+					return nil, fmt.Errorf("template %q: measurement* must be last", entry)
+				}
+			case !types.Labels{p: ""}.IsValid():
+				return nil, fmt.Errorf("template %q: bad label name %q", entry, p)
+			}
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func (t graphiteTemplate) match(nodes []string) bool {
+	if len(t.filter) > len(nodes) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != nodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyGraphiteTemplates uses the first matching template, the whole path is the ID otherwise.
+func applyGraphiteTemplates(templates []graphiteTemplate, path string) (string, types.Labels) {
+	nodes := strings.Split(path, ".")
+	for _, t := range templates {
+		if !t.match(nodes) {
+			continue
+		}
+		idNodes := []string{}
+		labels := types.Labels{}
+		for i, p := range t.parts {
+			if i >= len(nodes) {
+				break
+			}
+			switch p {
+			case "":
+			case "measurement":
+				idNodes = append(idNodes, nodes[i])
+			case "measurement*":
+				idNodes = append(idNodes, nodes[i:]...)
+			default:
+				labels[p] = nodes[i]
+			}
+		}
+		if len(idNodes) < 1 {
+			continue
+		}
+		if len(labels) < 1 {
+			labels = nil
+		}
+		return strings.Join(idNodes, "."), labels
+	}
+	return path, nil
+}
@@ -0,0 +1,295 @@
+package listeners
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/storages"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	sample, err := ParseStatsdLine("hits:3|c|@0.5|#env:prod,canary")
+	if err != nil {
+		t.Fatalf("ParseStatsdLine() = %v", err)
+	}
+	if sample.metric.GetDelta() != 6 {
+		t.Errorf("sampled counter = %d, want 6", sample.metric.GetDelta())
+	}
+	if sample.metric.Labels["env"] != "prod" || sample.metric.Labels["canary"] != "true" {
+		t.Errorf("labels = %v", sample.metric.Labels)
+	}
+
+	// one sampled timer line is 10 observations, added at once
+	sample, err = ParseStatsdLine("lat:20|ms|@0.1")
+	if err != nil {
+		t.Fatalf("ParseStatsdLine() = %v", err)
+	}
+	m := sample.metric
+	if m.GetDelta() != 10 || m.GetValue() != 200 || m.Counts[2] != 10 {
+		t.Errorf("sampled timer count=%d sum=%v counts=%v, want 10, 200 and 10 in the 25ms bucket", m.GetDelta(), m.GetValue(), m.Counts)
+	}
+
+	for _, tt := range []struct {
+		line       string
+		value      float64
+		isRelative bool
+	}{
+		{"q:3|g", 3, false},
+		{"q:+4|g", 4, true},
+		{"q:-2.5|g", -2.5, true},
+	} {
+		sample, err := ParseStatsdLine(tt.line)
+		if err != nil {
+			t.Fatalf("ParseStatsdLine(%q) = %v", tt.line, err)
+		}
+		isIncrement := sample.metric.Source == types.IncrementSource
+		if sample.metric.GetValue() != tt.value || sample.isRelative != tt.isRelative || isIncrement != tt.isRelative {
+			t.Errorf("ParseStatsdLine(%q) = %v relative %v, want %v relative %v", tt.line, sample.metric.GetValue(), sample.isRelative, tt.value, tt.isRelative)
+		}
+	}
+
+	for _, bad := range []string{
+		"hits",
+		":1|c",
+		"hits:1",
+		"hits:one|c",
+		"hits:1|x",
+		"hits:1|c|@0",
+		"hits:1|c|@1.5",
+		"hits:1|c|@soon",
+		// below statsdMinSampleRate
+		"lat:1|ms|@0.0009",
+		"lat:1|ms|@1e-9",
+	} {
+		if _, err := ParseStatsdLine(bad); err == nil {
+			t.Errorf("ParseStatsdLine(%q) accepted", bad)
+		}
+	}
+}
+
+func newTestStatsd(flushInterval time.Duration) *StatsdListener {
+	repo := &storages.MemStorage{}
+	repo.Init(context.Background())
+	return &StatsdListener{
+		Repo:           repo,
+		Config:         &configs.ServerConfig{StatsdFlushInterval: flushInterval},
+		pending:        make(map[string]*types.Metrics),
+		pendingClients: make(map[string]string),
+	}
+}
+
+func TestStatsdRelativeGauges(t *testing.T) {
+	ctx := context.Background()
+	l := newTestStatsd(0)
+	gauge := func() float64 {
+		m, err := l.Repo.Get("queue")
+		if err != nil {
+			t.Fatalf("Get(queue) = %v", err)
+		}
+		return m.GetValue()
+	}
+
+	// concurrent increments must not lose updates
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.handlePacket(ctx, "127.0.0.1", "queue:+1|g")
+			}
+		}()
+	}
+	wg.Wait()
+	if gauge() != 800 {
+		t.Fatalf("queue = %v, want 800", gauge())
+	}
+
+	// aggregated, an absolute value resets what is pending and later increments add to it
+	l = newTestStatsd(time.Hour)
+	l.handlePacket(ctx, "127.0.0.1", "queue:+3|g\nqueue:+4|g")
+	l.Flush(ctx)
+	if gauge() != 7 {
+		t.Errorf("queue = %v, want 7", gauge())
+	}
+	l.handlePacket(ctx, "127.0.0.1", "queue:+1|g\nqueue:5|g\nqueue:-2|g")
+	l.Flush(ctx)
+	if gauge() != 3 {
+		t.Errorf("queue = %v, want 3", gauge())
+	}
+	l.handlePacket(ctx, "127.0.0.1", "queue:+10|g")
+	l.Flush(ctx)
+	if gauge() != 13 {
+		t.Errorf("queue = %v, want 13", gauge())
+	}
+}
+
+func TestStatsdClientSeriesLimit(t *testing.T) {
+	ctx := context.Background()
+	for _, flushInterval := range []time.Duration{0, time.Hour} {
+		l := newTestStatsd(flushInterval)
+		limited, err := repositories.NewLimiting(l.Repo, repositories.SeriesLimits{MaxClientSeries: 1})
+		if err != nil {
+			t.Fatalf("NewLimiting() = %v", err)
+		}
+		l.Repo = limited
+
+		l.handlePacket(ctx, "10.0.0.1", "a:1|c\nb:1|c")
+		l.handlePacket(ctx, "10.0.0.2", "c:1|c")
+		l.Flush(ctx)
+		stored := map[string]bool{}
+		for _, m := range l.Repo.GetAll() {
+			stored[m.ID] = true
+		}
+		// the first client gets one series, the second its own
+		if len(stored) != 2 || !stored["c"] || stored["a"] == stored["b"] {
+			t.Errorf("flush interval %v: stored %v, want c and one of a and b", flushInterval, stored)
+		}
+	}
+}
+
+func TestGraphiteParseLine(t *testing.T) {
+	templates, err := ParseGraphiteTemplates("servers.* .host.measurement*; stats.* ..region.measurement")
+	if err != nil {
+		t.Fatalf("ParseGraphiteTemplates() = %v", err)
+	}
+	now := time.Unix(1000, 0)
+	l := &GraphiteListener{Config: &configs.ServerConfig{MaxSampleAge: time.Minute}, templates: templates}
+
+	for _, tt := range []struct {
+		line   string
+		id     string
+		labels types.Labels
+		time   time.Time
+	}{
+		{"servers.web1.cpu.load 0.5 990", "cpu.load", types.Labels{"host": "web1"}, time.Unix(990, 0)},
+		{"stats.api.eu.hits 3 990.5", "hits", types.Labels{"region": "eu"}, time.UnixMilli(990500)},
+		{"other.path 1 -1", "other.path", nil, now},
+		{"other.path 1", "other.path", nil, now},
+	} {
+		m, err := l.parseLine(tt.line, now)
+		if err != nil {
+			t.Fatalf("parseLine(%q) = %v", tt.line, err)
+		}
+		if m.ID != tt.id || m.Labels.String() != tt.labels.String() || !m.GetTime().Equal(tt.time) {
+			t.Errorf("parseLine(%q) = %v%v at %v, want %v%v at %v", tt.line, m.ID, m.Labels, m.GetTime(), tt.id, tt.labels, tt.time)
+		}
+	}
+
+	for _, bad := range []string{
+		"cpu",
+		"cpu 1 2 3",
+		"cpu one",
+		"cpu 1 soon",
+		// older than MaxSampleAge
+		"cpu 1 10",
+	} {
+		if _, err := l.parseLine(bad, now); err == nil {
+			t.Errorf("parseLine(%q) accepted", bad)
+		}
+	}
+
+	for _, bad := range []string{"a b c", "measurement*.host", "servers.* .ho-st"} {
+		if _, err := ParseGraphiteTemplates(bad); err == nil {
+			t.Errorf("ParseGraphiteTemplates(%q) accepted", bad)
+		}
+	}
+}
+
+// gatedRepo holds every write until gate is closed.
+type gatedRepo struct {
+	repositories.Repo
+	gate chan struct{}
+}
+
+func (r *gatedRepo) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	<-r.gate
+	return r.Repo.SetMany(ctx, metrics)
+}
+
+func startGraphite(t *testing.T, repo repositories.Repo, maxConns int) *GraphiteListener {
+	l := &GraphiteListener{
+		Repo:   repo,
+		Config: &configs.ServerConfig{GraphiteAddress: "127.0.0.1:0", GraphiteMaxConns: maxConns},
+	}
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	return l
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %v", what)
+}
+
+func TestGraphiteQueueBackpressure(t *testing.T) {
+	mem := &storages.MemStorage{}
+	mem.Init(context.Background())
+	repo := &gatedRepo{Repo: mem, gate: make(chan struct{})}
+	l := startGraphite(t, repo, 1)
+	defer l.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	lines := graphiteQueueSize * 2
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&sb, "m.%d %d\n", i, i)
+	}
+	go func() {
+		conn.Write([]byte(sb.String()))
+		conn.Close()
+	}()
+
+	// the reader waits on the full queue instead of dropping lines
+	waitFor(t, "a full queue", func() bool { return len(l.queue) == graphiteQueueSize })
+	close(repo.gate)
+	waitFor(t, "every line stored", func() bool { return len(mem.GetAll()) == lines })
+}
+
+func TestGraphiteConnectionSlots(t *testing.T) {
+	mem := &storages.MemStorage{}
+	mem.Init(context.Background())
+	l := startGraphite(t, mem, 1)
+	defer l.Stop(context.Background())
+	isStored := func(id string) bool {
+		_, err := mem.Get(id)
+		return err == nil
+	}
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	first.Write([]byte("first 1\n"))
+	waitFor(t, "the first line", func() bool { return isStored("first") })
+
+	// the second client waits in the backlog while the only slot is taken
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer second.Close()
+	second.Write([]byte("second 1\n"))
+	time.Sleep(100 * time.Millisecond)
+	if isStored("second") {
+		t.Fatalf("second connection served while the slot was taken")
+	}
+	first.Close()
+	waitFor(t, "the second line", func() bool { return isStored("second") })
+}
@@ -0,0 +1,296 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// StatsdTimerBuckets are histogram bounds in milliseconds for |ms and |h samples.
+var StatsdTimerBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const statsdMaxPacket = 64 * 1024
+
+// statsdMinSampleRate bounds the weight of one sampled line to 1000 samples.
+const statsdMinSampleRate = 0.001
+
+// StatsdListener reads StatsD lines from UDP and writes them to Repo, tagged with the sender host
+// for per-client series limits.
+// With Config.StatsdFlushInterval > 0 counters are summed, gauges keep the last
+// value and timers fill a histogram until the next flush; with 0 every sample is written at once.
+type StatsdListener struct {
+	Repo    repositories.Repo
+	Config  *configs.ServerConfig
+	conn    net.PacketConn
+	mu      sync.Mutex
+	pending map[string]*types.Metrics
+	// pendingClients is the sender of the first pending sample of each series
+	pendingClients map[string]string
+	wg             sync.WaitGroup
+	done           chan struct{}
+}
+
+// statsdSample is one parsed line, relative gauges (+N/-N) carry types.IncrementSource
+// and are added to the stored value by the storage merge.
+type statsdSample struct {
+	metric     types.Metrics
+	isRelative bool
+}
+
+func (l *StatsdListener) Start(mainCtx context.Context) error {
+	conn, err := net.ListenPacket("udp", l.Config.StatsdAddress)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("StatsdListener.Start(): fail: %w", err))
+	}
+	l.conn = conn
+	l.pending = make(map[string]*types.Metrics)
+	l.pendingClients = make(map[string]string)
+	l.done = make(chan struct{})
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		l.readLoop(mainCtx)
+	}()
+
+	if l.Config.StatsdFlushInterval > 0 {
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			flushTicker := time.NewTicker(l.Config.StatsdFlushInterval)
+			defer flushTicker.Stop()
+			for {
+				select {
+				case <-flushTicker.C:
+					l.Flush(mainCtx)
+				case <-mainCtx.Done():
+					return
+				case <-l.done:
+					return
+				}
+			}
+		}()
+	}
+	log.Println(types.NewTimeError(fmt.Errorf("StatsdListener: listen udp %v", conn.LocalAddr())))
+	return nil
+}
+
+func (l *StatsdListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Stop closes the socket and flushes what was aggregated so far.
+func (l *StatsdListener) Stop(mainCtx context.Context) {
+	if l.conn == nil {
+		return
+	}
+	close(l.done)
+	l.conn.Close()
+	l.wg.Wait()
+	l.Flush(mainCtx)
+}
+
+func (l *StatsdListener) readLoop(mainCtx context.Context) {
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if mainCtx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Println(types.NewTimeError(fmt.Errorf("StatsdListener.readLoop(): fail: %w", err)))
+				continue
+			}
+			return
+		}
+		l.handlePacket(mainCtx, clientHost(addr), string(buf[:n]))
+	}
+}
+
+// clientHost is the host part of addr, the client of repositories.WithClient.
+func clientHost(addr net.Addr) string {
+	client, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return client
+}
+
+func (l *StatsdListener) handlePacket(mainCtx context.Context, client string, packet string) {
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 1 {
+			continue
+		}
+		sample, err := ParseStatsdLine(line)
+		if err != nil {
+			log.Println(types.NewTimeError(fmt.Errorf("StatsdListener: skip %q: %w", line, err)))
+			continue
+		}
+		if l.Config.StatsdFlushInterval > 0 {
+			l.aggregate(client, sample)
+			continue
+		}
+		err = l.write(repositories.WithClient(mainCtx, client), sample)
+		if err != nil {
+			log.Println(types.NewTimeError(fmt.Errorf("StatsdListener: skip %q: %w", line, err)))
+			continue
+		}
+		l.Repo.FlushDB(mainCtx)
+	}
+}
+
+func (l *StatsdListener) write(ctx context.Context, sample statsdSample) error {
+	return l.Repo.SetMany(ctx, []types.Metrics{sample.metric})
+}
+
+func (l *StatsdListener) aggregate(client string, sample statsdSample) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := sample.metric.Key()
+	p, ok := l.pending[key]
+	if !ok {
+		m := sample.metric.GetMetric()
+		l.pending[key] = &m
+		l.pendingClients[key] = client
+		return
+	}
+	err := p.SetMetric(sample.metric)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("StatsdListener.aggregate(): skip %v: %w", key, err)))
+		return
+	}
+	if !sample.isRelative {
+		// an absolute gauge makes the pending value absolute too
+		p.Source = sample.metric.Source
+	}
+}
+
+// Flush writes aggregated samples as one batch per client.
+func (l *StatsdListener) Flush(mainCtx context.Context) {
+	l.mu.Lock()
+	batches := make(map[string][]types.Metrics)
+	for key, m := range l.pending {
+		client := l.pendingClients[key]
+		batches[client] = append(batches[client], *m)
+	}
+	l.pending = make(map[string]*types.Metrics)
+	l.pendingClients = make(map[string]string)
+	l.mu.Unlock()
+
+	if len(batches) < 1 {
+		return
+	}
+	for client, batch := range batches {
+		ctx := repositories.WithClient(mainCtx, client)
+		err := l.Repo.SetMany(ctx, batch)
+		if err == nil {
+			continue
+		}
+		// one bad series must not drop the whole interval
+		log.Println(types.NewTimeError(fmt.Errorf("StatsdListener.Flush(): batch fail, retry one by one: %w", err)))
+		for _, m := range batch {
+			if err := l.Repo.SetMany(ctx, []types.Metrics{m}); err != nil {
+				log.Println(types.NewTimeError(fmt.Errorf("StatsdListener.Flush(): skip %v: %w", m.Key(), err)))
+			}
+		}
+	}
+	l.Repo.FlushDB(mainCtx)
+}
+
+// ParseStatsdLine parses name:value|type[|@rate][|#tag:value,...].
+func ParseStatsdLine(line string) (statsdSample, error) {
+	sample := statsdSample{}
+	name, rest, found := strings.Cut(line, ":")
+	if !found || len(name) < 1 {
+		return sample, fmt.Errorf("no name")
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return sample, fmt.Errorf("no type")
+	}
+	valueStr, typeStr := parts[0], parts[1]
+
+	rate := 1.0
+	var labels types.Labels
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			r, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || r < statsdMinSampleRate || r > 1 {
+				return sample, fmt.Errorf("bad sample rate %q", p)
+			}
+			rate = r
+		case strings.HasPrefix(p, "#"):
+			labels = statsdTags(p[1:])
+		}
+	}
+
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return sample, fmt.Errorf("bad value %q", valueStr)
+	}
+
+	var m *types.Metrics
+	switch typeStr {
+	case "c":
+		m, err = types.NewMetric(name, types.CounterType, types.IncrementSource)
+		if err == nil {
+			err = m.Set(int64(math.Round(value / rate)))
+		}
+	case "g":
+		source := types.OsSource
+		sample.isRelative = strings.HasPrefix(valueStr, "+") || strings.HasPrefix(valueStr, "-")
+		if sample.isRelative {
+			source = types.IncrementSource
+		}
+		m, err = types.NewMetric(name, types.GaugeType, source)
+		if err == nil {
+			err = m.Set(value)
+		}
+	case "ms", "h":
+		m, err = types.NewHistogram(name, StatsdTimerBuckets, types.OsSource)
+		if err == nil {
+			// a sampled timer stands for 1/rate observations
+			err = m.ObserveN(value, int64(math.Round(1/rate)))
+		}
+	default:
+		return sample, fmt.Errorf("unsupported type %q", typeStr)
+	}
+	if err != nil {
+		return sample, err
+	}
+	m.Labels = labels
+	m.SetTime(time.Now())
+	sample.metric = *m
+	return sample, nil
+}
+
+// statsdTags reads DogStatsD tags, bare tags become name="true".
+func statsdTags(s string) types.Labels {
+	labels := types.Labels{}
+	for _, tag := range strings.Split(s, ",") {
+		k, v, found := strings.Cut(tag, ":")
+		if !found {
+			v = "true"
+		}
+		k = types.LabelName(k)
+		if len(k) > 0 {
+			labels[k] = v
+		}
+	}
+	if len(labels) < 1 {
+		return nil
+	}
+	return labels
+}
@@ -0,0 +1,165 @@
+package repositories
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// SlowPolicy decides what happens to a subscriber whose buffer is full.
+type SlowPolicy string
+
+const (
+	// SlowDrop loses the update, Dropped counts them.
+	SlowDrop SlowPolicy = "drop"
+	// SlowDisconnect stops delivery and closes Overflow, the subscriber should go away.
+	SlowDisconnect SlowPolicy = "disconnect"
+)
+
+// Broker fans out stored metric values to subscribers.
+// Publish never blocks, so a stuck subscriber cannot hold up writers.
+type Broker struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	// isClosed makes new subscriptions start closed, see Close
+	isClosed bool
+}
+
+type Subscription struct {
+	C            <-chan types.Metrics
+	Overflow     <-chan struct{}
+	c            chan types.Metrics
+	overflow     chan struct{}
+	overflowOnce sync.Once
+	filter       Filter
+	policy       SlowPolicy
+	dropped      uint64
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription buffering up to size updates matching filter.
+func (b *Broker) Subscribe(filter Filter, size int, policy SlowPolicy) *Subscription {
+	if size < 1 {
+		size = 1
+	}
+	c := make(chan types.Metrics, size)
+	overflow := make(chan struct{})
+	sub := &Subscription{C: c, c: c, Overflow: overflow, overflow: overflow, filter: filter, policy: policy}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.isClosed {
+		close(c)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe stops delivery and closes sub.C.
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	close(sub.c)
+}
+
+// Close ends every subscription and the ones made later, so streaming handlers return on shutdown.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.isClosed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Subscribers is the number of subscriptions still receiving updates.
+func (b *Broker) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+func (b *Broker) Publish(metrics ...types.Metrics) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		for _, m := range metrics {
+			if !sub.filter.Match(m) {
+				continue
+			}
+			select {
+			case sub.c <- m:
+			default:
+				atomic.AddUint64(&sub.dropped, 1)
+				if sub.policy == SlowDisconnect {
+					sub.overflowOnce.Do(func() { close(sub.overflow) })
+				}
+			}
+		}
+	}
+}
+
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// publishingRepo publishes the stored value of every series written through it.
+type publishingRepo struct {
+	Repo
+	broker *Broker
+}
+
+// NewPublishing wraps repo so successful writes reach broker subscribers.
+func NewPublishing(repo Repo, broker *Broker) Repo {
+	return &publishingRepo{Repo: repo, broker: broker}
+}
+
+func (r *publishingRepo) Unwrap() Repo {
+	return r.Repo
+}
+
+func (r *publishingRepo) Set(m types.Metrics) error {
+	err := r.Repo.Set(m)
+	if err != nil {
+		return err
+	}
+	r.publish([]types.Metrics{m})
+	return nil
+}
+
+func (r *publishingRepo) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	err := r.Repo.SetMany(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	r.publish(metrics)
+	return nil
+}
+
+func (r *publishingRepo) publish(metrics []types.Metrics) {
+	seen := make(map[string]struct{}, len(metrics))
+	stored := make([]types.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		k := m.Key()
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		cur, err := r.Repo.Get(k)
+		if err != nil {
+			continue
+		}
+		stored = append(stored, cur)
+	}
+	r.broker.Publish(stored...)
+}
@@ -0,0 +1,122 @@
+package repositories
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// CumulativePoint is the last cumulative value a client sent for a series.
+type CumulativePoint struct {
+	// Start is when the client started counting in unix nanoseconds, 0 when the protocol has none
+	Start  uint64
+	Metric types.Metrics
+}
+
+// cumulativeRepo remembers the last cumulative point per series, so receivers of cumulative
+// counters (OTLP, Influx) turn them into deltas against what the client sent, not the stored total.
+type cumulativeRepo struct {
+	Repo
+	// mu is held by a CumulativeTx from reading the points to saving them
+	mu     sync.Mutex
+	points map[string]CumulativePoint
+}
+
+// NewCumulative wraps repo to keep cumulative points, deleted series forget theirs.
+func NewCumulative(repo Repo) Repo {
+	return &cumulativeRepo{Repo: repo, points: make(map[string]CumulativePoint)}
+}
+
+func (r *cumulativeRepo) Unwrap() Repo {
+	return r.Repo
+}
+
+func (r *cumulativeRepo) Delete(ctx context.Context, keys []string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deleted, err := r.Repo.Delete(ctx, keys)
+	for _, k := range keys {
+		if _, getErr := r.Repo.Get(k); getErr != nil {
+			delete(r.points, k)
+		}
+	}
+	return deleted, err
+}
+
+// CumulativeTx reads and saves the points of one write, other writers and deletes wait for it.
+type CumulativeTx struct {
+	repo   *cumulativeRepo
+	saved  map[string]CumulativePoint
+	isDone bool
+}
+
+// BeginCumulative starts a tx on the points of repo or of the storage it decorates.
+// Without NewCumulative in the chain no point is known and Commit keeps nothing.
+func BeginCumulative(repo Repo) *CumulativeTx {
+	tx := &CumulativeTx{saved: make(map[string]CumulativePoint)}
+	for repo != nil {
+		if c, ok := repo.(*cumulativeRepo); ok {
+			c.mu.Lock()
+			tx.repo = c
+			break
+		}
+		wrapped, ok := repo.(Unwrapper)
+		if !ok {
+			break
+		}
+		repo = wrapped.Unwrap()
+	}
+	return tx
+}
+
+// Last returns the point saved earlier in tx or by a committed write.
+func (tx *CumulativeTx) Last(key string) (CumulativePoint, bool) {
+	if p, ok := tx.saved[key]; ok {
+		return p, true
+	}
+	if tx.repo == nil {
+		return CumulativePoint{}, false
+	}
+	p, ok := tx.repo.points[key]
+	return p, ok
+}
+
+// Save records p as the last point of key once tx commits.
+func (tx *CumulativeTx) Save(key string, p CumulativePoint) {
+	tx.saved[key] = p
+}
+
+// Forget drops the point saved in tx for key, e.g. when its write was rejected.
+func (tx *CumulativeTx) Forget(key string) {
+	delete(tx.saved, key)
+}
+
+// Commit keeps the saved points and ends tx.
+func (tx *CumulativeTx) Commit() {
+	if tx.isDone {
+		return
+	}
+	if tx.repo != nil {
+		for key, p := range tx.saved {
+			tx.repo.points[key] = p
+		}
+	}
+	tx.end()
+}
+
+// Rollback ends tx without keeping the saved points, it does nothing after Commit.
+func (tx *CumulativeTx) Rollback() {
+	if tx.isDone {
+		return
+	}
+	tx.end()
+}
+
+func (tx *CumulativeTx) end() {
+	tx.isDone = true
+	if tx.repo != nil {
+		tx.repo.mu.Unlock()
+	}
+}
@@ -0,0 +1,260 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+var (
+	// ErrSeriesLimit is returned for a new series over the global or per-client limit.
+	ErrSeriesLimit = errors.New("series limit exceeded")
+	// ErrSeriesNotAllowed is returned for a new series whose ID matches no allowlist pattern.
+	ErrSeriesNotAllowed = errors.New("series ID not allowed")
+)
+
+// Reasons a write is rejected, as reported by SeriesStats.
+const (
+	RejectMaxSeries       = "max_series"
+	RejectMaxClientSeries = "max_client_series"
+	RejectNotAllowed      = "not_allowed"
+)
+
+// SeriesLimits bound the number of distinct series, zero values disable a limit.
+type SeriesLimits struct {
+	MaxSeries       int
+	MaxClientSeries int
+	// Allow are ID globs for path.Match, empty allows every ID
+	Allow []string
+}
+
+// SeriesLimitError tells why a new series was refused.
+type SeriesLimitError struct {
+	Key    string
+	Client string
+	Reason string
+	Limit  int
+	Err    error
+}
+
+func (e *SeriesLimitError) Error() string {
+	switch e.Reason {
+	case RejectMaxSeries:
+		return fmt.Sprintf("series %v: %v: %d series stored", e.Key, e.Err, e.Limit)
+	case RejectMaxClientSeries:
+		return fmt.Sprintf("series %v: %v: client %v created %d series", e.Key, e.Err, e.Client, e.Limit)
+	}
+	return fmt.Sprintf("series %v: %v", e.Key, e.Err)
+}
+
+func (e *SeriesLimitError) Unwrap() error {
+	return e.Err
+}
+
+// SeriesStats is a snapshot of the limiter counters.
+type SeriesStats struct {
+	Series   int
+	Rejected map[string]uint64
+}
+
+// SeriesLimited is implemented by repos enforcing SeriesLimits.
+type SeriesLimited interface {
+	SeriesStats() SeriesStats
+}
+
+type clientKey struct{}
+
+// WithClient tags ctx with the client writing through it, used for per-client limits.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientOf returns the client set by WithClient, "" when unknown.
+func ClientOf(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// limitingRepo refuses new series over the limits, updates of known series always pass.
+type limitingRepo struct {
+	Repo
+	limits SeriesLimits
+	// mu is held across the write, so two clients cannot both take the last free slot
+	mu sync.Mutex
+	// owners maps every known series to the client that created it, "" for restored ones
+	owners   map[string]string
+	clients  map[string]int
+	rejected map[string]uint64
+}
+
+// NewLimiting wraps repo so new series are checked against limits, series already in repo are counted.
+func NewLimiting(repo Repo, limits SeriesLimits) (Repo, error) {
+	for _, pattern := range limits.Allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("allowlist pattern %q: %w", pattern, err)
+		}
+	}
+	r := &limitingRepo{
+		Repo:     repo,
+		limits:   limits,
+		owners:   make(map[string]string),
+		clients:  make(map[string]int),
+		rejected: map[string]uint64{RejectMaxSeries: 0, RejectMaxClientSeries: 0, RejectNotAllowed: 0},
+	}
+	for _, m := range repo.GetAll() {
+		r.owners[m.Key()] = ""
+	}
+	return r, nil
+}
+
+func (r *limitingRepo) Unwrap() Repo {
+	return r.Repo
+}
+
+func (r *limitingRepo) Set(m types.Metrics) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	newKeys, err := r.admit([]types.Metrics{m}, "")
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("limitingRepo.Set(): fail: %w", err))
+	}
+	err = r.Repo.Set(m)
+	if err != nil {
+		return err
+	}
+	r.commit(newKeys, "")
+	return nil
+}
+
+func (r *limitingRepo) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client := ClientOf(ctx)
+	newKeys, err := r.admit(metrics, client)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("limitingRepo.SetMany(): %w", err))
+	}
+	err = r.Repo.SetMany(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	r.commit(newKeys, client)
+	return nil
+}
+
+func (r *limitingRepo) Delete(ctx context.Context, keys []string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deleted, err := r.Repo.Delete(ctx, keys)
+	for _, k := range keys {
+		client, ok := r.owners[k]
+		if !ok {
+			continue
+		}
+		if _, getErr := r.Repo.Get(k); getErr == nil {
+			continue
+		}
+		delete(r.owners, k)
+		if len(client) > 0 {
+			r.clients[client]--
+			if r.clients[client] <= 0 {
+				delete(r.clients, client)
+			}
+		}
+	}
+	return deleted, err
+}
+
+func (r *limitingRepo) SeriesStats() SeriesStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := SeriesStats{Series: len(r.owners), Rejected: make(map[string]uint64, len(r.rejected))}
+	for reason, n := range r.rejected {
+		stats.Rejected[reason] = n
+	}
+	return stats
+}
+
+// admit returns the keys metrics would create, or an *ItemError for the first one over a limit, caller holds mu.
+func (r *limitingRepo) admit(metrics []types.Metrics, client string) ([]string, error) {
+	newKeys := []string{}
+	isNew := make(map[string]struct{})
+	for i, m := range metrics {
+		k := m.Key()
+		if _, ok := isNew[k]; ok {
+			continue
+		}
+		if _, ok := r.owners[k]; ok {
+			continue
+		}
+		if _, err := r.Repo.Get(k); err == nil {
+			// created behind the limiter, e.g. merged from the DB
+			r.owners[k] = ""
+			continue
+		}
+		limitErr := r.check(m.ID, k, client, len(newKeys))
+		if limitErr != nil {
+			r.rejected[limitErr.Reason]++
+			return nil, &ItemError{Index: i, Key: k, Err: limitErr}
+		}
+		isNew[k] = struct{}{}
+		newKeys = append(newKeys, k)
+	}
+	return newKeys, nil
+}
+
+// check tests one new series given pending new series earlier in the same batch.
+func (r *limitingRepo) check(id string, k string, client string, pending int) *SeriesLimitError {
+	if len(r.limits.Allow) > 0 {
+		isAllowed := false
+		for _, pattern := range r.limits.Allow {
+			if ok, _ := path.Match(pattern, id); ok {
+				isAllowed = true
+				break
+			}
+		}
+		if !isAllowed {
+			return &SeriesLimitError{Key: k, Client: client, Reason: RejectNotAllowed, Err: ErrSeriesNotAllowed}
+		}
+	}
+	if r.limits.MaxSeries > 0 && len(r.owners)+pending >= r.limits.MaxSeries {
+		return &SeriesLimitError{Key: k, Client: client, Reason: RejectMaxSeries, Limit: r.limits.MaxSeries, Err: ErrSeriesLimit}
+	}
+	if r.limits.MaxClientSeries > 0 && len(client) > 0 && r.clients[client]+pending >= r.limits.MaxClientSeries {
+		return &SeriesLimitError{Key: k, Client: client, Reason: RejectMaxClientSeries, Limit: r.limits.MaxClientSeries, Err: ErrSeriesLimit}
+	}
+	return nil
+}
+
+// commit records series created by a successful write, caller holds mu.
+func (r *limitingRepo) commit(newKeys []string, client string) {
+	for _, k := range newKeys {
+		r.owners[k] = client
+	}
+	if len(client) > 0 && len(newKeys) > 0 {
+		r.clients[client] += len(newKeys)
+	}
+}
+
+// SeriesStatsOf returns the limiter counters of repo or of the storage it decorates.
+func SeriesStatsOf(repo Repo) (SeriesStats, bool) {
+	for repo != nil {
+		if limited, ok := repo.(SeriesLimited); ok {
+			return limited.SeriesStats(), true
+		}
+		wrapped, ok := repo.(Unwrapper)
+		if !ok {
+			break
+		}
+		repo = wrapped.Unwrap()
+	}
+	return SeriesStats{}, false
+}
@@ -2,6 +2,8 @@ package repositories
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/aaarkadev/collectalertagent/internal/types"
 )
@@ -10,8 +12,142 @@ type Repo interface {
 	Set(v types.Metrics) error
 	Get(k string) (types.Metrics, error)
 	GetAll() []types.Metrics
+	// SetMany applies all metrics or none of them.
+	SetMany(ctx context.Context, metrics []types.Metrics) error
+	List(ctx context.Context, filter Filter) ([]types.Metrics, error)
+	// Delete removes the series with the given keys and returns how many existed.
+	Delete(ctx context.Context, keys []string) (int, error)
+	History(k string, from time.Time, to time.Time) ([]types.Point, error)
 	Init(context.Context) bool
 	Shutdown(context.Context)
 	FlushDB(context.Context)
 	Ping(context.Context) error
 }
+
+// StoredResponse is the response remembered for an Idempotency-Key.
+type StoredResponse struct {
+	RequestHash string `json:"request_hash" db:"RequestHash"`
+	Status      int    `json:"status" db:"Status"`
+	ContentType string `json:"content_type" db:"ContentType"`
+	Body        string `json:"body" db:"Body"`
+	// ExpiresAt is unix milliseconds
+	ExpiresAt int64 `json:"expires_at" db:"ExpiresAt"`
+}
+
+// IdempotencyStore is implemented by storages that persist responses next to the metrics.
+type IdempotencyStore interface {
+	LoadResponse(key string) (StoredResponse, bool)
+	SaveResponse(ctx context.Context, key string, resp StoredResponse)
+}
+
+// ItemError tells which metric of a SetMany batch failed.
+type ItemError struct {
+	Index int
+	Key   string
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item %d [%v] fail: %v", e.Index, e.Key, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// Tiered is implemented by storages that can degrade to a fallback tier at runtime.
+type Tiered interface {
+	Tier() string
+}
+
+// RepoV2 is the context-aware, error-returning view of a Repo.
+type RepoV2 interface {
+	SetMany(ctx context.Context, metrics []types.Metrics) error
+	Get(ctx context.Context, k string) (types.Metrics, error)
+	List(ctx context.Context, filter Filter) ([]types.Metrics, error)
+}
+
+// Filter selects series for List, empty fields match everything.
+type Filter struct {
+	MType  types.DataType
+	IDs    []string
+	Labels types.Labels
+}
+
+func (f Filter) Match(m types.Metrics) bool {
+	if len(f.MType) > 0 && types.DataType(m.MType) != f.MType {
+		return false
+	}
+	if len(f.IDs) > 0 {
+		found := false
+		for _, id := range f.IDs {
+			if m.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return m.Labels.Match(f.Labels)
+}
+
+type repoV2 struct {
+	repo Repo
+}
+
+// NewV2 adapts a Repo to RepoV2, old callers keep using the Repo itself.
+func NewV2(repo Repo) RepoV2 {
+	return repoV2{repo: repo}
+}
+
+func (r repoV2) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	return r.repo.SetMany(ctx, metrics)
+}
+
+func (r repoV2) Get(ctx context.Context, k string) (types.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return types.Metrics{}, err
+	}
+	return r.repo.Get(k)
+}
+
+func (r repoV2) List(ctx context.Context, filter Filter) ([]types.Metrics, error) {
+	return r.repo.List(ctx, filter)
+}
+
+// Unwrapper is implemented by Repo decorators.
+type Unwrapper interface {
+	Unwrap() Repo
+}
+
+// IdempotencyOf returns the IdempotencyStore of repo or of the storage it decorates.
+func IdempotencyOf(repo Repo) (IdempotencyStore, bool) {
+	for repo != nil {
+		if store, ok := repo.(IdempotencyStore); ok {
+			return store, true
+		}
+		wrapped, ok := repo.(Unwrapper)
+		if !ok {
+			break
+		}
+		repo = wrapped.Unwrap()
+	}
+	return nil, false
+}
+
+// TierOf reports the storage tier of repo or of the storage it decorates.
+func TierOf(repo Repo) (string, bool) {
+	for repo != nil {
+		if tieredRepo, ok := repo.(Tiered); ok {
+			return tieredRepo.Tier(), true
+		}
+		wrapped, ok := repo.(Unwrapper)
+		if !ok {
+			break
+		}
+		repo = wrapped.Unwrap()
+	}
+	return "", false
+}
@@ -0,0 +1,85 @@
+package servers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// expiryMaxInterval caps how long an expired series may outlive its TTL.
+const expiryMaxInterval = time.Minute
+
+// StartSeriesExpiry evicts series without updates for ttl from repo until mainCtx is done, ttl 0 disables it.
+func StartSeriesExpiry(mainCtx context.Context, repo repositories.Repo, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	interval := ttl / 2
+	if interval > expiryMaxInterval {
+		interval = expiryMaxInterval
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	go func() {
+		// series stored without a timestamp age from the first time they are seen here
+		unstampedSince := make(map[string]time.Time)
+		expiryTicker := time.NewTicker(interval)
+		defer expiryTicker.Stop()
+		for {
+			select {
+			case <-expiryTicker.C:
+				expireSeries(mainCtx, repo, ttl, unstampedSince)
+			case <-mainCtx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func expireSeries(mainCtx context.Context, repo repositories.Repo, ttl time.Duration, unstampedSince map[string]time.Time) {
+	now := time.Now()
+	deadline := now.Add(-ttl)
+	expired := []string{}
+	seen := make(map[string]struct{})
+	for _, m := range repo.GetAll() {
+		k := m.Key()
+		updatedAt := m.GetTime()
+		if updatedAt.IsZero() {
+			seen[k] = struct{}{}
+			since, ok := unstampedSince[k]
+			if !ok {
+				unstampedSince[k] = now
+				continue
+			}
+			updatedAt = since
+		}
+		if updatedAt.Before(deadline) {
+			expired = append(expired, k)
+		}
+	}
+	for k := range unstampedSince {
+		if _, ok := seen[k]; !ok {
+			delete(unstampedSince, k)
+		}
+	}
+	if len(expired) < 1 {
+		return
+	}
+
+	deleted, err := repo.Delete(mainCtx, expired)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("servers.expireSeries(): fail: %w", err)))
+		return
+	}
+	for _, k := range expired {
+		delete(unstampedSince, k)
+	}
+	repo.FlushDB(mainCtx)
+	log.Println(types.NewTimeError(fmt.Errorf("servers.expireSeries(): %d series without updates for %v evicted", deleted, ttl)))
+}
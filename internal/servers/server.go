@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 
@@ -13,7 +14,9 @@ import (
 	"os/user"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/aaarkadev/collectalertagent/internal/alerts"
 	"github.com/aaarkadev/collectalertagent/internal/configs"
 	"github.com/aaarkadev/collectalertagent/internal/repositories"
 	"github.com/aaarkadev/collectalertagent/internal/storages"
@@ -22,6 +25,9 @@ import (
 
 type ServerHandlerData struct {
 	Repo            repositories.Repo
+	Broker          *repositories.Broker
+	Alerts          *alerts.Engine
+	Notifications   *alerts.Dispatcher
 	Config          configs.ServerConfig
 	IsHeadersWriten bool
 	Writer          gzip.Writer
@@ -71,6 +77,13 @@ func (w *ServerHandlerData) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush lets streaming handlers push uncompressed responses through the gzip wrapper.
+func (w *ServerHandlerData) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func UnGzipMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -112,6 +125,17 @@ func GzipMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// ClientMiddleware tags the request context with the client address for per-client series limits.
+func ClientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		next.ServeHTTP(w, r.WithContext(repositories.WithClient(r.Context(), client)))
+	})
+}
+
 var logFile *os.File
 
 func SetupLog() {
@@ -136,7 +160,13 @@ func StopServer(mainCtx context.Context, repo repositories.Repo) {
 
 func Init(mainCtx context.Context, config *configs.ServerConfig) (repositories.Repo, ServerHandlerData) {
 	var repo repositories.Repo
-	repo = &storages.DBStorage{Config: config}
+	if storages.IsSQLiteDSN(config.DSN) {
+		repo = &storages.SQLiteStorage{DBStorage: storages.DBStorage{Config: config}}
+	} else if len(config.DSN) > 0 {
+		repo = &storages.TieredStorage{Config: config}
+	} else {
+		repo = &storages.DBStorage{Config: config}
+	}
 	isInitSuccess := repo.Init(mainCtx)
 	if !isInitSuccess {
 		log.Println(types.NewTimeError(fmt.Errorf("init DB repo failed. falback to file")))
@@ -147,14 +177,100 @@ func Init(mainCtx context.Context, config *configs.ServerConfig) (repositories.R
 		}
 	}
 
+	limits := repositories.SeriesLimits{MaxSeries: config.MaxSeries, MaxClientSeries: config.MaxClientSeries}
+	for _, pattern := range strings.Split(config.SeriesAllowlist, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) > 0 {
+			limits.Allow = append(limits.Allow, pattern)
+		}
+	}
+	limitedRepo, err := repositories.NewLimiting(repo, limits)
+	if err != nil {
+		log.Fatalln(types.NewTimeError(fmt.Errorf("server.Init(): fail: %w", err)))
+	}
+	repo = limitedRepo
+
+	broker := repositories.NewBroker()
+	repo = repositories.NewPublishing(repo, broker)
+	repo = repositories.NewCumulative(repo)
+	StartSeriesExpiry(mainCtx, repo, config.SeriesTTL)
+
 	serverData := ServerHandlerData{}
 	serverData.Repo = repo
+	serverData.Broker = broker
 	serverData.Config = *config
 
 	return repo, serverData
 }
 
-func StartServer(mainCtx context.Context, config configs.ServerConfig, router http.Handler) *http.Server {
+// LoadAlertRules reads the rules of -alert-rules and -alert-rules-file.
+func LoadAlertRules(config *configs.ServerConfig) ([]alerts.Rule, error) {
+	rules, err := alerts.ParseRules(config.AlertRules)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.AlertRulesFile) > 0 {
+		data, err := os.ReadFile(config.AlertRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		fileRules, err := alerts.ParseRules(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", config.AlertRulesFile, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	return rules, nil
+}
+
+// NewDispatcher builds the alert notification channels of config, nil when none is set.
+func NewDispatcher(config *configs.ServerConfig) *alerts.Dispatcher {
+	notifiers := []alerts.Notifier{}
+	if len(config.NotifyWebhookURL) > 0 {
+		notifiers = append(notifiers, &alerts.WebhookNotifier{URL: config.NotifyWebhookURL, HashKey: config.HashKey})
+	}
+	if len(config.NotifySMTPAddress) > 0 {
+		smtpNotifier := &alerts.SMTPNotifier{
+			Address:  config.NotifySMTPAddress,
+			From:     config.NotifySMTPFrom,
+			Username: config.NotifySMTPUser,
+			Password: config.NotifySMTPPassword,
+		}
+		for _, to := range strings.Split(config.NotifySMTPTo, ",") {
+			to = strings.TrimSpace(to)
+			if len(to) > 0 {
+				smtpNotifier.To = append(smtpNotifier.To, to)
+			}
+		}
+		notifiers = append(notifiers, smtpNotifier)
+	}
+	if len(notifiers) < 1 {
+		return nil
+	}
+	return &alerts.Dispatcher{
+		Notifiers:       notifiers,
+		SubjectTemplate: config.NotifySubject,
+		BodyTemplate:    config.NotifyBody,
+		Retries:         config.NotifyRetries,
+		RetryDelay:      time.Second,
+		RateLimit:       config.NotifyRateLimit,
+		RatePeriod:      time.Minute,
+	}
+}
+
+// Migrate applies DB schema migrations for -migrate-only mode.
+func Migrate(mainCtx context.Context, config *configs.ServerConfig) error {
+	if storages.IsSQLiteDSN(config.DSN) {
+		repo := &storages.SQLiteStorage{DBStorage: storages.DBStorage{Config: config}}
+		return repo.Migrate(mainCtx)
+	}
+	repo := &storages.DBStorage{Config: config}
+	return repo.Migrate(mainCtx)
+}
+
+// StartServer serves router until a signal, onShutdown funcs run when Shutdown starts,
+// e.g. to end long-lived streams that Shutdown would otherwise wait for.
+func StartServer(mainCtx context.Context, config configs.ServerConfig, router http.Handler, onShutdown ...func()) *http.Server {
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan,
@@ -164,6 +280,9 @@ func StartServer(mainCtx context.Context, config configs.ServerConfig, router ht
 		syscall.SIGQUIT)
 
 	server := &http.Server{Addr: config.ListenAddress, Handler: router}
+	for _, f := range onShutdown {
+		server.RegisterOnShutdown(f)
+	}
 
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
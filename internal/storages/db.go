@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aaarkadev/collectalertagent/internal/configs"
@@ -19,20 +20,32 @@ type DBStorage struct {
 	mem    MemStorage
 	Config *configs.ServerConfig
 	DBConn *sqlx.DB
+	// writeMu orders writes of memory and the DB, so a batch written to the DB outside mem.mu
+	// is not overtaken in memory by a later write or a store of the same series
+	writeMu sync.Mutex
+	// driverName, dataSource and migrationsDir default to Postgres from Config.DSN
+	driverName    string
+	dataSource    string
+	migrationsDir string
 }
 
 var _ repositories.Repo = (*DBStorage)(nil)
 
-const schemaSQL = `
-CREATE TABLE IF NOT EXISTS "metrics" (
-    "ID"	varchar(255) NOT NULL,
-    "MType" varchar(128) DEFAULT 'gauge' NOT NULL,
-    "Delta" bigint,
-    "Value" double precision,
-    "Hash" varchar(128) DEFAULT '' NOT NULL,
-    PRIMARY KEY ("ID")
-);
-CREATE INDEX IF NOT EXISTS "metrics_MType" ON  "metrics" USING btree ("MType");`
+// dbBatchSize rows per INSERT statement, keeps bind params well under the driver limit.
+const dbBatchSize = 500
+
+const upsertSQL = `INSERT INTO "metrics" ("ID", "MType", "Delta", "Value", "Buckets", "Counts", "Labels", "Timestamp", "Hash")
+VALUES (:ID, :MType, :Delta, :Value, :Buckets, :Counts, :Labels, :Timestamp, :Hash)
+ON CONFLICT ("ID", "Labels") DO UPDATE SET
+    "MType" = EXCLUDED."MType",
+    "Delta" = EXCLUDED."Delta",
+    "Value" = EXCLUDED."Value",
+    "Buckets" = EXCLUDED."Buckets",
+    "Counts" = EXCLUDED."Counts",
+    "Timestamp" = EXCLUDED."Timestamp",
+    "Hash" = EXCLUDED."Hash"`
+
+const deleteSQL = `DELETE FROM "metrics" WHERE "ID" = ? AND "Labels" = ?`
 
 func (repo *DBStorage) Init(mainCtx context.Context) bool {
 	repo.mem = MemStorage{}
@@ -42,44 +55,26 @@ func (repo *DBStorage) Init(mainCtx context.Context) bool {
 		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.Init(): empty Config. falback to file")))
 		return false
 	}
+	repo.mem.HistorySize = repo.Config.HistorySize
 	if len(repo.Config.DSN) <= 0 {
 		repo.Config.DSN = ""
 		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.Init(): empty Config.DSN falback to file")))
 		return false
 	}
-	conn, connErr := sql.Open("pgx", repo.Config.DSN)
-	if connErr != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.Init(): Cannot connect to DB. falback to file. fail: %w", connErr)))
-		repo.Config.DSN = ""
-		return false
-	}
-	connErr = conn.Ping()
-	if connErr != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.Init(): Cannot ping DB. falback to file. fail: %w", connErr)))
-		repo.Config.DSN = ""
-		return false
-	}
-	repo.DBConn = sqlx.NewDb(conn, "pgx")
-
-	ctx, cancel := context.WithTimeout(mainCtx, configs.GlobalDefaultTimeout)
-	defer cancel()
-	if !repo.Config.IsRestore {
-		repo.DBConn.ExecContext(ctx, `DROP TABLE IF EXISTS "metrics";`)
-	}
-	_, err := repo.DBConn.ExecContext(ctx, schemaSQL)
+	repo.setDefaults()
+	err := repo.open(mainCtx)
 	if err != nil {
-		fmt.Println("Cannot load DB shema. falback to file. ", err)
+		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.Init(): Cannot open DB. falback to file. fail: %w", err)))
 		repo.Config.DSN = ""
 		return false
 	}
-	_, err = repo.DBConn.ExecContext(ctx, `SELECT * FROM "metrics" LIMIT 1`)
-	if err != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.Init(): Cannot find DB table. falback to file. fail: %w", err)))
-		repo.Config.DSN = ""
-		return false
-
+	if err := repo.clearTables(mainCtx); err != nil {
+		log.Println(err)
 	}
 	repo.loadDB(mainCtx)
+	// rows just loaded are already in the table
+	repo.mem.TakeDirty()
+	repo.mem.TakeDeleted()
 
 	go func() {
 		if repo.Config.StoreInterval == 0 {
@@ -95,32 +90,122 @@ func (repo *DBStorage) Init(mainCtx context.Context) bool {
 	return true
 }
 
-func (repo *DBStorage) loadDB(mainCtx context.Context) {
-	if !repo.Config.IsRestore {
+func (repo *DBStorage) setDefaults() {
+	if len(repo.driverName) > 0 {
 		return
 	}
-	if len(repo.Config.DSN) <= 0 {
+	if IsSQLiteDSN(repo.Config.DSN) {
+		repo.setSQLite()
 		return
 	}
+	repo.driverName = "pgx"
+	repo.dataSource = repo.Config.DSN
+	repo.migrationsDir = "migrations/postgres"
+}
+
+func (repo *DBStorage) connect(mainCtx context.Context) error {
+	conn, err := sql.Open(repo.driverName, repo.dataSource)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(mainCtx, configs.GlobalDefaultTimeout)
+	defer cancel()
+	err = conn.PingContext(ctx)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	repo.DBConn = sqlx.NewDb(conn, repo.driverName)
+	return nil
+}
 
+// open connects and migrates the schema, it runs again when a DB lost at runtime comes back.
+func (repo *DBStorage) open(mainCtx context.Context) error {
+	err := repo.connect(mainCtx)
+	if err != nil {
+		return err
+	}
+	err = migrate(mainCtx, repo.DBConn, migrationsFS, repo.migrationsDir)
+	if err != nil {
+		repo.DBConn.Close()
+		repo.DBConn = nil
+		return err
+	}
+	return nil
+}
+
+// clearTables empties the tables when not restoring. It runs at start-up, or on the first connect
+// when the DB was down at start-up; a reconnect later must not wipe the rows stored before the outage.
+func (repo *DBStorage) clearTables(mainCtx context.Context) error {
+	if repo.Config.IsRestore {
+		return nil
+	}
+	return repo.truncateTables(mainCtx)
+}
+
+func (repo *DBStorage) truncateTables(mainCtx context.Context) error {
 	ctx, cancel := context.WithTimeout(mainCtx, configs.GlobalDefaultTimeout)
 	defer cancel()
+	for _, table := range []string{"metrics", "idempotency"} {
+		_, err := repo.DBConn.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s"`, table))
+		if err != nil {
+			return types.NewTimeError(fmt.Errorf("DBStorage.truncateTables(): table %v fail: %w", table, err))
+		}
+	}
+	return nil
+}
 
-	oldMetrics := []types.Metrics{}
-	err := repo.DBConn.SelectContext(ctx, &oldMetrics, `SELECT * FROM "metrics"`)
+// Migrate upgrades the DB schema without loading or serving metrics.
+func (repo *DBStorage) Migrate(mainCtx context.Context) error {
+	if repo.Config == nil || len(repo.Config.DSN) <= 0 {
+		return types.NewTimeError(fmt.Errorf("DBStorage.Migrate(): empty Config.DSN"))
+	}
+	repo.setDefaults()
+	err := repo.connect(mainCtx)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("DBStorage.Migrate(): fail: %w", err))
+	}
+	defer repo.DBConn.Close()
+	return migrate(mainCtx, repo.DBConn, migrationsFS, repo.migrationsDir)
+}
+
+func (repo *DBStorage) loadDB(mainCtx context.Context) {
+	if !repo.Config.IsRestore {
+		return
+	}
+	if len(repo.Config.DSN) <= 0 {
+		return
+	}
+
+	oldMetrics, err := repo.selectAll(mainCtx)
 	if err != nil {
 		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.loadDB(): empty table. fail: %w", err)))
 		return
 	}
 	for _, m := range oldMetrics {
-		m.ID = strings.Trim(m.ID, " 	")
-		m.MType = strings.Trim(m.MType, " 	")
-		m.Hash = strings.Trim(m.Hash, " 	")
 		err := repo.Set(m)
 		if err != nil {
 			log.Fatalln(types.NewTimeError(fmt.Errorf("DBStorage.loadDB(): fail: %w", err)))
 		}
 	}
+	repo.loadResponses(mainCtx)
+}
+
+func (repo *DBStorage) selectAll(mainCtx context.Context) ([]types.Metrics, error) {
+	ctx, cancel := context.WithTimeout(mainCtx, configs.GlobalDefaultTimeout)
+	defer cancel()
+
+	oldMetrics := []types.Metrics{}
+	err := repo.DBConn.SelectContext(ctx, &oldMetrics, `SELECT * FROM "metrics"`)
+	if err != nil {
+		return nil, err
+	}
+	for i := range oldMetrics {
+		oldMetrics[i].ID = strings.Trim(oldMetrics[i].ID, " 	")
+		oldMetrics[i].MType = strings.Trim(oldMetrics[i].MType, " 	")
+		oldMetrics[i].Hash = strings.Trim(oldMetrics[i].Hash, " 	")
+	}
+	return oldMetrics, nil
 }
 
 func (repo *DBStorage) Shutdown(mainCtx context.Context) {
@@ -134,11 +219,53 @@ func (repo *DBStorage) GetAll() []types.Metrics {
 	return repo.mem.GetAll()
 }
 
+func (repo *DBStorage) History(k string, from time.Time, to time.Time) ([]types.Point, error) {
+	return repo.mem.History(k, from, to)
+}
+
 func (repo *DBStorage) Get(k string) (types.Metrics, error) {
 	return repo.mem.Get(k)
 }
 
+// SetMany with no store interval commits the batch to the DB before memory, so the caller sees DB errors
+// and memory never keeps a batch the DB refused; otherwise the batch goes on the next store.
+// The upsert runs without holding memory locked, readers see the old values until it is done.
+func (repo *DBStorage) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	if len(repo.Config.DSN) <= 0 || repo.Config.StoreInterval != 0 {
+		return repo.mem.SetMany(ctx, metrics)
+	}
+
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+
+	staged, newKeys, err := repo.mem.stageMany(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	// the upsert replaces the whole row, so it also settles a pending delete of the series:
+	// committed series are neither dirty nor deleted and the next store does not write them again
+	err = repo.upsertMetrics(ctx, nil, stagedList(staged), nil)
+	if err != nil {
+		return err
+	}
+	repo.mem.commitStaged(staged, newKeys)
+	return nil
+}
+
+func (repo *DBStorage) List(ctx context.Context, filter repositories.Filter) ([]types.Metrics, error) {
+	return repo.mem.List(ctx, filter)
+}
+
+// Delete removes series from memory, their rows go on the next store.
+func (repo *DBStorage) Delete(ctx context.Context, keys []string) (int, error) {
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+	return repo.mem.Delete(ctx, keys)
+}
+
 func (repo *DBStorage) Set(mset types.Metrics) error {
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
 	return repo.mem.Set(mset)
 }
 
@@ -146,42 +273,95 @@ func (repo *DBStorage) StoreDBfunc(mainCtx context.Context) {
 	if len(repo.Config.DSN) <= 0 {
 		return
 	}
+	repo.writeMu.Lock()
+	defer repo.writeMu.Unlock()
+
+	deletedMetrics := repo.mem.TakeDeleted()
+	dirtyMetrics := repo.mem.TakeDirty()
+	dirtyResponses := repo.mem.TakeDirtyResponses()
+	if len(deletedMetrics) < 1 && len(dirtyMetrics) < 1 && len(dirtyResponses) < 1 {
+		return
+	}
+	err := repo.upsertMetrics(mainCtx, deletedMetrics, dirtyMetrics, dirtyResponses)
+	if err != nil {
+		repo.mem.MarkDeleted(deletedMetrics)
+		repo.mem.MarkDirty(dirtyMetrics)
+		repo.mem.MarkDirtyResponses(dirtyResponses)
+		log.Println(err)
+		return
+	}
+}
 
+// upsertMetrics drops deleted series, then writes changed series and idempotency responses in batches inside one transaction.
+// A series deleted and written again since the last store ends up with only its new row.
+func (repo *DBStorage) upsertMetrics(mainCtx context.Context, deleted []types.Metrics, metrics []types.Metrics, responses map[string]repositories.StoredResponse) error {
 	ctx, cancel := context.WithTimeout(mainCtx, configs.GlobalDefaultTimeout)
 	defer cancel()
 
-	var err error
 	dbTx, err := repo.DBConn.BeginTxx(ctx, nil)
 	if err != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.StoreDBfunc(): transaction begin fail: %w", err)))
-		return
+		return types.NewTimeError(fmt.Errorf("DBStorage.upsertMetrics(): transaction begin fail: %w", err))
 	}
+	defer dbTx.Rollback()
 
-	_, err = dbTx.ExecContext(ctx, `TRUNCATE TABLE "metrics"`)
-	if err != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.StoreDBfunc(): truncate table fail: %w", err)))
-		return
+	if len(deleted) > 0 {
+		deleteStmt, err := dbTx.PreparexContext(ctx, dbTx.Rebind(deleteSQL))
+		if err != nil {
+			return types.NewTimeError(fmt.Errorf("DBStorage.upsertMetrics(): delete prepare fail: %w", err))
+		}
+		defer deleteStmt.Close()
+		for _, m := range deleted {
+			_, err = deleteStmt.ExecContext(ctx, m.ID, m.Labels)
+			if err != nil {
+				return types.NewTimeError(fmt.Errorf("DBStorage.upsertMetrics(): delete fail: %w", err))
+			}
+		}
 	}
 
-	allMetrics := repo.GetAll()
-	if len(allMetrics) > 0 {
-		_, err = dbTx.NamedExecContext(ctx, `INSERT INTO "metrics" ("ID", "MType", "Delta", "Value", "Hash")
-                                                    VALUES (:ID, :MType, :Delta, :Value, :Hash)`, allMetrics)
+	for start := 0; start < len(metrics); start += dbBatchSize {
+		end := start + dbBatchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		_, err = dbTx.NamedExecContext(ctx, upsertSQL, metrics[start:end])
 		if err != nil {
-			log.Println(types.NewTimeError(fmt.Errorf("DBStorage.StoreDBfunc(): insert into table fail: %w", err)))
-			return
+			return types.NewTimeError(fmt.Errorf("DBStorage.upsertMetrics(): upsert fail: %w", err))
+		}
+	}
+
+	if len(responses) > 0 {
+		rows := make([]responseRow, 0, len(responses))
+		for k, r := range responses {
+			rows = append(rows, responseRow{Key: k, StoredResponse: r})
+		}
+		for start := 0; start < len(rows); start += dbBatchSize {
+			end := start + dbBatchSize
+			if end > len(rows) {
+				end = len(rows)
+			}
+			_, err = dbTx.NamedExecContext(ctx, upsertResponseSQL, rows[start:end])
+			if err != nil {
+				return types.NewTimeError(fmt.Errorf("DBStorage.upsertMetrics(): upsert responses fail: %w", err))
+			}
+		}
+		_, err = dbTx.ExecContext(ctx, dbTx.Rebind(`DELETE FROM "idempotency" WHERE "ExpiresAt" < ?`), time.Now().UnixMilli())
+		if err != nil {
+			return types.NewTimeError(fmt.Errorf("DBStorage.upsertMetrics(): expire responses fail: %w", err))
 		}
 	}
 
 	err = dbTx.Commit()
 	if err != nil {
-		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.StoreDBfunc(): transaction commit fail: %w", err)))
-		return
+		return types.NewTimeError(fmt.Errorf("DBStorage.upsertMetrics(): transaction commit fail: %w", err))
 	}
+	return nil
 }
 
 func (repo *DBStorage) FlushDB(mainCtx context.Context) {
-	repo.StoreDBfunc(mainCtx)
+	if repo.Config.StoreInterval == 0 {
+		repo.StoreDBfunc(mainCtx)
+		return
+	}
 }
 
 func (repo *DBStorage) Ping(mainCtx context.Context) error {
@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/aaarkadev/collectalertagent/internal/configs"
@@ -15,9 +17,14 @@ import (
 )
 
 type FileStorage struct {
-	mem       MemStorage
-	Config    *configs.ServerConfig
-	StoreFile *os.File
+	mem        MemStorage
+	Config     *configs.ServerConfig
+	StoreFile  *os.File
+	walFile    *os.File
+	walMu      sync.Mutex
+	walRecords int
+	// walLSN is the number of the last log record written or replayed
+	walLSN uint64
 }
 
 var _ repositories.Repo = (*FileStorage)(nil)
@@ -30,8 +37,16 @@ func (repo *FileStorage) Init(mainCtx context.Context) bool {
 		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.Init(): empty Config. falback to file")))
 		return false
 	}
+	repo.mem.HistorySize = repo.Config.HistorySize
 
-	if len(repo.Config.StoreFileName) > 0 {
+	if len(repo.Config.StoreFileName) > 0 && repo.Config.StoreWAL {
+		walErr := repo.openWAL()
+		if walErr != nil {
+			repo.Config.StoreFileName = ""
+			log.Println(types.NewTimeError(fmt.Errorf("FileStorage.Init(): open wal fail. falback to mem. fail: %w", walErr)))
+			return false
+		}
+	} else if len(repo.Config.StoreFileName) > 0 {
 		fmode := os.O_RDWR | os.O_CREATE
 		if !repo.Config.IsRestore {
 			fmode |= os.O_TRUNC
@@ -47,6 +62,7 @@ func (repo *FileStorage) Init(mainCtx context.Context) bool {
 	}
 
 	repo.loadDB(mainCtx)
+	repo.loadResponses()
 
 	go func() {
 		if repo.Config.StoreInterval == 0 {
@@ -79,16 +95,23 @@ func (repo *FileStorage) loadDB(mainCtx context.Context) {
 	if len(repo.Config.StoreFileName) <= 0 {
 		return
 	}
-	decoder := json.NewDecoder(repo.StoreFile)
-
-	oldMetrics := []types.Metrics{}
-
-	if err := decoder.Decode(&oldMetrics); err != nil {
+	if repo.Config.StoreWAL {
+		repo.loadWAL()
+		return
+	}
+	data, err := io.ReadAll(repo.StoreFile)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadDB(): fail: %w", err)))
+		return
+	}
+	// a snapshot left by the WAL mode reads as well
+	snapshot, err := decodeSnapshot(data)
+	if err != nil {
 		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadDB(): fail: %w", err)))
 		return
 	}
 
-	for _, m := range oldMetrics {
+	for _, m := range snapshot.Metrics {
 		err := repo.Set(m)
 		if err != nil {
 			log.Fatalln(types.NewTimeError(fmt.Errorf("FileStorage.loadDB(): fail: %w", err)))
@@ -98,7 +121,9 @@ func (repo *FileStorage) loadDB(mainCtx context.Context) {
 
 func (repo *FileStorage) Shutdown(mainCtx context.Context) {
 	repo.StoreDBfunc(mainCtx)
-	if len(repo.Config.StoreFileName) > 0 {
+	if len(repo.Config.StoreFileName) > 0 && repo.Config.StoreWAL {
+		defer repo.walFile.Close()
+	} else if len(repo.Config.StoreFileName) > 0 {
 		defer repo.StoreFile.Close()
 	}
 }
@@ -107,11 +132,39 @@ func (repo *FileStorage) GetAll() []types.Metrics {
 	return repo.mem.GetAll()
 }
 
+func (repo *FileStorage) History(k string, from time.Time, to time.Time) ([]types.Point, error) {
+	return repo.mem.History(k, from, to)
+}
+
 func (repo *FileStorage) Get(k string) (types.Metrics, error) {
 	return repo.mem.Get(k)
 }
 
+func (repo *FileStorage) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	if len(repo.Config.StoreFileName) > 0 && repo.Config.StoreWAL {
+		return repo.setManyWAL(ctx, metrics)
+	}
+	return repo.mem.SetMany(ctx, metrics)
+}
+
+func (repo *FileStorage) List(ctx context.Context, filter repositories.Filter) ([]types.Metrics, error) {
+	return repo.mem.List(ctx, filter)
+}
+
+// Delete removes series, the snapshot drops them on the next store and the log records tombstones.
+func (repo *FileStorage) Delete(ctx context.Context, keys []string) (int, error) {
+	// the JSON file is a full snapshot, it needs no per-row deletes
+	defer repo.mem.TakeDeleted()
+	if len(repo.Config.StoreFileName) > 0 && repo.Config.StoreWAL {
+		return repo.deleteWAL(ctx, keys)
+	}
+	return repo.mem.Delete(ctx, keys)
+}
+
 func (repo *FileStorage) Set(mset types.Metrics) error {
+	if len(repo.Config.StoreFileName) > 0 && repo.Config.StoreWAL {
+		return repo.setWAL(mset)
+	}
 	return repo.mem.Set(mset)
 }
 
@@ -119,6 +172,11 @@ func (repo *FileStorage) StoreDBfunc(mainCtx context.Context) {
 	if len(repo.Config.StoreFileName) <= 0 {
 		return
 	}
+	repo.storeResponses()
+	if repo.Config.StoreWAL {
+		repo.compactWAL()
+		return
+	}
 	err := repo.StoreFile.Truncate(0)
 	if err != nil {
 		return
@@ -144,6 +202,12 @@ func (repo *FileStorage) StoreDBfunc(mainCtx context.Context) {
 }
 
 func (repo *FileStorage) FlushDB(mainCtx context.Context) {
+	if repo.Config.StoreWAL {
+		if repo.Config.StoreInterval == 0 && repo.walRecordsCount() >= walCompactRecords {
+			repo.StoreDBfunc(mainCtx)
+		}
+		return
+	}
 	if repo.Config.StoreInterval == 0 {
 		repo.StoreDBfunc(mainCtx)
 		return
@@ -0,0 +1,57 @@
+package storages
+
+import (
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// historyRing keeps the last len(points) samples of one series.
+type historyRing struct {
+	points []types.Point
+	next   int
+	full   bool
+}
+
+func newHistoryRing(size int) *historyRing {
+	return &historyRing{points: make([]types.Point, size)}
+}
+
+// add appends p, keeping the ring chronological: a point older than the newest one is a late
+// sample and is dropped, a point at the same time replaces the newest one.
+func (h *historyRing) add(p types.Point) {
+	if h.next > 0 || h.full {
+		lastIdx := (h.next - 1 + len(h.points)) % len(h.points)
+		last := h.points[lastIdx]
+		if p.Timestamp < last.Timestamp {
+			return
+		}
+		if p.Timestamp == last.Timestamp {
+			h.points[lastIdx] = p
+			return
+		}
+	}
+	h.points[h.next] = p
+	h.next = (h.next + 1) % len(h.points)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// between returns points with from <= t <= to in chronological order.
+func (h *historyRing) between(from time.Time, to time.Time) []types.Point {
+	fromMs := from.UnixMilli()
+	toMs := to.UnixMilli()
+
+	ordered := h.points[:h.next]
+	if h.full {
+		ordered = append(append([]types.Point{}, h.points[h.next:]...), h.points[:h.next]...)
+	}
+	res := []types.Point{}
+	for _, p := range ordered {
+		if p.Timestamp >= fromMs && p.Timestamp <= toMs {
+			res = append(res, p)
+		}
+	}
+	return res
+}
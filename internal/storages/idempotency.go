@@ -0,0 +1,242 @@
+package storages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// responsesPurgeMin is the map size below which expired responses are not swept.
+const responsesPurgeMin = 1024
+
+const upsertResponseSQL = `INSERT INTO "idempotency" ("Key", "RequestHash", "Status", "ContentType", "Body", "ExpiresAt")
+VALUES (:Key, :RequestHash, :Status, :ContentType, :Body, :ExpiresAt)
+ON CONFLICT ("Key") DO UPDATE SET
+    "RequestHash" = EXCLUDED."RequestHash",
+    "Status" = EXCLUDED."Status",
+    "ContentType" = EXCLUDED."ContentType",
+    "Body" = EXCLUDED."Body",
+    "ExpiresAt" = EXCLUDED."ExpiresAt"`
+
+type responseRow struct {
+	Key string `db:"Key"`
+	repositories.StoredResponse
+}
+
+func isResponseExpired(resp repositories.StoredResponse, now time.Time) bool {
+	return resp.ExpiresAt < now.UnixMilli()
+}
+
+func (repo *MemStorage) LoadResponse(key string) (repositories.StoredResponse, bool) {
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+
+	resp, ok := repo.responses[key]
+	if !ok || isResponseExpired(resp, time.Now()) {
+		return repositories.StoredResponse{}, false
+	}
+	return resp, true
+}
+
+func (repo *MemStorage) SaveResponse(ctx context.Context, key string, resp repositories.StoredResponse) {
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+
+	repo.putResponse(key, resp)
+	repo.dirtyResponses[key] = struct{}{}
+}
+
+// putResponse stores resp without marking it dirty, caller holds respMu.
+func (repo *MemStorage) putResponse(key string, resp repositories.StoredResponse) {
+	if repo.responses == nil {
+		repo.responses = make(map[string]repositories.StoredResponse)
+		repo.dirtyResponses = make(map[string]struct{})
+	}
+	repo.responses[key] = resp
+	if len(repo.responses) < responsesPurgeMin || len(repo.responses) < repo.responsesPurgeAt {
+		return
+	}
+	now := time.Now()
+	for k, r := range repo.responses {
+		if isResponseExpired(r, now) {
+			delete(repo.responses, k)
+			delete(repo.dirtyResponses, k)
+		}
+	}
+	// sweep again once the live set doubles, keeps saves amortized O(1)
+	repo.responsesPurgeAt = 2 * len(repo.responses)
+}
+
+func (repo *MemStorage) putResponses(responses map[string]repositories.StoredResponse, isDirty bool) {
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+
+	now := time.Now()
+	for k, r := range responses {
+		if isResponseExpired(r, now) {
+			continue
+		}
+		repo.putResponse(k, r)
+		if isDirty {
+			repo.dirtyResponses[k] = struct{}{}
+		}
+	}
+}
+
+// TakeDirtyResponses returns responses saved since the last call and clears the set.
+func (repo *MemStorage) TakeDirtyResponses() map[string]repositories.StoredResponse {
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+
+	dirty := repo.dirtyResponsesLocked()
+	repo.dirtyResponses = make(map[string]struct{})
+	return dirty
+}
+
+func (repo *MemStorage) PeekDirtyResponses() map[string]repositories.StoredResponse {
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+
+	return repo.dirtyResponsesLocked()
+}
+
+func (repo *MemStorage) dirtyResponsesLocked() map[string]repositories.StoredResponse {
+	dirty := make(map[string]repositories.StoredResponse, len(repo.dirtyResponses))
+	for k := range repo.dirtyResponses {
+		if r, ok := repo.responses[k]; ok {
+			dirty[k] = r
+		}
+	}
+	return dirty
+}
+
+// MarkDirtyResponses puts back responses a failed store did not write.
+func (repo *MemStorage) MarkDirtyResponses(responses map[string]repositories.StoredResponse) {
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+
+	for k := range responses {
+		if _, ok := repo.responses[k]; ok {
+			repo.dirtyResponses[k] = struct{}{}
+		}
+	}
+}
+
+// Responses returns every response that has not expired.
+func (repo *MemStorage) Responses() map[string]repositories.StoredResponse {
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+
+	now := time.Now()
+	live := make(map[string]repositories.StoredResponse, len(repo.responses))
+	for k, r := range repo.responses {
+		if !isResponseExpired(r, now) {
+			live[k] = r
+		}
+	}
+	return live
+}
+
+func (repo *FileStorage) responsesFileName() string {
+	return repo.Config.StoreFileName + ".idem"
+}
+
+func (repo *FileStorage) loadResponses() {
+	if len(repo.Config.StoreFileName) <= 0 {
+		return
+	}
+	name := repo.responsesFileName()
+	if !repo.Config.IsRestore {
+		os.Remove(name)
+		return
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadResponses(): fail: %w", err)))
+		}
+		return
+	}
+	responses := map[string]repositories.StoredResponse{}
+	err = json.Unmarshal(data, &responses)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadResponses(): fail: %w", err)))
+		return
+	}
+	repo.mem.putResponses(responses, false)
+}
+
+func (repo *FileStorage) storeResponses() {
+	if len(repo.Config.StoreFileName) <= 0 {
+		return
+	}
+	dirtyResponses := repo.mem.TakeDirtyResponses()
+	if len(dirtyResponses) < 1 {
+		return
+	}
+	data, err := json.Marshal(repo.mem.Responses())
+	if err == nil {
+		err = writeFileAtomic(repo.responsesFileName(), data)
+	}
+	if err != nil {
+		repo.mem.MarkDirtyResponses(dirtyResponses)
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.storeResponses(): fail: %w", err)))
+	}
+}
+
+func (repo *FileStorage) LoadResponse(key string) (repositories.StoredResponse, bool) {
+	return repo.mem.LoadResponse(key)
+}
+
+func (repo *FileStorage) SaveResponse(ctx context.Context, key string, resp repositories.StoredResponse) {
+	repo.mem.SaveResponse(ctx, key, resp)
+	if repo.Config.StoreInterval == 0 {
+		repo.storeResponses()
+	}
+}
+
+func (repo *DBStorage) loadResponses(mainCtx context.Context) {
+	ctx, cancel := context.WithTimeout(mainCtx, configs.GlobalDefaultTimeout)
+	defer cancel()
+
+	rows := []responseRow{}
+	err := repo.DBConn.SelectContext(ctx, &rows, repo.DBConn.Rebind(`SELECT * FROM "idempotency" WHERE "ExpiresAt" >= ?`), time.Now().UnixMilli())
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("DBStorage.loadResponses(): fail: %w", err)))
+		return
+	}
+	responses := make(map[string]repositories.StoredResponse, len(rows))
+	for _, row := range rows {
+		responses[row.Key] = row.StoredResponse
+	}
+	repo.mem.putResponses(responses, false)
+}
+
+func (repo *DBStorage) LoadResponse(key string) (repositories.StoredResponse, bool) {
+	return repo.mem.LoadResponse(key)
+}
+
+func (repo *DBStorage) SaveResponse(ctx context.Context, key string, resp repositories.StoredResponse) {
+	repo.mem.SaveResponse(ctx, key, resp)
+	if repo.Config.StoreInterval == 0 {
+		repo.StoreDBfunc(ctx)
+	}
+}
+
+func (repo *TieredStorage) LoadResponse(key string) (repositories.StoredResponse, bool) {
+	return repo.db.mem.LoadResponse(key)
+}
+
+func (repo *TieredStorage) SaveResponse(ctx context.Context, key string, resp repositories.StoredResponse) {
+	repo.db.mem.SaveResponse(ctx, key, resp)
+	if repo.Config.StoreInterval == 0 {
+		repo.StoreDBfunc(ctx)
+	}
+}
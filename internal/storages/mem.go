@@ -4,20 +4,48 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/aaarkadev/collectalertagent/internal/repositories"
 	"github.com/aaarkadev/collectalertagent/internal/types"
 )
 
+// MemStorage indexes series by key, Set and Get are O(1) under one lock.
 type MemStorage struct {
-	metrics []types.Metrics
-	mu      sync.RWMutex
+	metrics map[string]*types.Metrics
+	// keys keeps insertion order for GetAll
+	keys []string
+	mu   sync.RWMutex
+	// HistorySize is the number of points kept per series, 0 disables history.
+	HistorySize int
+	history     map[string]*historyRing
+	// dirty holds keys changed since the last TakeDirty
+	dirty map[string]struct{}
+	// deleted holds series removed since the last TakeDeleted, DB storages drop their rows
+	deleted map[string]types.Metrics
+	// responses are kept for Idempotency-Key replays, see idempotency.go
+	respMu           sync.Mutex
+	responses        map[string]repositories.StoredResponse
+	dirtyResponses   map[string]struct{}
+	responsesPurgeAt int
 }
 
 var _ repositories.Repo = (*MemStorage)(nil)
 
 func (repo *MemStorage) Init(mainCtx context.Context) bool {
-	repo.metrics = make([]types.Metrics, 0)
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.metrics = make(map[string]*types.Metrics)
+	repo.keys = make([]string, 0)
+	repo.history = make(map[string]*historyRing)
+	repo.dirty = make(map[string]struct{})
+	repo.deleted = make(map[string]types.Metrics)
+
+	repo.respMu.Lock()
+	defer repo.respMu.Unlock()
+	repo.responses = make(map[string]repositories.StoredResponse)
+	repo.dirtyResponses = make(map[string]struct{})
 	return true
 }
 
@@ -25,57 +53,356 @@ func (repo *MemStorage) GetAll() []types.Metrics {
 	repo.mu.RLock()
 	defer repo.mu.RUnlock()
 
-	copyValsMetrics := []types.Metrics{}
-	for _, m := range repo.metrics {
-		copyValsMetrics = append(copyValsMetrics, m.GetMetric())
+	copyValsMetrics := make([]types.Metrics, 0, len(repo.keys))
+	for _, k := range repo.keys {
+		copyValsMetrics = append(copyValsMetrics, repo.metrics[k].GetMetric())
 	}
 	return copyValsMetrics
 }
 
 func (repo *MemStorage) Get(k string) (types.Metrics, error) {
-	allMetrics := repo.GetAll()
-	for _, v := range allMetrics {
-		if v.ID == k {
-			return v, nil
-		}
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	m, ok := repo.metrics[k]
+	if !ok {
+		return types.Metrics{}, fmt.Errorf("k[%v]: not found in storage", k)
 	}
-	return types.Metrics{}, fmt.Errorf("k[%v]: not found in storage", k)
+	return m.GetMetric(), nil
 }
 
 func (repo *MemStorage) Set(mset types.Metrics) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	err := repo.set(mset)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("MemStorage.Set(): fail: %w", err))
+	}
+	return nil
+}
+
+// set merges mset into its series, caller holds repo.mu.
+func (repo *MemStorage) set(mset types.Metrics) error {
+	key := mset.Key()
+	m, ok := repo.metrics[key]
+	if ok {
+		err := m.SetMetric(mset)
+		if err != nil {
+			return err
+		}
+	} else {
+		newMetricElement, err := newSeries(mset)
+		if err != nil {
+			return err
+		}
+		m = newMetricElement
+		repo.metrics[key] = m
+		repo.keys = append(repo.keys, key)
+	}
+
+	repo.addHistory(*m)
+	repo.dirty[key] = struct{}{}
+	return nil
+}
+
+func newSeries(mset types.Metrics) (*types.Metrics, error) {
+	newMetricElement, err := types.NewMetric(mset.ID, types.DataType(mset.MType), mset.Source)
+	if err != nil {
+		return nil, err
+	}
+	if !mset.Labels.IsValid() {
+		return nil, fmt.Errorf("labels[%v]: invalid", mset.Labels)
+	}
+	newMetricElement.Labels = mset.Labels.Copy()
+	err = newMetricElement.SetMetric(mset)
+	if err != nil {
+		return nil, err
+	}
+	return newMetricElement, nil
+}
 
-	_, err := repo.Get(mset.ID)
+// SetMany merges every metric into staged copies and commits only if all succeed.
+func (repo *MemStorage) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	return repo.setManyWith(ctx, metrics, nil)
+}
+
+// setManyWith is SetMany with a hook that gets the merged series before they are committed,
+// a hook error drops the batch, e.g. when the WAL append failed.
+func (repo *MemStorage) setManyWith(ctx context.Context, metrics []types.Metrics, beforeCommit func(staged []types.Metrics) error) error {
+	if err := ctx.Err(); err != nil {
+		return types.NewTimeError(fmt.Errorf("MemStorage.SetMany(): fail: %w", err))
+	}
 
-	allMetrics := repo.GetAll()
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
 
+	staged, newKeys, err := repo.stage(metrics)
 	if err != nil {
-		newMetricElement, errNew := types.NewMetric(mset.ID, types.DataType(mset.MType), mset.Source)
-		err = errNew
-		if err == nil {
-			err = newMetricElement.SetMetric(mset)
-			if err == nil {
-				allMetrics = append(allMetrics, *newMetricElement)
+		return err
+	}
+	if beforeCommit != nil {
+		if err := beforeCommit(stagedList(staged)); err != nil {
+			return err
+		}
+	}
+	repo.commit(staged, newKeys, true)
+	return nil
+}
+
+// stageMany merges metrics into copies of their series without changing repo, see commitStaged.
+func (repo *MemStorage) stageMany(ctx context.Context, metrics []types.Metrics) (map[string]*types.Metrics, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, types.NewTimeError(fmt.Errorf("MemStorage.SetMany(): fail: %w", err))
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	return repo.stage(metrics)
+}
+
+// commitStaged stores series staged by stageMany as already written, they are neither dirty nor pending
+// deletion any more. The caller keeps other writers out between the two calls.
+func (repo *MemStorage) commitStaged(staged map[string]*types.Metrics, newKeys []string) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.commit(staged, newKeys, false)
+	for key := range staged {
+		delete(repo.deleted, key)
+	}
+}
+
+// stage merges metrics into copies of their series and returns them with the keys of new series,
+// caller holds repo.mu.
+func (repo *MemStorage) stage(metrics []types.Metrics) (map[string]*types.Metrics, []string, error) {
+	staged := make(map[string]*types.Metrics)
+	newKeys := []string{}
+	for i, mset := range metrics {
+		key := mset.Key()
+		m, ok := staged[key]
+		if ok {
+			err := m.SetMetric(mset)
+			if err != nil {
+				return nil, nil, types.NewTimeError(fmt.Errorf("MemStorage.SetMany(): %w", &repositories.ItemError{Index: i, Key: key, Err: err}))
+			}
+			continue
+		}
+		if old, found := repo.metrics[key]; found {
+			copyM := old.GetMetric()
+			err := copyM.SetMetric(mset)
+			if err != nil {
+				return nil, nil, types.NewTimeError(fmt.Errorf("MemStorage.SetMany(): %w", &repositories.ItemError{Index: i, Key: key, Err: err}))
 			}
+			staged[key] = &copyM
+			continue
 		}
+		newMetricElement, err := newSeries(mset)
 		if err != nil {
-			err = types.NewTimeError(fmt.Errorf("MemStorage.Set(): fail: %w", err))
+			return nil, nil, types.NewTimeError(fmt.Errorf("MemStorage.SetMany(): %w", &repositories.ItemError{Index: i, Key: key, Err: err}))
 		}
-	} else {
-		for i, v := range allMetrics {
-			if v.ID == mset.ID {
-				err = allMetrics[i].SetMetric(mset)
-				if err != nil {
-					err = types.NewTimeError(fmt.Errorf("MemStorage.Set(): fail: %w", err))
-				}
-				break
+		staged[key] = newMetricElement
+		newKeys = append(newKeys, key)
+	}
+	return staged, newKeys, nil
+}
+
+// commit replaces series with their staged copies, caller holds repo.mu.
+func (repo *MemStorage) commit(staged map[string]*types.Metrics, newKeys []string, isDirty bool) {
+	repo.keys = append(repo.keys, newKeys...)
+	for key, m := range staged {
+		repo.metrics[key] = m
+		repo.addHistory(*m)
+		if isDirty {
+			repo.dirty[key] = struct{}{}
+		} else {
+			delete(repo.dirty, key)
+		}
+	}
+}
+
+func stagedList(staged map[string]*types.Metrics) []types.Metrics {
+	stagedMetrics := make([]types.Metrics, 0, len(staged))
+	for _, m := range staged {
+		stagedMetrics = append(stagedMetrics, m.GetMetric())
+	}
+	return stagedMetrics
+}
+
+func (repo *MemStorage) List(ctx context.Context, filter repositories.Filter) ([]types.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, types.NewTimeError(fmt.Errorf("MemStorage.List(): fail: %w", err))
+	}
+
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	res := []types.Metrics{}
+	for _, k := range repo.keys {
+		m := repo.metrics[k]
+		if filter.Match(*m) {
+			res = append(res, m.GetMetric())
+		}
+	}
+	return res, nil
+}
+
+// Delete removes the series with the given keys and their history, unknown keys are skipped.
+func (repo *MemStorage) Delete(ctx context.Context, keys []string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, types.NewTimeError(fmt.Errorf("MemStorage.Delete(): fail: %w", err))
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	removed := 0
+	for _, k := range keys {
+		m, ok := repo.metrics[k]
+		if !ok {
+			continue
+		}
+		repo.deleted[k] = m.GetMetric()
+		delete(repo.metrics, k)
+		delete(repo.history, k)
+		delete(repo.dirty, k)
+		removed++
+	}
+	if removed > 0 {
+		newKeys := make([]string, 0, len(repo.metrics))
+		for _, k := range repo.keys {
+			if _, ok := repo.metrics[k]; ok {
+				newKeys = append(newKeys, k)
 			}
 		}
+		repo.keys = newKeys
+	}
+	return removed, nil
+}
+
+// put replaces the series state with m as is, used to restore full snapshots.
+func (repo *MemStorage) put(m types.Metrics) error {
+	if !types.DataType(m.MType).IsValid() || !m.Labels.IsValid() {
+		return types.NewTimeError(fmt.Errorf("MemStorage.put(): fail: invalid metric %v", m.Key()))
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	key := m.Key()
+	newM := m.GetMetric()
+	if _, ok := repo.metrics[key]; !ok {
+		repo.keys = append(repo.keys, key)
+	}
+	repo.metrics[key] = &newM
+	repo.dirty[key] = struct{}{}
+	return nil
+}
+
+func (repo *MemStorage) addHistory(m types.Metrics) {
+	if repo.HistorySize <= 0 {
+		return
+	}
+	h, ok := repo.history[m.Key()]
+	if !ok {
+		h = newHistoryRing(repo.HistorySize)
+		repo.history[m.Key()] = h
+	}
+	h.add(m.Point())
+}
+
+func (repo *MemStorage) History(k string, from time.Time, to time.Time) ([]types.Point, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	h, ok := repo.history[k]
+	if !ok {
+		return []types.Point{}, fmt.Errorf("k[%v]: no history in storage", k)
 	}
+	return h.between(from, to), nil
+}
 
+// TakeDirty returns series changed since the previous call and resets the dirty set.
+func (repo *MemStorage) TakeDirty() []types.Metrics {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
-	repo.metrics = allMetrics
-	return err
+
+	dirtyMetrics := make([]types.Metrics, 0, len(repo.dirty))
+	for k := range repo.dirty {
+		if m, ok := repo.metrics[k]; ok {
+			dirtyMetrics = append(dirtyMetrics, m.GetMetric())
+		}
+	}
+	repo.dirty = make(map[string]struct{})
+	return dirtyMetrics
+}
+
+// PeekDirty returns series changed since the last TakeDirty without resetting the dirty set.
+func (repo *MemStorage) PeekDirty() []types.Metrics {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	dirtyMetrics := make([]types.Metrics, 0, len(repo.dirty))
+	for k := range repo.dirty {
+		if m, ok := repo.metrics[k]; ok {
+			dirtyMetrics = append(dirtyMetrics, m.GetMetric())
+		}
+	}
+	return dirtyMetrics
+}
+
+// MarkDirty puts series back into the dirty set, e.g. after a failed write.
+func (repo *MemStorage) MarkDirty(metrics []types.Metrics) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, m := range metrics {
+		repo.dirty[m.Key()] = struct{}{}
+	}
+}
+
+// TakeDeleted returns series deleted since the previous call and resets the set.
+func (repo *MemStorage) TakeDeleted() []types.Metrics {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	deletedMetrics := make([]types.Metrics, 0, len(repo.deleted))
+	for _, m := range repo.deleted {
+		deletedMetrics = append(deletedMetrics, m)
+	}
+	repo.deleted = make(map[string]types.Metrics)
+	return deletedMetrics
+}
+
+// PeekDeleted returns series deleted since the last TakeDeleted without resetting the set.
+func (repo *MemStorage) PeekDeleted() []types.Metrics {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	deletedMetrics := make([]types.Metrics, 0, len(repo.deleted))
+	for _, m := range repo.deleted {
+		deletedMetrics = append(deletedMetrics, m)
+	}
+	return deletedMetrics
+}
+
+// MarkDeleted puts series back into the deleted set, e.g. after a failed write.
+func (repo *MemStorage) MarkDeleted(metrics []types.Metrics) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, m := range metrics {
+		repo.deleted[m.Key()] = m
+	}
+}
+
+// isDeleted reports whether k was deleted and not written to the DB yet.
+func (repo *MemStorage) isDeleted(k string) bool {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	_, ok := repo.deleted[k]
+	return ok
 }
 
 func (repo *MemStorage) FlushDB(mainCtx context.Context) {
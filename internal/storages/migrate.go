@@ -0,0 +1,130 @@
+package storages
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationsFS embed.FS
+
+// migration is one NNNN_name.sql file, applied once in version order.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+const migrationsTableSQL = `
+CREATE TABLE IF NOT EXISTS "schema_migrations" (
+    "version" integer NOT NULL,
+    "name" varchar(255) NOT NULL,
+    "applied_at" bigint NOT NULL,
+    PRIMARY KEY ("version")
+);`
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, types.NewTimeError(fmt.Errorf("storages.loadMigrations(): fail: %w", err))
+	}
+	migrations := []migration{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		versionStr, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version < 1 {
+			return nil, types.NewTimeError(fmt.Errorf("storages.loadMigrations(): bad file name %v", e.Name()))
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, types.NewTimeError(fmt.Errorf("storages.loadMigrations(): fail: %w", err))
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, types.NewTimeError(fmt.Errorf("storages.loadMigrations(): duplicate version %v", migrations[i].version))
+		}
+	}
+	return migrations, nil
+}
+
+// migrate applies pending migrations forward only, each in its own transaction.
+func migrate(mainCtx context.Context, db *sqlx.DB, fsys fs.FS, dir string) error {
+	migrations, err := loadMigrations(fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(mainCtx, configs.GlobalDefaultTimeout)
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, migrationsTableSQL)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("storages.migrate(): create schema_migrations fail: %w", err))
+	}
+	applied := []int{}
+	err = db.SelectContext(ctx, &applied, `SELECT "version" FROM "schema_migrations"`)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("storages.migrate(): read schema_migrations fail: %w", err))
+	}
+	appliedSet := make(map[int]struct{}, len(applied))
+	for _, v := range applied {
+		appliedSet[v] = struct{}{}
+		if len(migrations) > 0 && v > migrations[len(migrations)-1].version {
+			return types.NewTimeError(fmt.Errorf("storages.migrate(): DB schema version %v is newer than this binary", v))
+		}
+	}
+
+	for _, m := range migrations {
+		if _, ok := appliedSet[m.version]; ok {
+			continue
+		}
+		err := applyMigration(ctx, db, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sqlx.DB, m migration) error {
+	dbTx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("storages.applyMigration(%v): transaction begin fail: %w", m.name, err))
+	}
+	defer dbTx.Rollback()
+
+	_, err = dbTx.ExecContext(ctx, m.sql)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("storages.applyMigration(%v): fail: %w", m.name, err))
+	}
+	_, err = dbTx.ExecContext(ctx, db.Rebind(`INSERT INTO "schema_migrations" ("version", "name", "applied_at") VALUES (?, ?, ?)`),
+		m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("storages.applyMigration(%v): fail: %w", m.name, err))
+	}
+	err = dbTx.Commit()
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("storages.applyMigration(%v): transaction commit fail: %w", m.name, err))
+	}
+	return nil
+}
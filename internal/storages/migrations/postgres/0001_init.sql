@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS "metrics" (
+    "ID"	varchar(255) NOT NULL,
+    "MType" varchar(128) DEFAULT 'gauge' NOT NULL,
+    "Delta" bigint,
+    "Value" double precision,
+    "Hash" varchar(128) DEFAULT '' NOT NULL,
+    PRIMARY KEY ("ID")
+);
+CREATE INDEX IF NOT EXISTS "metrics_MType" ON  "metrics" USING btree ("MType");
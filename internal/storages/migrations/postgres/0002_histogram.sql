@@ -0,0 +1,2 @@
+ALTER TABLE "metrics" ADD COLUMN IF NOT EXISTS "Buckets" text DEFAULT '' NOT NULL;
+ALTER TABLE "metrics" ADD COLUMN IF NOT EXISTS "Counts" text DEFAULT '' NOT NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE "metrics" ADD COLUMN IF NOT EXISTS "Labels" text DEFAULT '' NOT NULL;
+ALTER TABLE "metrics" DROP CONSTRAINT IF EXISTS "metrics_pkey";
+ALTER TABLE "metrics" ADD PRIMARY KEY ("ID", "Labels");
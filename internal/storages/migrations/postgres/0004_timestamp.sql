@@ -0,0 +1 @@
+ALTER TABLE "metrics" ADD COLUMN IF NOT EXISTS "Timestamp" bigint DEFAULT 0 NOT NULL;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS "idempotency" (
+    "Key" varchar(255) NOT NULL,
+    "RequestHash" varchar(128) DEFAULT '' NOT NULL,
+    "Status" integer NOT NULL,
+    "ContentType" varchar(128) DEFAULT '' NOT NULL,
+    "Body" text DEFAULT '' NOT NULL,
+    "ExpiresAt" bigint NOT NULL,
+    PRIMARY KEY ("Key")
+);
+CREATE INDEX IF NOT EXISTS "idempotency_ExpiresAt" ON "idempotency" USING btree ("ExpiresAt");
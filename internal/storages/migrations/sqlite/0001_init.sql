@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS "metrics" (
+    "ID"	varchar(255) NOT NULL,
+    "MType" varchar(128) DEFAULT 'gauge' NOT NULL,
+    "Delta" bigint,
+    "Value" double precision,
+    "Buckets" text DEFAULT '' NOT NULL,
+    "Counts" text DEFAULT '' NOT NULL,
+    "Labels" text DEFAULT '' NOT NULL,
+    "Timestamp" bigint DEFAULT 0 NOT NULL,
+    "Hash" varchar(128) DEFAULT '' NOT NULL,
+    PRIMARY KEY ("ID", "Labels")
+);
+CREATE INDEX IF NOT EXISTS "metrics_MType" ON "metrics" ("MType");
@@ -0,0 +1,53 @@
+package storages
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+const SQLiteScheme = "sqlite://"
+
+// SQLiteStorage is DBStorage over an embedded SQLite file, DSN sqlite:///path/to/metrics.db
+type SQLiteStorage struct {
+	DBStorage
+}
+
+var _ repositories.Repo = (*SQLiteStorage)(nil)
+
+func init() {
+	sqlx.BindDriver("sqlite", sqlx.QUESTION)
+}
+
+func IsSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, SQLiteScheme)
+}
+
+func (repo *SQLiteStorage) Init(mainCtx context.Context) bool {
+	repo.setSQLite()
+	isInit := repo.DBStorage.Init(mainCtx)
+	if isInit {
+		// one writer at a time, SQLite locks the whole file
+		repo.DBConn.SetMaxOpenConns(1)
+	}
+	return isInit
+}
+
+func (repo *SQLiteStorage) Migrate(mainCtx context.Context) error {
+	repo.setSQLite()
+	return repo.DBStorage.Migrate(mainCtx)
+}
+
+// setSQLite points the DB storage at an embedded SQLite file.
+func (repo *DBStorage) setSQLite() {
+	if repo.Config == nil || !IsSQLiteDSN(repo.Config.DSN) {
+		return
+	}
+	repo.driverName = "sqlite"
+	repo.dataSource = fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", strings.TrimPrefix(repo.Config.DSN, SQLiteScheme))
+	repo.migrationsDir = "migrations/sqlite"
+}
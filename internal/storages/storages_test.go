@@ -1 +1,754 @@
 package storages
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+func newSQLiteConfig(t *testing.T, isRestore bool) *configs.ServerConfig {
+	return &configs.ServerConfig{
+		DSN:       SQLiteScheme + filepath.Join(t.TempDir(), "metrics.db"),
+		IsRestore: isRestore,
+	}
+}
+
+func initSQLite(t *testing.T, config *configs.ServerConfig) *SQLiteStorage {
+	repo := &SQLiteStorage{DBStorage: DBStorage{Config: config}}
+	if !repo.Init(context.Background()) {
+		t.Fatalf("SQLiteStorage.Init(%v) failed", config.DSN)
+	}
+	return repo
+}
+
+func setTestMetrics(t *testing.T, repo *SQLiteStorage) {
+	gauge, _ := types.NewMetric("Alloc", types.GaugeType, types.OsSource)
+	gauge.Set(1.5)
+	gauge.Labels = types.Labels{"host": "a"}
+
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(int64(3))
+
+	histogram, _ := types.NewHistogram("Latency", []float64{1, 2}, types.OsSource)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	for _, m := range []*types.Metrics{gauge, counter, histogram} {
+		if err := repo.Set(*m); err != nil {
+			t.Fatalf("Set(%v): %v", m.ID, err)
+		}
+	}
+}
+
+func TestSQLiteStorageRestore(t *testing.T) {
+	ctx := context.Background()
+	config := newSQLiteConfig(t, true)
+
+	repo := initSQLite(t, config)
+	setTestMetrics(t, repo)
+	repo.Shutdown(ctx)
+
+	restored := initSQLite(t, config)
+	defer restored.Shutdown(ctx)
+
+	if len(restored.GetAll()) != 3 {
+		t.Fatalf("restored %v metrics, want 3", len(restored.GetAll()))
+	}
+	gauge, err := restored.Get(types.SeriesKey("Alloc", types.Labels{"host": "a"}))
+	if err != nil || gauge.GetValue() != 1.5 {
+		t.Errorf("gauge = %v, %v; want 1.5", gauge.GetValue(), err)
+	}
+	counter, err := restored.Get("PollCount")
+	if err != nil || counter.GetDelta() != 3 {
+		t.Errorf("counter = %v, %v; want 3", counter.GetDelta(), err)
+	}
+	histogram, err := restored.Get("Latency")
+	if err != nil || histogram.GetDelta() != 2 || len(histogram.Counts) != 3 || histogram.Counts[2] != 1 {
+		t.Errorf("histogram = %+v, %v", histogram, err)
+	}
+}
+
+func TestSQLiteStorageIncrementalStore(t *testing.T) {
+	ctx := context.Background()
+	config := newSQLiteConfig(t, true)
+
+	repo := initSQLite(t, config)
+	setTestMetrics(t, repo)
+	repo.StoreDBfunc(ctx)
+
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(int64(2))
+	repo.Set(*counter)
+	if dirty := repo.mem.TakeDirty(); len(dirty) != 1 {
+		t.Fatalf("dirty = %v, want only PollCount", dirty)
+	} else {
+		repo.mem.MarkDirty(dirty)
+	}
+	repo.StoreDBfunc(ctx)
+
+	stored := []types.Metrics{}
+	err := repo.DBConn.SelectContext(ctx, &stored, `SELECT * FROM "metrics" WHERE "ID" = ?`, "PollCount")
+	if err != nil || len(stored) != 1 || stored[0].GetDelta() != 5 {
+		t.Errorf("stored = %+v, %v; want delta 5", stored, err)
+	}
+	repo.Shutdown(ctx)
+}
+
+func TestSQLiteStorageSetManyDBError(t *testing.T) {
+	ctx := context.Background()
+	repo := initSQLite(t, newSQLiteConfig(t, true))
+	setTestMetrics(t, repo)
+
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(int64(2))
+	if err := repo.SetMany(ctx, []types.Metrics{*counter}); err != nil {
+		t.Fatalf("SetMany() = %v", err)
+	}
+	stored := []types.Metrics{}
+	err := repo.DBConn.SelectContext(ctx, &stored, `SELECT * FROM "metrics" WHERE "ID" = ?`, "PollCount")
+	if err != nil || len(stored) != 1 || stored[0].GetDelta() != 5 {
+		t.Errorf("stored = %+v, %v; want delta 5 written by SetMany", stored, err)
+	}
+
+	repo.DBConn.Close()
+	if err := repo.SetMany(ctx, []types.Metrics{*counter}); err == nil {
+		t.Fatalf("SetMany() with the DB closed succeeded")
+	}
+	if m, _ := repo.Get("PollCount"); m.GetDelta() != 5 {
+		t.Errorf("PollCount = %v after a refused batch, want 5", m.GetDelta())
+	}
+}
+
+func TestSQLiteStorageSetManyWritesOnce(t *testing.T) {
+	ctx := context.Background()
+	repo := initSQLite(t, newSQLiteConfig(t, true))
+	defer repo.Shutdown(ctx)
+	setTestMetrics(t, repo)
+	repo.StoreDBfunc(ctx)
+
+	// a series deleted and written again before the next store keeps the new row
+	if _, err := repo.Delete(ctx, []string{"PollCount"}); err != nil {
+		t.Fatal(err)
+	}
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(int64(2))
+	if err := repo.SetMany(ctx, []types.Metrics{*counter}); err != nil {
+		t.Fatalf("SetMany() = %v", err)
+	}
+	if dirty, deleted := repo.mem.PeekDirty(), repo.mem.PeekDeleted(); len(dirty) != 0 || len(deleted) != 0 {
+		t.Errorf("after SetMany dirty = %v, deleted = %v; want both empty", dirty, deleted)
+	}
+	repo.FlushDB(ctx)
+	stored := []types.Metrics{}
+	err := repo.DBConn.SelectContext(ctx, &stored, `SELECT * FROM "metrics" WHERE "ID" = ?`, "PollCount")
+	if err != nil || len(stored) != 1 || stored[0].GetDelta() != 2 {
+		t.Errorf("stored = %+v, %v; want delta 2", stored, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				hit, _ := types.NewMetric("Hits", types.CounterType, types.IncrementSource)
+				hit.Set(int64(1))
+				if err := repo.SetMany(ctx, []types.Metrics{*hit}); err != nil {
+					t.Errorf("SetMany() = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stored = stored[:0]
+	err = repo.DBConn.SelectContext(ctx, &stored, `SELECT * FROM "metrics" WHERE "ID" = ?`, "Hits")
+	if m, _ := repo.Get("Hits"); err != nil || len(stored) != 1 || stored[0].GetDelta() != 80 || m.GetDelta() != 80 {
+		t.Errorf("Hits = %v, stored %+v, %v; want 80 in memory and the DB", m.GetDelta(), stored, err)
+	}
+}
+
+func TestSQLiteStorageNoRestore(t *testing.T) {
+	ctx := context.Background()
+	config := newSQLiteConfig(t, true)
+
+	repo := initSQLite(t, config)
+	setTestMetrics(t, repo)
+	repo.Shutdown(ctx)
+
+	config.IsRestore = false
+	fresh := initSQLite(t, config)
+	defer fresh.Shutdown(ctx)
+	if len(fresh.GetAll()) != 0 {
+		t.Errorf("got %v metrics without restore, want 0", len(fresh.GetAll()))
+	}
+}
+
+func TestSQLiteStorageDelete(t *testing.T) {
+	ctx := context.Background()
+	config := newSQLiteConfig(t, true)
+
+	repo := initSQLite(t, config)
+	setTestMetrics(t, repo)
+	repo.StoreDBfunc(ctx)
+
+	alloc := types.SeriesKey("Alloc", types.Labels{"host": "a"})
+	deleted, err := repo.Delete(ctx, []string{alloc, "PollCount", "Missing"})
+	if err != nil || deleted != 2 {
+		t.Fatalf("Delete() = %v, %v; want 2", deleted, err)
+	}
+	// a deleted counter written again starts from zero
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(int64(1))
+	repo.Set(*counter)
+	repo.Shutdown(ctx)
+
+	restored := initSQLite(t, config)
+	defer restored.Shutdown(ctx)
+	if len(restored.GetAll()) != 2 {
+		t.Fatalf("restored %v metrics, want 2", len(restored.GetAll()))
+	}
+	if _, err := restored.Get(alloc); err == nil {
+		t.Errorf("deleted gauge restored")
+	}
+	if restoredCounter, err := restored.Get("PollCount"); err != nil || restoredCounter.GetDelta() != 1 {
+		t.Errorf("counter = %v, %v; want 1", restoredCounter.GetDelta(), err)
+	}
+}
+
+func newWALConfig(t *testing.T) *configs.ServerConfig {
+	return &configs.ServerConfig{
+		StoreFileName: filepath.Join(t.TempDir(), "metrics.json"),
+		StoreInterval: time.Hour,
+		StoreWAL:      true,
+		IsRestore:     true,
+	}
+}
+
+func TestFileStorageWALDelete(t *testing.T) {
+	ctx := context.Background()
+	config := newWALConfig(t)
+
+	repo := &FileStorage{Config: config}
+	repo.Init(ctx)
+	for _, id := range []string{"Alloc", "Frees"} {
+		gauge, _ := types.NewMetric(id, types.GaugeType, types.OsSource)
+		gauge.Set(1.0)
+		repo.Set(*gauge)
+	}
+	if deleted, err := repo.Delete(ctx, []string{"Alloc"}); err != nil || deleted != 1 {
+		t.Fatalf("Delete() = %v, %v; want 1", deleted, err)
+	}
+	// crash: the log is replayed without a compaction
+	repo.walFile.Close()
+
+	restored := &FileStorage{Config: config}
+	restored.Init(ctx)
+	defer restored.Shutdown(ctx)
+	if all := restored.GetAll(); len(all) != 1 || all[0].ID != "Frees" {
+		t.Errorf("restored %+v, want only Frees", all)
+	}
+}
+
+func addPollCount(t *testing.T, repo *FileStorage, delta int64) {
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(delta)
+	if err := repo.Set(*counter); err != nil {
+		t.Fatalf("Set(PollCount): %v", err)
+	}
+}
+
+func TestFileStorageWALCompactionCrash(t *testing.T) {
+	ctx := context.Background()
+	config := newWALConfig(t)
+
+	repo := &FileStorage{Config: config}
+	repo.Init(ctx)
+	addPollCount(t, repo, 1)
+	addPollCount(t, repo, 2)
+	logged, err := os.ReadFile(repo.walFileName())
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	repo.compactWAL()
+	// crash: the snapshot is written but the log still holds the records it covers
+	if err := os.WriteFile(repo.walFileName(), logged, 0666); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	repo.walFile.Close()
+
+	restored := &FileStorage{Config: config}
+	restored.Init(ctx)
+	addPollCount(t, restored, 4)
+	restored.walFile.Close()
+
+	again := &FileStorage{Config: config}
+	again.Init(ctx)
+	defer again.Shutdown(ctx)
+	if counter, err := again.Get("PollCount"); err != nil || counter.GetDelta() != 7 {
+		t.Errorf("PollCount = %v, %v; want 7", counter.GetDelta(), err)
+	}
+}
+
+func TestFileStorageWALTornRecord(t *testing.T) {
+	ctx := context.Background()
+	config := newWALConfig(t)
+
+	repo := &FileStorage{Config: config}
+	repo.Init(ctx)
+	addPollCount(t, repo, 1)
+	repo.walFile.Write([]byte(`{"lsn":2,"metrics":[{"id":"PollCo`))
+	repo.walFile.Close()
+
+	restored := &FileStorage{Config: config}
+	restored.Init(ctx)
+	// the torn tail is cut, so this record is not appended behind it
+	addPollCount(t, restored, 2)
+	restored.walFile.Close()
+
+	again := &FileStorage{Config: config}
+	again.Init(ctx)
+	defer again.Shutdown(ctx)
+	if counter, err := again.Get("PollCount"); err != nil || counter.GetDelta() != 3 {
+		t.Errorf("PollCount = %v, %v; want 3", counter.GetDelta(), err)
+	}
+}
+
+func TestFileStorageWALTornBatch(t *testing.T) {
+	ctx := context.Background()
+	config := newWALConfig(t)
+
+	repo := &FileStorage{Config: config}
+	repo.Init(ctx)
+	addPollCount(t, repo, 1)
+	batch := []types.Metrics{}
+	for _, id := range []string{"Alloc", "Frees"} {
+		gauge, _ := types.NewMetric(id, types.GaugeType, types.OsSource)
+		gauge.Set(1.0)
+		batch = append(batch, *gauge)
+	}
+	if err := repo.SetMany(ctx, batch); err != nil {
+		t.Fatalf("SetMany() = %v", err)
+	}
+	// crash in the middle of the batch record
+	info, _ := repo.walFile.Stat()
+	repo.walFile.Truncate(info.Size() - 20)
+	repo.walFile.Close()
+
+	restored := &FileStorage{Config: config}
+	restored.Init(ctx)
+	defer restored.Shutdown(ctx)
+	if all := restored.GetAll(); len(all) != 1 || all[0].ID != "PollCount" {
+		t.Errorf("restored %+v, want only PollCount", all)
+	}
+}
+
+func TestFileStorageWALRelativeGauge(t *testing.T) {
+	ctx := context.Background()
+	config := newWALConfig(t)
+
+	repo := &FileStorage{Config: config}
+	repo.Init(ctx)
+	for _, v := range []float64{10, -3, 5} {
+		gauge, _ := types.NewMetric("Queue", types.GaugeType, types.IncrementSource)
+		gauge.Set(v)
+		if err := repo.Set(*gauge); err != nil {
+			t.Fatalf("Set(%v) = %v", v, err)
+		}
+	}
+	if m, _ := repo.Get("Queue"); m.GetValue() != 12 {
+		t.Fatalf("Queue = %v, want 12", m.GetValue())
+	}
+	repo.walFile.Close()
+
+	// the log keeps the merged value, replay must not turn the increments into absolute values
+	restored := &FileStorage{Config: config}
+	restored.Init(ctx)
+	defer restored.Shutdown(ctx)
+	if m, err := restored.Get("Queue"); err != nil || m.GetValue() != 12 {
+		t.Errorf("restored Queue = %v, %v; want 12", m.GetValue(), err)
+	}
+}
+
+func TestSQLiteStorageMigrate(t *testing.T) {
+	ctx := context.Background()
+	config := newSQLiteConfig(t, true)
+
+	for i := 0; i < 2; i++ {
+		repo := &SQLiteStorage{DBStorage: DBStorage{Config: config}}
+		if err := repo.Migrate(ctx); err != nil {
+			t.Fatalf("Migrate() run %v: %v", i, err)
+		}
+	}
+
+	repo := initSQLite(t, config)
+	defer repo.Shutdown(ctx)
+	versions := []int{}
+	err := repo.DBConn.SelectContext(ctx, &versions, `SELECT "version" FROM "schema_migrations"`)
+	if err != nil || len(versions) != 2 {
+		t.Errorf("versions = %v, %v; want two applied migrations", versions, err)
+	}
+	if err := repo.Ping(ctx); err != nil {
+		t.Errorf("Ping() = %v", err)
+	}
+}
+
+// newTieredConfig keeps the SQLite file in its own directory, renaming the directory takes the DB down.
+func newTieredConfig(t *testing.T, isRestore bool) (*configs.ServerConfig, string) {
+	dir := t.TempDir()
+	dbDir := filepath.Join(dir, "db")
+	if err := os.Mkdir(dbDir, 0777); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	config := &configs.ServerConfig{
+		DSN:           SQLiteScheme + filepath.Join(dbDir, "metrics.db"),
+		StoreFileName: filepath.Join(dir, "metrics.json"),
+		StoreInterval: time.Hour,
+		IsRestore:     isRestore,
+	}
+	return config, dbDir
+}
+
+func initTiered(t *testing.T, ctx context.Context, config *configs.ServerConfig) *TieredStorage {
+	repo := &TieredStorage{Config: config}
+	if !repo.Init(ctx) {
+		t.Fatalf("TieredStorage.Init(%v) failed", config.DSN)
+	}
+	return repo
+}
+
+func storedDelta(t *testing.T, repo *TieredStorage, id string) int64 {
+	stored := []types.Metrics{}
+	err := repo.db.DBConn.SelectContext(context.Background(), &stored, `SELECT * FROM "metrics" WHERE "ID" = ?`, id)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("stored %v = %+v, %v; want one row", id, stored, err)
+	}
+	return stored[0].GetDelta()
+}
+
+func TestTieredStorageRuntimeFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config, _ := newTieredConfig(t, false)
+
+	repo := initTiered(t, ctx, config)
+	alloc, _ := types.NewMetric("Alloc", types.GaugeType, types.OsSource)
+	alloc.Set(1.5)
+	repo.Set(*alloc)
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(int64(1))
+	repo.Set(*counter)
+	repo.StoreDBfunc(ctx)
+	if repo.Tier() != TierDB {
+		t.Fatalf("tier = %v, want %v", repo.Tier(), TierDB)
+	}
+
+	// the connection drops: writes go on, the store spills them
+	repo.db.DBConn.Close()
+	counter.Set(int64(2))
+	repo.Set(*counter)
+	repo.StoreDBfunc(ctx)
+	if repo.Tier() != TierFile {
+		t.Fatalf("tier = %v, want %v", repo.Tier(), TierFile)
+	}
+	if _, err := os.Stat(repo.spillFileName()); err != nil {
+		t.Fatalf("no spill file: %v", err)
+	}
+
+	// the DB is reachable again and open() reconnects
+	repo.db.DBConn = nil
+	repo.checkDB(ctx)
+	defer repo.Shutdown(ctx)
+	if repo.Tier() != TierDB {
+		t.Fatalf("tier = %v after recovery, want %v", repo.Tier(), TierDB)
+	}
+	if _, err := os.Stat(repo.spillFileName()); !os.IsNotExist(err) {
+		t.Errorf("spill file left after recovery: %v", err)
+	}
+	if delta := storedDelta(t, repo, "PollCount"); delta != 3 {
+		t.Errorf("stored PollCount = %v, want 3", delta)
+	}
+	// stored before the outage, a reconnect must not clear it
+	storedDelta(t, repo, "Alloc")
+}
+
+func TestTieredStorageStartupOutage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config, dbDir := newTieredConfig(t, true)
+
+	previous := initSQLite(t, config)
+	setTestMetrics(t, previous)
+	previous.Shutdown(ctx)
+	if err := os.Rename(dbDir, dbDir+".down"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	repo := initTiered(t, ctx, config)
+	if repo.Tier() != TierFile {
+		t.Fatalf("tier = %v, want %v", repo.Tier(), TierFile)
+	}
+	counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+	counter.Set(int64(2))
+	repo.Set(*counter)
+	alloc, _ := types.NewMetric("Alloc", types.GaugeType, types.OsSource)
+	alloc.Set(7.0)
+	alloc.Labels = types.Labels{"host": "a"}
+	repo.Set(*alloc)
+	repo.Shutdown(ctx)
+
+	// restarted while the DB is still down, the spill brings the series back
+	restarted := initTiered(t, ctx, config)
+	if m, err := restarted.Get("PollCount"); err != nil || m.GetDelta() != 2 {
+		t.Fatalf("PollCount = %v, %v from the spill; want 2", m.GetDelta(), err)
+	}
+
+	if err := os.Rename(dbDir+".down", dbDir); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	restarted.checkDB(ctx)
+	defer restarted.Shutdown(ctx)
+	if restarted.Tier() != TierDB {
+		t.Fatalf("tier = %v after recovery, want %v", restarted.Tier(), TierDB)
+	}
+	// counters add the DB totals, gauges keep the newer value, unknown series are adopted
+	if m, _ := restarted.Get("PollCount"); m.GetDelta() != 5 {
+		t.Errorf("PollCount = %v, want 5", m.GetDelta())
+	}
+	if m, _ := restarted.Get(alloc.Key()); m.GetValue() != 7 {
+		t.Errorf("Alloc = %v, want 7", m.GetValue())
+	}
+	if _, err := restarted.Get("Latency"); err != nil {
+		t.Errorf("Latency not merged from the DB: %v", err)
+	}
+	if delta := storedDelta(t, restarted, "PollCount"); delta != 5 {
+		t.Errorf("stored PollCount = %v, want 5", delta)
+	}
+}
+
+func TestTieredStorageStartupOutageNoRestore(t *testing.T) {
+	for _, isRestarted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("restarted=%v", isRestarted), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			config, dbDir := newTieredConfig(t, false)
+
+			previous := initSQLite(t, config)
+			setTestMetrics(t, previous)
+			previous.Shutdown(ctx)
+			if err := os.Rename(dbDir, dbDir+".down"); err != nil {
+				t.Fatalf("rename: %v", err)
+			}
+
+			repo := initTiered(t, ctx, config)
+			counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+			counter.Set(int64(2))
+			repo.Set(*counter)
+			if isRestarted {
+				// restarted with restore while the DB is still down, the spill keeps the pending clear
+				repo.Shutdown(ctx)
+				config.IsRestore = true
+				repo = initTiered(t, ctx, config)
+			}
+
+			if err := os.Rename(dbDir+".down", dbDir); err != nil {
+				t.Fatalf("rename: %v", err)
+			}
+			repo.checkDB(ctx)
+			defer repo.Shutdown(ctx)
+			if repo.Tier() != TierDB {
+				t.Fatalf("tier = %v after recovery, want %v", repo.Tier(), TierDB)
+			}
+			// the rows of the previous run are dropped, not merged back
+			if m, _ := repo.Get("PollCount"); m.GetDelta() != 2 {
+				t.Errorf("PollCount = %v, want 2", m.GetDelta())
+			}
+			if _, err := repo.Get("Latency"); err == nil {
+				t.Errorf("Latency merged from the DB")
+			}
+			if delta := storedDelta(t, repo, "PollCount"); delta != 2 {
+				t.Errorf("stored PollCount = %v, want 2", delta)
+			}
+			rows := 0
+			if err := repo.db.DBConn.GetContext(ctx, &rows, `SELECT COUNT(*) FROM "metrics"`); err != nil || rows != 1 {
+				t.Errorf("stored %v rows, %v; want only PollCount", rows, err)
+			}
+
+			// a later outage does not clear again
+			repo.db.DBConn.Close()
+			alloc, _ := types.NewMetric("Alloc", types.GaugeType, types.OsSource)
+			alloc.Set(1.5)
+			repo.Set(*alloc)
+			repo.StoreDBfunc(ctx)
+			if repo.Tier() != TierFile {
+				t.Fatalf("tier = %v, want %v", repo.Tier(), TierFile)
+			}
+			repo.db.DBConn = nil
+			repo.checkDB(ctx)
+			if delta := storedDelta(t, repo, "PollCount"); delta != 2 {
+				t.Errorf("stored PollCount = %v after a reconnect, want 2", delta)
+			}
+			storedDelta(t, repo, "Alloc")
+		})
+	}
+}
+
+func TestMemStorageConcurrentSet(t *testing.T) {
+	repo := &MemStorage{}
+	repo.Init(context.Background())
+
+	const workers = 16
+	const perWorker = 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				counter, _ := types.NewMetric("PollCount", types.CounterType, types.IncrementSource)
+				counter.Set(int64(1))
+				if err := repo.Set(*counter); err != nil {
+					t.Error(err)
+				}
+				gauge, _ := types.NewMetric(fmt.Sprintf("Gauge%d", w), types.GaugeType, types.OsSource)
+				gauge.Set(float64(i))
+				if err := repo.Set(*gauge); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	counter, err := repo.Get("PollCount")
+	if err != nil || counter.GetDelta() != workers*perWorker {
+		t.Errorf("PollCount = %v, %v; want %v", counter.GetDelta(), err, workers*perWorker)
+	}
+	if len(repo.GetAll()) != workers+1 {
+		t.Errorf("got %v series, want %v", len(repo.GetAll()), workers+1)
+	}
+}
+
+func TestMemStorageHistoryDropsLateSamples(t *testing.T) {
+	repo := &MemStorage{HistorySize: 10}
+	repo.Init(context.Background())
+
+	setGauge := func(v float64, ts int64) {
+		gauge, _ := types.NewMetric("Alloc", types.GaugeType, types.OsSource)
+		gauge.Set(v)
+		gauge.Timestamp = ts
+		if err := repo.Set(*gauge); err != nil {
+			t.Fatalf("Set(%v @%d): %v", v, ts, err)
+		}
+	}
+	setGauge(1, 1000)
+	setGauge(3, 3000)
+	// late: the gauge keeps 3, history must not get a point at 3000 for it
+	setGauge(2, 2000)
+	setGauge(4, 3000)
+
+	points, err := repo.History("Alloc", time.UnixMilli(0), time.UnixMilli(10000))
+	if err != nil {
+		t.Fatalf("History() = %v", err)
+	}
+	want := []types.Point{{Timestamp: 1000, Value: 1}, {Timestamp: 3000, Value: 4}}
+	if fmt.Sprint(points) != fmt.Sprint(want) {
+		t.Errorf("History() = %v, want %v", points, want)
+	}
+}
+
+func BenchmarkMemStorageSet(b *testing.B) {
+	for _, series := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprintf("series=%d", series), func(b *testing.B) {
+			repo := &MemStorage{}
+			repo.Init(context.Background())
+			for i := 0; i < series; i++ {
+				m, _ := types.NewMetric(fmt.Sprintf("Gauge%d", i), types.GaugeType, types.OsSource)
+				repo.Set(*m)
+			}
+			m, _ := types.NewMetric(fmt.Sprintf("Gauge%d", series/2), types.GaugeType, types.OsSource)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Set(float64(i))
+				if err := repo.Set(*m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyResponsesRestore(t *testing.T) {
+	ctx := context.Background()
+	live := repositories.StoredResponse{RequestHash: "h1", Status: 200, ContentType: "application/json", Body: `{"ok":true}`, ExpiresAt: time.Now().Add(time.Hour).UnixMilli()}
+	expired := repositories.StoredResponse{RequestHash: "h2", Status: 200, ExpiresAt: time.Now().Add(-time.Second).UnixMilli()}
+
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	dsn := newSQLiteConfig(t, true).DSN
+
+	type store interface {
+		repositories.Repo
+		repositories.IdempotencyStore
+	}
+	tests := []struct {
+		name   string
+		config func(isRestore bool) *configs.ServerConfig
+		open   func(config *configs.ServerConfig) store
+	}{
+		{
+			name: "file",
+			config: func(isRestore bool) *configs.ServerConfig {
+				return &configs.ServerConfig{StoreFileName: fileName, IsRestore: isRestore}
+			},
+			open: func(config *configs.ServerConfig) store {
+				repo := &FileStorage{Config: config}
+				repo.Init(ctx)
+				return repo
+			},
+		},
+		{
+			name: "sqlite",
+			config: func(isRestore bool) *configs.ServerConfig {
+				return &configs.ServerConfig{DSN: dsn, IsRestore: isRestore}
+			},
+			open: func(config *configs.ServerConfig) store {
+				return initSQLite(t, config)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tt.open(tt.config(true))
+			repo.SaveResponse(ctx, "/update/ k1", live)
+			repo.SaveResponse(ctx, "/update/ k2", expired)
+			if _, found := repo.LoadResponse("/update/ k2"); found {
+				t.Errorf("expired response loaded")
+			}
+			repo.Shutdown(ctx)
+
+			restored := tt.open(tt.config(true))
+			resp, found := restored.LoadResponse("/update/ k1")
+			if !found || resp != live {
+				t.Errorf("restored response = %+v, %v; want %+v", resp, found, live)
+			}
+			if _, found := restored.LoadResponse("/update/ k2"); found {
+				t.Errorf("expired response restored")
+			}
+			restored.Shutdown(ctx)
+
+			fresh := tt.open(tt.config(false))
+			defer fresh.Shutdown(ctx)
+			if _, found := fresh.LoadResponse("/update/ k1"); found {
+				t.Errorf("response kept without restore")
+			}
+		})
+	}
+}
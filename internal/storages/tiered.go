@@ -0,0 +1,344 @@
+package storages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aaarkadev/collectalertagent/internal/configs"
+	"github.com/aaarkadev/collectalertagent/internal/repositories"
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+const (
+	TierDB   = "db"
+	TierFile = "file"
+	TierMem  = "mem"
+)
+
+// tierCheckInterval is how often the primary DB is probed.
+const tierCheckInterval = 5 * time.Second
+
+// TieredStorage keeps Postgres as the primary store, spills unsaved series to
+// a local file while the DB is down and replays them once it is back.
+type TieredStorage struct {
+	db     DBStorage
+	Config *configs.ServerConfig
+	// storeMu serializes store, spill and recovery
+	storeMu sync.Mutex
+	tierMu  sync.RWMutex
+	tier    string
+	// isDBLoaded is false when the DB was down at start-up and its rows are not merged yet
+	isDBLoaded bool
+	// isClearPending is true when the DB was down at start-up without restore and its tables still hold old rows
+	isClearPending bool
+}
+
+var _ repositories.Repo = (*TieredStorage)(nil)
+
+// spillFile is the on-disk state of series not yet written to the DB.
+type spillFile struct {
+	IsDBLoaded     bool                                   `json:"db_loaded"`
+	IsClearPending bool                                   `json:"clear_pending,omitempty"`
+	Metrics        []types.Metrics                        `json:"metrics"`
+	Deleted        []types.Metrics                        `json:"deleted,omitempty"`
+	Responses      map[string]repositories.StoredResponse `json:"responses,omitempty"`
+}
+
+func (repo *TieredStorage) Init(mainCtx context.Context) bool {
+	if repo.Config == nil || len(repo.Config.DSN) <= 0 {
+		log.Println(types.NewTimeError(fmt.Errorf("TieredStorage.Init(): empty Config.DSN. falback to file")))
+		return false
+	}
+	// DBStorage clears DSN on failures, keep the shared config intact
+	dbConfig := *repo.Config
+	repo.db = DBStorage{Config: &dbConfig}
+	repo.db.mem = MemStorage{}
+	repo.db.mem.Init(mainCtx)
+	repo.db.mem.HistorySize = repo.Config.HistorySize
+	repo.db.setDefaults()
+
+	err := repo.db.open(mainCtx)
+	if err == nil {
+		if err := repo.db.clearTables(mainCtx); err != nil {
+			log.Println(err)
+		}
+		repo.db.loadDB(mainCtx)
+		repo.db.mem.TakeDirty()
+		repo.db.mem.TakeDeleted()
+		repo.isDBLoaded = true
+		repo.setTier(TierDB)
+	} else {
+		log.Println(types.NewTimeError(fmt.Errorf("TieredStorage.Init(): DB unavailable, spill to file. fail: %w", err)))
+		repo.isDBLoaded = !repo.Config.IsRestore
+		repo.isClearPending = !repo.Config.IsRestore
+		repo.setTier(TierFile)
+	}
+	repo.loadSpill()
+
+	go func() {
+		checkTicker := time.NewTicker(tierCheckInterval)
+		defer checkTicker.Stop()
+		var storeC <-chan time.Time
+		if repo.Config.StoreInterval > 0 {
+			storeTicker := time.NewTicker(repo.Config.StoreInterval)
+			defer storeTicker.Stop()
+			storeC = storeTicker.C
+		}
+		for {
+			select {
+			case <-checkTicker.C:
+				repo.checkDB(mainCtx)
+			case <-storeC:
+				repo.StoreDBfunc(mainCtx)
+			case <-mainCtx.Done():
+				return
+			}
+		}
+	}()
+
+	return true
+}
+
+func (repo *TieredStorage) Tier() string {
+	repo.tierMu.RLock()
+	defer repo.tierMu.RUnlock()
+	return repo.tier
+}
+
+func (repo *TieredStorage) setTier(tier string) {
+	repo.tierMu.Lock()
+	defer repo.tierMu.Unlock()
+	if repo.tier != tier {
+		log.Println(types.NewTimeError(fmt.Errorf("TieredStorage: storage tier %v -> %v", repo.tier, tier)))
+	}
+	repo.tier = tier
+}
+
+func (repo *TieredStorage) spillFileName() string {
+	if len(repo.Config.StoreFileName) <= 0 {
+		return ""
+	}
+	return repo.Config.StoreFileName + ".spill"
+}
+
+// loadSpill restores series saved while the DB was down, they are newer than DB rows.
+func (repo *TieredStorage) loadSpill() {
+	name := repo.spillFileName()
+	if len(name) <= 0 {
+		return
+	}
+	if !repo.Config.IsRestore {
+		os.Remove(name)
+		return
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(types.NewTimeError(fmt.Errorf("TieredStorage.loadSpill(): fail: %w", err)))
+		}
+		return
+	}
+	spill := spillFile{}
+	err = json.Unmarshal(data, &spill)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("TieredStorage.loadSpill(): fail: %w", err)))
+		return
+	}
+	for _, m := range spill.Metrics {
+		err := repo.db.mem.put(m)
+		if err != nil {
+			log.Println(types.NewTimeError(fmt.Errorf("TieredStorage.loadSpill(): skip: %w", err)))
+		}
+	}
+	repo.db.mem.MarkDeleted(spill.Deleted)
+	repo.db.mem.putResponses(spill.Responses, true)
+	if spill.IsDBLoaded {
+		repo.isDBLoaded = true
+	}
+	if spill.IsClearPending {
+		// restarted with restore before the DB came back, its rows are still the ones to drop
+		repo.isClearPending = true
+	}
+}
+
+// writeSpill saves every series, deletion and response still owed to the DB, caller holds storeMu.
+func (repo *TieredStorage) writeSpill(deletedMetrics []types.Metrics, dirtyMetrics []types.Metrics, dirtyResponses map[string]repositories.StoredResponse) {
+	name := repo.spillFileName()
+	if len(name) <= 0 {
+		repo.setTier(TierMem)
+		return
+	}
+	data, err := json.Marshal(spillFile{IsDBLoaded: repo.isDBLoaded, IsClearPending: repo.isClearPending, Metrics: dirtyMetrics, Deleted: deletedMetrics, Responses: dirtyResponses})
+	if err == nil {
+		err = writeFileAtomic(name, data)
+	}
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("TieredStorage.writeSpill(): fail: %w", err)))
+		repo.setTier(TierMem)
+		return
+	}
+	repo.setTier(TierFile)
+}
+
+func (repo *TieredStorage) StoreDBfunc(mainCtx context.Context) {
+	repo.storeMu.Lock()
+	defer repo.storeMu.Unlock()
+
+	deletedMetrics := repo.db.mem.TakeDeleted()
+	dirtyMetrics := repo.db.mem.TakeDirty()
+	dirtyResponses := repo.db.mem.TakeDirtyResponses()
+	if repo.Tier() == TierDB {
+		if len(deletedMetrics) < 1 && len(dirtyMetrics) < 1 && len(dirtyResponses) < 1 {
+			return
+		}
+		err := repo.db.upsertMetrics(mainCtx, deletedMetrics, dirtyMetrics, dirtyResponses)
+		if err == nil {
+			return
+		}
+		log.Println(err)
+	}
+	// keep them dirty until the DB accepts them
+	repo.db.mem.MarkDeleted(deletedMetrics)
+	repo.db.mem.MarkDirty(dirtyMetrics)
+	repo.db.mem.MarkDirtyResponses(dirtyResponses)
+	repo.writeSpill(repo.db.mem.PeekDeleted(), repo.db.mem.PeekDirty(), repo.db.mem.PeekDirtyResponses())
+}
+
+// checkDB probes the primary and replays spilled series once it answers again.
+func (repo *TieredStorage) checkDB(mainCtx context.Context) {
+	repo.storeMu.Lock()
+	defer repo.storeMu.Unlock()
+
+	if repo.Tier() == TierDB {
+		if repo.db.Ping(mainCtx) != nil {
+			repo.writeSpill(repo.db.mem.PeekDeleted(), repo.db.mem.PeekDirty(), repo.db.mem.PeekDirtyResponses())
+		}
+		return
+	}
+
+	if repo.db.DBConn == nil {
+		if err := repo.db.open(mainCtx); err != nil {
+			return
+		}
+	} else if repo.db.Ping(mainCtx) != nil {
+		return
+	}
+	if repo.isClearPending {
+		// the start-up clear the DB missed, before the spill goes in, even if this run restored the spill
+		if err := repo.db.truncateTables(mainCtx); err != nil {
+			log.Println(err)
+			return
+		}
+		repo.isClearPending = false
+	}
+	if !repo.isDBLoaded {
+		if err := repo.mergeDB(mainCtx); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	deletedMetrics := repo.db.mem.TakeDeleted()
+	dirtyMetrics := repo.db.mem.TakeDirty()
+	dirtyResponses := repo.db.mem.TakeDirtyResponses()
+	if len(deletedMetrics) > 0 || len(dirtyMetrics) > 0 || len(dirtyResponses) > 0 {
+		err := repo.db.upsertMetrics(mainCtx, deletedMetrics, dirtyMetrics, dirtyResponses)
+		if err != nil {
+			repo.db.mem.MarkDeleted(deletedMetrics)
+			repo.db.mem.MarkDirty(dirtyMetrics)
+			repo.db.mem.MarkDirtyResponses(dirtyResponses)
+			log.Println(err)
+			return
+		}
+	}
+	name := repo.spillFileName()
+	if len(name) > 0 {
+		os.Remove(name)
+	}
+	repo.setTier(TierDB)
+}
+
+// mergeDB folds DB rows into series created while the DB was unreachable at start-up:
+// series deleted meanwhile are skipped, unknown series are adopted, counters and histograms add the DB totals, gauges keep the newer memory value.
+func (repo *TieredStorage) mergeDB(mainCtx context.Context) error {
+	oldMetrics, err := repo.db.selectAll(mainCtx)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("TieredStorage.mergeDB(): fail: %w", err))
+	}
+	for _, m := range oldMetrics {
+		if repo.db.mem.isDeleted(m.Key()) {
+			// deleted while the DB was down, the row goes on the next store
+			continue
+		}
+		var err error
+		_, getErr := repo.db.mem.Get(m.Key())
+		if getErr != nil {
+			err = repo.db.mem.put(m)
+		} else if types.DataType(m.MType) != types.GaugeType {
+			m.Timestamp = 0
+			err = repo.db.mem.Set(m)
+		}
+		if err != nil {
+			log.Println(types.NewTimeError(fmt.Errorf("TieredStorage.mergeDB(): skip: %w", err)))
+		}
+	}
+	repo.db.loadResponses(mainCtx)
+	repo.isDBLoaded = true
+	return nil
+}
+
+func (repo *TieredStorage) Shutdown(mainCtx context.Context) {
+	repo.StoreDBfunc(mainCtx)
+	if repo.db.DBConn != nil {
+		defer repo.db.DBConn.Close()
+	}
+}
+
+func (repo *TieredStorage) FlushDB(mainCtx context.Context) {
+	if repo.Config.StoreInterval == 0 {
+		repo.StoreDBfunc(mainCtx)
+		return
+	}
+}
+
+func (repo *TieredStorage) Ping(mainCtx context.Context) error {
+	tier := repo.Tier()
+	if tier != TierDB {
+		return types.NewTimeError(fmt.Errorf("TieredStorage.Ping(): DB unavailable, storage tier %v", tier))
+	}
+	return repo.db.Ping(mainCtx)
+}
+
+func (repo *TieredStorage) GetAll() []types.Metrics {
+	return repo.db.GetAll()
+}
+
+func (repo *TieredStorage) Get(k string) (types.Metrics, error) {
+	return repo.db.Get(k)
+}
+
+func (repo *TieredStorage) Set(mset types.Metrics) error {
+	return repo.db.Set(mset)
+}
+
+// SetMany always commits to memory, a DB outage spills instead of failing writes.
+func (repo *TieredStorage) SetMany(ctx context.Context, metrics []types.Metrics) error {
+	return repo.db.mem.SetMany(ctx, metrics)
+}
+
+func (repo *TieredStorage) Delete(ctx context.Context, keys []string) (int, error) {
+	return repo.db.Delete(ctx, keys)
+}
+
+func (repo *TieredStorage) List(ctx context.Context, filter repositories.Filter) ([]types.Metrics, error) {
+	return repo.db.List(ctx, filter)
+}
+
+func (repo *TieredStorage) History(k string, from time.Time, to time.Time) ([]types.Point, error) {
+	return repo.db.History(k, from, to)
+}
@@ -0,0 +1,315 @@
+package storages
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aaarkadev/collectalertagent/internal/types"
+)
+
+// walCompactRecords triggers compaction from FlushDB when no store ticker runs.
+const walCompactRecords = 1000
+
+// walRecord is one log line: metrics to merge or series to delete, numbered by LSN.
+type walRecord struct {
+	LSN     uint64          `json:"lsn"`
+	Metrics []types.Metrics `json:"metrics,omitempty"`
+	Deleted []string        `json:"deleted,omitempty"`
+}
+
+// walSnapshot is the snapshot written by compaction, it already holds every record up to LSN.
+type walSnapshot struct {
+	LSN     uint64          `json:"lsn"`
+	Metrics []types.Metrics `json:"metrics"`
+}
+
+// decodeSnapshot reads a walSnapshot or the plain metrics array of the non-WAL mode, whose LSN is 0.
+func decodeSnapshot(data []byte) (walSnapshot, error) {
+	snapshot := walSnapshot{}
+	data = bytes.TrimSpace(data)
+	if len(data) < 1 {
+		return snapshot, nil
+	}
+	if data[0] == '[' {
+		err := json.Unmarshal(data, &snapshot.Metrics)
+		return snapshot, err
+	}
+	err := json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func (repo *FileStorage) walFileName() string {
+	return repo.Config.StoreFileName + ".wal"
+}
+
+func (repo *FileStorage) openWAL() error {
+	if !repo.Config.IsRestore {
+		for _, name := range []string{repo.Config.StoreFileName, repo.walFileName()} {
+			err := os.Remove(name)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	file, err := os.OpenFile(repo.walFileName(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	repo.walFile = file
+	return nil
+}
+
+// loadWAL restores the snapshot, then replays the log records it does not hold yet.
+func (repo *FileStorage) loadWAL() {
+	data, err := os.ReadFile(repo.Config.StoreFileName)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadWAL(): snapshot fail: %w", err)))
+	}
+	snapshot, err := decodeSnapshot(data)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadWAL(): snapshot fail: %w", err)))
+	}
+	for _, m := range snapshot.Metrics {
+		err := repo.mem.Set(m)
+		if err != nil {
+			log.Fatalln(types.NewTimeError(fmt.Errorf("FileStorage.loadWAL(): fail: %w", err)))
+		}
+	}
+	repo.walLSN = snapshot.LSN
+
+	_, err = repo.walFile.Seek(0, 0)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadWAL(): fail: %w", err)))
+		return
+	}
+	reader := bufio.NewReader(repo.walFile)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) < 1 {
+			return
+		}
+		if err != nil && err != io.EOF {
+			log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadWAL(): fail: %w", err)))
+			return
+		}
+		record := walRecord{}
+		if err == nil {
+			err = json.Unmarshal(line, &record)
+		}
+		if err != nil {
+			// a torn last record after a crash, cut it so new records are not appended behind garbage
+			log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadWAL(): truncate log at %d: %w", offset, err)))
+			repo.truncateWAL(offset)
+			return
+		}
+		offset += int64(len(line))
+		if record.LSN <= snapshot.LSN {
+			// compaction crashed after writing the snapshot but before emptying the log
+			continue
+		}
+		repo.walLSN = record.LSN
+		repo.replayWAL(record)
+	}
+}
+
+// replayWAL applies one record read back from the log.
+func (repo *FileStorage) replayWAL(record walRecord) {
+	if len(record.Deleted) > 0 {
+		repo.mem.Delete(context.Background(), record.Deleted)
+		repo.walRecords += len(record.Deleted)
+		return
+	}
+	if err := repo.mem.SetMany(context.Background(), record.Metrics); err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.loadWAL(): skip record %d: %w", record.LSN, err)))
+		return
+	}
+	repo.walRecords += len(record.Metrics)
+}
+
+func (repo *FileStorage) truncateWAL(offset int64) {
+	err := repo.walFile.Truncate(offset)
+	if err == nil {
+		err = repo.walFile.Sync()
+	}
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.truncateWAL(): fail: %w", err)))
+	}
+}
+
+// setWAL logs the update before applying it, so memory is never ahead of the log;
+// walMu keeps compaction from splitting an update between snapshot and log.
+func (repo *FileStorage) setWAL(mset types.Metrics) error {
+	return repo.setManyWAL(context.Background(), []types.Metrics{mset})
+}
+
+// setManyWAL merges the batch, logs it and only then commits it in memory.
+func (repo *FileStorage) setManyWAL(ctx context.Context, metrics []types.Metrics) error {
+	if err := ctx.Err(); err != nil {
+		return types.NewTimeError(fmt.Errorf("FileStorage.setManyWAL(): fail: %w", err))
+	}
+
+	repo.walMu.Lock()
+	defer repo.walMu.Unlock()
+
+	return repo.mem.setManyWith(ctx, metrics, func(staged []types.Metrics) error {
+		return repo.appendWAL(resolveRelative(metrics, staged))
+	})
+}
+
+// resolveRelative replaces relative gauges with the value they merged to, the log does not keep Source.
+func resolveRelative(metrics []types.Metrics, staged []types.Metrics) []types.Metrics {
+	var merged map[string]types.Metrics
+	res := metrics
+	for i, m := range metrics {
+		if types.DataType(m.MType) != types.GaugeType || m.Source != types.IncrementSource {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]types.Metrics, len(staged))
+			for _, sm := range staged {
+				merged[sm.Key()] = sm
+			}
+			res = append([]types.Metrics(nil), metrics...)
+		}
+		res[i] = merged[m.Key()]
+		res[i].Source = types.OsSource
+	}
+	return res
+}
+
+// deleteWAL logs one record with the keys that exist, then removes them, so replay does not bring them back.
+func (repo *FileStorage) deleteWAL(ctx context.Context, keys []string) (int, error) {
+	repo.walMu.Lock()
+	defer repo.walMu.Unlock()
+
+	removed := []string{}
+	for _, k := range keys {
+		if _, err := repo.mem.Get(k); err == nil {
+			removed = append(removed, k)
+		}
+	}
+	if len(removed) < 1 {
+		return 0, nil
+	}
+	record, err := repo.marshalWAL(walRecord{Deleted: removed})
+	if err != nil {
+		return 0, err
+	}
+	err = repo.writeWAL(record, len(removed))
+	if err != nil {
+		return 0, err
+	}
+	return repo.mem.Delete(ctx, removed)
+}
+
+// marshalWAL numbers record with the next LSN and returns its line, caller holds walMu.
+func (repo *FileStorage) marshalWAL(record walRecord) ([]byte, error) {
+	record.LSN = repo.walLSN + 1
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, types.NewTimeError(fmt.Errorf("FileStorage.marshalWAL(): fail: %w", err))
+	}
+	repo.walLSN = record.LSN
+	return append(line, '\n'), nil
+}
+
+// appendWAL writes the metrics as one record, replay applies a batch whole or not at all, caller holds walMu.
+func (repo *FileStorage) appendWAL(metrics []types.Metrics) error {
+	record, err := repo.marshalWAL(walRecord{Metrics: metrics})
+	if err != nil {
+		return err
+	}
+	return repo.writeWAL(record, len(metrics))
+}
+
+// writeWAL appends ready records, syncing when there is no store interval, caller holds walMu.
+func (repo *FileStorage) writeWAL(records []byte, count int) error {
+	_, err := repo.walFile.Write(records)
+	if err != nil {
+		return types.NewTimeError(fmt.Errorf("FileStorage.writeWAL(): fail: %w", err))
+	}
+	if repo.Config.StoreInterval == 0 {
+		err = repo.walFile.Sync()
+		if err != nil {
+			return types.NewTimeError(fmt.Errorf("FileStorage.writeWAL(): fail: %w", err))
+		}
+	}
+	repo.walRecords += count
+	return nil
+}
+
+func (repo *FileStorage) walRecordsCount() int {
+	repo.walMu.Lock()
+	defer repo.walMu.Unlock()
+	return repo.walRecords
+}
+
+// compactWAL writes a snapshot atomically and empties the log. The snapshot carries the last LSN,
+// so a crash before the log is emptied does not replay the records twice.
+func (repo *FileStorage) compactWAL() {
+	repo.walMu.Lock()
+	defer repo.walMu.Unlock()
+
+	storeTxt, err := json.Marshal(walSnapshot{LSN: repo.walLSN, Metrics: repo.mem.GetAll()})
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.compactWAL(): fail: %w", err)))
+		return
+	}
+	err = writeFileAtomic(repo.Config.StoreFileName, storeTxt)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.compactWAL(): fail: %w", err)))
+		return
+	}
+	err = repo.walFile.Truncate(0)
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.compactWAL(): fail: %w", err)))
+		return
+	}
+	err = repo.walFile.Sync()
+	if err != nil {
+		log.Println(types.NewTimeError(fmt.Errorf("FileStorage.compactWAL(): fail: %w", err)))
+		return
+	}
+	repo.walRecords = 0
+}
+
+// writeFileAtomic replaces name via temp file, fsync and rename.
+func writeFileAtomic(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
@@ -0,0 +1,119 @@
+package types
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels are metric dimensions, part of the series identity.
+type Labels map[string]string
+
+func (l Labels) Copy() Labels {
+	if len(l) < 1 {
+		return nil
+	}
+	newL := make(Labels, len(l))
+	for k, v := range l {
+		newL[k] = v
+	}
+	return newL
+}
+
+func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for k := range l {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String is the canonical form: {k1="v1",k2="v2"} with sorted names, empty for no labels.
+func (l Labels) String() string {
+	if len(l) < 1 {
+		return ""
+	}
+	pairs := []string{}
+	for _, k := range l.Names() {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, l[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Match reports whether l contains every pair of filter.
+func (l Labels) Match(filter Labels) bool {
+	for k, v := range filter {
+		lv, ok := l[k]
+		if !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (l Labels) IsValid() bool {
+	for k := range l {
+		if !isLabelName(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelName replaces characters not allowed in label names with '_'.
+func LabelName(s string) string {
+	var sb strings.Builder
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			sb.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(c)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+func isLabelName(s string) bool {
+	if len(s) < 1 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (l Labels) Value() (driver.Value, error) {
+	return listValue(len(l), l)
+}
+
+func (l *Labels) Scan(src interface{}) error {
+	return listScan(src, l)
+}
+
+// CheckID rejects IDs with '{' or '}', the label set delimiters of SeriesKey,
+// so ID "a{x=\"1\"}" cannot take over the key of ID "a" with label x="1".
+func CheckID(id string) error {
+	if strings.ContainsAny(id, "{}") {
+		return fmt.Errorf("ID[%v]: '{' and '}' are not allowed", id)
+	}
+	return nil
+}
+
+// SeriesKey is the ID followed by the canonical label set, unambiguous as IDs cannot hold braces.
+func SeriesKey(id string, labels Labels) string {
+	return id + labels.String()
+}
@@ -0,0 +1,56 @@
+package types
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Float64List and Int64List are stored in SQL as JSON text, empty string for nil.
+type Float64List []float64
+type Int64List []int64
+
+func (l Float64List) Value() (driver.Value, error) {
+	return listValue(len(l), l)
+}
+
+func (l *Float64List) Scan(src interface{}) error {
+	return listScan(src, l)
+}
+
+func (l Int64List) Value() (driver.Value, error) {
+	return listValue(len(l), l)
+}
+
+func (l *Int64List) Scan(src interface{}) error {
+	return listScan(src, l)
+}
+
+func listValue(n int, v interface{}) (driver.Value, error) {
+	if n < 1 {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func listScan(src interface{}, dst interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("types.listScan(): unsupported type %T", src)
+	}
+	if len(b) < 1 {
+		return nil
+	}
+	return json.Unmarshal(b, dst)
+}
@@ -11,26 +11,44 @@ import (
 type DataType string
 type DataSource uint8
 
+// Metrics for histograms: Delta is the total count, Value is the sum,
+// Buckets are upper bounds and Counts has one extra +Inf bucket.
+// Timestamp is the collection time in unix milliseconds, 0 when unknown.
 type Metrics struct {
-	ID     string     `json:"id" db:"ID"`
-	MType  string     `json:"type" db:"MType"`
-	Delta  *int64     `json:"delta,omitempty" db:"Delta,omitempty"`
-	Value  *float64   `json:"value,omitempty" db:"Value,omitempty"`
-	Hash   string     `json:"hash" db:"Hash"`
-	Source DataSource `json:"-" db:"-"`
+	ID        string      `json:"id" db:"ID"`
+	MType     string      `json:"type" db:"MType"`
+	Delta     *int64      `json:"delta,omitempty" db:"Delta,omitempty"`
+	Value     *float64    `json:"value,omitempty" db:"Value,omitempty"`
+	Buckets   Float64List `json:"buckets,omitempty" db:"Buckets"`
+	Counts    Int64List   `json:"counts,omitempty" db:"Counts"`
+	Labels    Labels      `json:"labels,omitempty" db:"Labels"`
+	Timestamp int64       `json:"timestamp,omitempty" db:"Timestamp"`
+	Hash      string      `json:"hash" db:"Hash"`
+	Source    DataSource  `json:"-" db:"-"`
 }
 
 const (
-	GaugeType   DataType = "gauge"
-	CounterType DataType = "counter"
+	GaugeType     DataType = "gauge"
+	CounterType   DataType = "counter"
+	HistogramType DataType = "histogram"
 )
 
+var DefaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
 const (
 	OsSource DataSource = iota
+	// IncrementSource counters count up on the agent; a gauge written with it is relative,
+	// e.g. StatsD +N/-N, and is added to the stored value in the same merge
 	IncrementSource
 	RandSource
 )
 
+// Point is one history sample: unix milliseconds and the series scalar value.
+type Point struct {
+	Timestamp int64   `json:"t"`
+	Value     float64 `json:"v"`
+}
+
 type CtxValues string
 
 var MainCtxCancelFunc = CtxValues("mainCtxCancel")
@@ -44,6 +62,10 @@ func (te *TimeError) Error() string {
 	return fmt.Sprintf("%v %v", te.Time.Format(`2006/01/02 15:04:05`), te.Err)
 }
 
+func (te *TimeError) Unwrap() error {
+	return te.Err
+}
+
 func NewTimeError(err error) error {
 	return &TimeError{
 		Time: time.Now(),
@@ -53,7 +75,7 @@ func NewTimeError(err error) error {
 
 func (s DataType) IsValid() bool {
 	switch s {
-	case GaugeType, CounterType:
+	case GaugeType, CounterType, HistogramType:
 		return true
 	default:
 		return false
@@ -77,6 +99,9 @@ func (m *Metrics) Init() {
 	switch DataType(m.MType) {
 	case CounterType:
 		m.Delta = new(int64)
+	case HistogramType:
+		m.Delta = new(int64)
+		m.Value = new(float64)
 	default:
 		m.Value = new(float64)
 	}
@@ -98,6 +123,17 @@ func (m *Metrics) GenHash(key []byte) {
 		{
 			strForHash = fmt.Sprintf("%s:%s:%f", m.ID, m.MType, m.GetValue())
 		}
+	case "histogram":
+		{
+			strForHash = fmt.Sprintf("%s:%s:%d:%f:%v:%v", m.ID, m.MType, m.GetDelta(), m.GetValue(), []float64(m.Buckets), []int64(m.Counts))
+		}
+	}
+
+	if len(m.Labels) > 0 {
+		strForHash = fmt.Sprintf("%s:%s", strForHash, m.Labels.String())
+	}
+	if m.Timestamp != 0 {
+		strForHash = fmt.Sprintf("%s:%d", strForHash, m.Timestamp)
 	}
 
 	h := hmac.New(sha256.New, key)
@@ -108,6 +144,19 @@ func (m *Metrics) GenHash(key []byte) {
 	m.Hash = fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// CheckHash fails when m carries a Hash that does not match key, unsigned metrics pass.
+func (m Metrics) CheckHash(key []byte) error {
+	if len(m.Hash) < 1 {
+		return nil
+	}
+	tmpHash := m
+	tmpHash.GenHash(key)
+	if m.Hash != tmpHash.Hash {
+		return fmt.Errorf("wrong hash %v", m.ID)
+	}
+	return nil
+}
+
 func (m *Metrics) Get() string {
 	s := ""
 	switch DataType(m.MType) {
@@ -115,6 +164,10 @@ func (m *Metrics) Get() string {
 		{
 			s = fmt.Sprintf("%d", m.GetDelta())
 		}
+	case HistogramType:
+		{
+			s = fmt.Sprintf("count=%d sum=%.3f", m.GetDelta(), m.GetValue())
+		}
 	default:
 		{
 			s = fmt.Sprintf("%.3f", m.GetValue())
@@ -124,6 +177,52 @@ func (m *Metrics) Get() string {
 	return s
 }
 
+// Point returns the series scalar: gauge value, counter total or histogram count.
+func (m *Metrics) Point() Point {
+	p := Point{Timestamp: m.Timestamp}
+	if p.Timestamp == 0 {
+		p.Timestamp = time.Now().UnixMilli()
+	}
+	switch DataType(m.MType) {
+	case CounterType, HistogramType:
+		p.Value = float64(m.GetDelta())
+	default:
+		p.Value = m.GetValue()
+	}
+	return p
+}
+
+// Key identifies the series: ID plus its label set.
+func (m *Metrics) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+func (m *Metrics) GetTime() time.Time {
+	if m.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(m.Timestamp)
+}
+
+func (m *Metrics) SetTime(t time.Time) {
+	m.Timestamp = t.UnixMilli()
+}
+
+// CheckTime rejects samples older than maxAge or newer than now+maxFuture, zero durations disable the check.
+func (m *Metrics) CheckTime(now time.Time, maxAge time.Duration, maxFuture time.Duration) error {
+	if m.Timestamp == 0 {
+		return nil
+	}
+	t := m.GetTime()
+	if maxAge > 0 && t.Before(now.Add(-maxAge)) {
+		return NewTimeError(fmt.Errorf("Metric.CheckTime(): fail: %v too old", m.ID))
+	}
+	if maxFuture > 0 && t.After(now.Add(maxFuture)) {
+		return NewTimeError(fmt.Errorf("Metric.CheckTime(): fail: %v in the future", m.ID))
+	}
+	return nil
+}
+
 func (m *Metrics) GetDelta() int64 {
 	if !m.IsDelta() {
 		return int64(0)
@@ -148,14 +247,24 @@ func (m *Metrics) GetMetric() Metrics {
 	newElem := Metrics{}
 	newElem.ID = m.ID
 	newElem.MType = m.MType
-	if DataType(m.MType) == CounterType {
+	switch DataType(m.MType) {
+	case CounterType:
+		delta := m.GetDelta()
+		newElem.Delta = &delta
+	case HistogramType:
 		delta := m.GetDelta()
 		newElem.Delta = &delta
-	} else {
+		value := m.GetValue()
+		newElem.Value = &value
+		newElem.Buckets = append(Float64List(nil), m.Buckets...)
+		newElem.Counts = append(Int64List(nil), m.Counts...)
+	default:
 		value := m.GetValue()
 		newElem.Value = &value
 	}
 
+	newElem.Labels = m.Labels.Copy()
+	newElem.Timestamp = m.Timestamp
 	newElem.Hash = m.Hash
 	newElem.Source = m.Source
 	return newElem
@@ -165,27 +274,39 @@ func (m *Metrics) SetMetric(newM Metrics) error {
 	if m.MType != newM.MType {
 		return NewTimeError(fmt.Errorf("Metric.SetMetric(): fail: type[%v]!=[%v]", m.MType, newM.MType))
 	}
+	isLate := newM.Timestamp != 0 && newM.Timestamp < m.Timestamp
+	err := m.mergeMetric(newM, isLate)
+	if err != nil {
+		return NewTimeError(fmt.Errorf("Metric.SetMetric(): fail: %w", err))
+	}
+	// a failed merge leaves the series untouched, timestamp included
+	if !isLate && newM.Timestamp != 0 {
+		m.Timestamp = newM.Timestamp
+	}
+	//m.Hash = newM.Hash
+	return nil
+}
+
+func (m *Metrics) mergeMetric(newM Metrics, isLate bool) error {
+	if DataType(m.MType) == HistogramType {
+		return m.mergeHistogram(newM)
+	}
 	if !newM.IsDelta() && !newM.IsValue() {
-		return NewTimeError(fmt.Errorf("Metric.SetMetric(): fail: empty Delta and Value"))
+		return fmt.Errorf("empty Delta and Value")
 	}
 	switch DataType(m.MType) {
 	case CounterType:
-		{
-			err := m.Set((m.GetDelta() + newM.GetDelta()))
-			if err != nil {
-				return NewTimeError(fmt.Errorf("Metric.SetMetric(): fail: %w", err))
-			}
-		}
+		return m.Set(m.GetDelta() + newM.GetDelta())
 	default:
-		{
-			err := m.Set(newM.GetValue())
-			if err != nil {
-				return NewTimeError(fmt.Errorf("Metric.SetMetric(): fail: %w", err))
-			}
+		if newM.Source == IncrementSource {
+			return m.Set(m.GetValue() + newM.GetValue())
 		}
+		if isLate {
+			// gauge keeps the newer sample
+			return nil
+		}
+		return m.Set(newM.GetValue())
 	}
-	//m.Hash = newM.Hash
-	return nil
 }
 
 func (m *Metrics) Set(val interface{}) error {
@@ -200,6 +321,10 @@ func (m *Metrics) Set(val interface{}) error {
 				return NewTimeError(fmt.Errorf("Metric.Set(%v): fail: type[%v]", val, m.MType))
 			}
 		}
+	case HistogramType:
+		{
+			return NewTimeError(fmt.Errorf("Metric.Set(%v): fail: type[%v] use Observe()", val, m.MType))
+		}
 	default:
 		{
 			v, ok := val.(float64)
@@ -221,6 +346,9 @@ func NewMetric(name string, typ DataType, source DataSource) (*Metrics, error) {
 	if !source.IsValid() {
 		return &Metrics{}, NewTimeError(fmt.Errorf("DataSource[%v]: invalid", source))
 	}
+	if err := CheckID(name); err != nil {
+		return &Metrics{}, NewTimeError(err)
+	}
 
 	m := &Metrics{
 		ID:     name,
@@ -230,3 +358,121 @@ func NewMetric(name string, typ DataType, source DataSource) (*Metrics, error) {
 	m.Init()
 	return m, nil
 }
+
+// NewHistogram creates a histogram with the given upper bounds, DefaultHistogramBuckets when empty.
+func NewHistogram(name string, buckets []float64, source DataSource) (*Metrics, error) {
+	m, err := NewMetric(name, HistogramType, source)
+	if err != nil {
+		return m, err
+	}
+	if len(buckets) < 1 {
+		buckets = DefaultHistogramBuckets
+	}
+	m.Buckets = append(Float64List(nil), buckets...)
+	m.Counts = make(Int64List, len(buckets)+1)
+	if err := m.CheckBuckets(); err != nil {
+		return &Metrics{}, err
+	}
+	return m, nil
+}
+
+// CheckBuckets validates histogram layout: ascending bounds and one count per bucket plus +Inf.
+func (m *Metrics) CheckBuckets() error {
+	if DataType(m.MType) != HistogramType {
+		return NewTimeError(fmt.Errorf("Metric.CheckBuckets(): fail: type[%v]", m.MType))
+	}
+	for i := 1; i < len(m.Buckets); i++ {
+		if m.Buckets[i] <= m.Buckets[i-1] {
+			return NewTimeError(fmt.Errorf("Metric.CheckBuckets(): fail: buckets not ascending"))
+		}
+	}
+	if len(m.Counts) != len(m.Buckets)+1 {
+		return NewTimeError(fmt.Errorf("Metric.CheckBuckets(): fail: counts[%v] != buckets[%v]+1", len(m.Counts), len(m.Buckets)))
+	}
+	for _, c := range m.Counts {
+		if c < 0 {
+			return NewTimeError(fmt.Errorf("Metric.CheckBuckets(): fail: negative count"))
+		}
+	}
+	return nil
+}
+
+// Observe adds one sample to the histogram.
+func (m *Metrics) Observe(v float64) error {
+	return m.ObserveN(v, 1)
+}
+
+// ObserveN adds n samples of v in one step, e.g. a sampled StatsD timer that stands for 1/rate samples.
+func (m *Metrics) ObserveN(v float64, n int64) error {
+	if DataType(m.MType) != HistogramType {
+		return NewTimeError(fmt.Errorf("Metric.ObserveN(%v, %v): fail: type[%v]", v, n, m.MType))
+	}
+	if n < 1 {
+		return NewTimeError(fmt.Errorf("Metric.ObserveN(%v, %v): fail: count below 1", v, n))
+	}
+	if len(m.Counts) == 0 {
+		if len(m.Buckets) < 1 {
+			m.Buckets = append(Float64List(nil), DefaultHistogramBuckets...)
+		}
+		m.Counts = make(Int64List, len(m.Buckets)+1)
+	}
+	idx := len(m.Buckets)
+	for i, b := range m.Buckets {
+		if v <= b {
+			idx = i
+			break
+		}
+	}
+	m.Counts[idx] += n
+	m.initHistogramTotals()
+	*m.Delta += n
+	*m.Value += v * float64(n)
+	return nil
+}
+
+// initHistogramTotals allocates whichever of Delta and Value is missing, keeping the other.
+func (m *Metrics) initHistogramTotals() {
+	if !m.IsDelta() {
+		m.Delta = new(int64)
+	}
+	if !m.IsValue() {
+		m.Value = new(float64)
+	}
+}
+
+func (m *Metrics) mergeHistogram(newM Metrics) error {
+	if len(newM.Counts) < 1 {
+		return fmt.Errorf("empty Counts")
+	}
+	if err := newM.CheckBuckets(); err != nil {
+		return err
+	}
+	// the total count is derived from Counts, a Delta that disagrees is a broken update
+	count := int64(0)
+	for _, c := range newM.Counts {
+		count += c
+	}
+	if newM.IsDelta() && newM.GetDelta() != count {
+		return fmt.Errorf("count[%v] != sum of counts[%v]", newM.GetDelta(), count)
+	}
+	if len(m.Counts) == 0 {
+		m.Buckets = append(Float64List(nil), newM.Buckets...)
+		m.Counts = make(Int64List, len(newM.Counts))
+	}
+	if len(m.Buckets) != len(newM.Buckets) {
+		return fmt.Errorf("buckets[%v]!=[%v]", m.Buckets, newM.Buckets)
+	}
+	for i := range m.Buckets {
+		if m.Buckets[i] != newM.Buckets[i] {
+			return fmt.Errorf("buckets[%v]!=[%v]", m.Buckets, newM.Buckets)
+		}
+	}
+
+	for i := range newM.Counts {
+		m.Counts[i] += newM.Counts[i]
+	}
+	m.initHistogramTotals()
+	*m.Delta += count
+	*m.Value += newM.GetValue()
+	return nil
+}
@@ -1 +1,133 @@
 package types
+
+import (
+	"testing"
+)
+
+func testHistogram(t *testing.T, samples ...float64) *Metrics {
+	m, err := NewHistogram("latency", []float64{1, 10}, OsSource)
+	if err != nil {
+		t.Fatalf("NewHistogram() = %v", err)
+	}
+	for _, v := range samples {
+		if err := m.Observe(v); err != nil {
+			t.Fatalf("Observe(%v) = %v", v, err)
+		}
+	}
+	return m
+}
+
+func TestObserveKeepsExistingTotals(t *testing.T) {
+	m := testHistogram(t, 0.5, 5)
+	m.Value = nil
+	if err := m.Observe(20); err != nil {
+		t.Fatalf("Observe() = %v", err)
+	}
+	if m.GetDelta() != 3 || m.GetValue() != 20 {
+		t.Errorf("count=%d sum=%v, want count 3 kept and sum restarted at 20", m.GetDelta(), m.GetValue())
+	}
+}
+
+func TestSetMetricMergesHistogram(t *testing.T) {
+	m := testHistogram(t, 0.5)
+	if err := m.SetMetric(*testHistogram(t, 5, 20, 30)); err != nil {
+		t.Fatalf("SetMetric() = %v", err)
+	}
+	if m.GetDelta() != 4 || m.GetValue() != 55.5 {
+		t.Errorf("count=%d sum=%v, want 4 and 55.5", m.GetDelta(), m.GetValue())
+	}
+	want := []int64{1, 1, 2}
+	for i, c := range want {
+		if m.Counts[i] != c {
+			t.Fatalf("counts = %v, want %v", m.Counts, want)
+		}
+	}
+
+	// Delta is optional, the count then comes from Counts
+	update := testHistogram(t, 0.1)
+	update.Delta = nil
+	if err := m.SetMetric(*update); err != nil {
+		t.Fatalf("SetMetric() without Delta = %v", err)
+	}
+	if m.GetDelta() != 5 {
+		t.Errorf("count = %d, want 5", m.GetDelta())
+	}
+}
+
+func TestSetMetricRejectsBadHistogram(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(m *Metrics)
+	}{
+		{"count differs from counts", func(m *Metrics) { *m.Delta = 10 }},
+		{"no counts", func(m *Metrics) { m.Counts = nil }},
+		{"counts length", func(m *Metrics) { m.Counts = m.Counts[:2] }},
+		{"negative count", func(m *Metrics) { m.Counts[0] = -1; *m.Delta = 0 }},
+		{"other buckets", func(m *Metrics) { m.Buckets = Float64List{1, 5} }},
+		{"descending buckets", func(m *Metrics) { m.Buckets = Float64List{10, 1} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testHistogram(t, 0.5)
+			update := testHistogram(t, 5)
+			tt.update(update)
+			if err := m.SetMetric(*update); err == nil {
+				t.Fatalf("SetMetric() accepted %+v", update)
+			}
+			if m.GetDelta() != 1 || m.GetValue() != 0.5 || m.Counts[0] != 1 || m.Counts[1] != 0 {
+				t.Errorf("rejected update changed the histogram: count=%d sum=%v counts=%v", m.GetDelta(), m.GetValue(), m.Counts)
+			}
+		})
+	}
+}
+
+func TestSetMetricTimestampOnSuccess(t *testing.T) {
+	m, _ := NewMetric("PollCount", CounterType, IncrementSource)
+	m.Timestamp = 1000
+
+	update, _ := NewMetric("PollCount", CounterType, IncrementSource)
+	update.Delta = nil
+	update.Timestamp = 2000
+	if err := m.SetMetric(*update); err == nil {
+		t.Fatalf("SetMetric() accepted an empty update")
+	}
+	if m.Timestamp != 1000 {
+		t.Errorf("timestamp = %d after a failed merge, want 1000", m.Timestamp)
+	}
+
+	delta := int64(2)
+	update.Delta = &delta
+	if err := m.SetMetric(*update); err != nil {
+		t.Fatalf("SetMetric() = %v", err)
+	}
+	if m.Timestamp != 2000 || m.GetDelta() != 2 {
+		t.Errorf("timestamp=%d delta=%d, want 2000 and 2", m.Timestamp, m.GetDelta())
+	}
+
+	// a histogram merge that fails keeps the old timestamp too
+	h := testHistogram(t, 0.5)
+	h.Timestamp = 1000
+	bad := testHistogram(t, 5)
+	bad.Buckets = Float64List{1, 5}
+	bad.Timestamp = 2000
+	if err := h.SetMetric(*bad); err == nil || h.Timestamp != 1000 {
+		t.Errorf("SetMetric() = %v, timestamp %d, want an error and 1000", err, h.Timestamp)
+	}
+}
+
+func TestSeriesKeyIsUnambiguous(t *testing.T) {
+	if _, err := NewMetric(`Alloc{host="a"}`, GaugeType, OsSource); err == nil {
+		t.Errorf("NewMetric() accepted an ID with a label set")
+	}
+	if _, err := NewMetric("Alloc}", GaugeType, OsSource); err == nil {
+		t.Errorf("NewMetric() accepted an ID with '}'")
+	}
+	m, err := NewMetric("Alloc", GaugeType, OsSource)
+	if err != nil {
+		t.Fatalf("NewMetric() = %v", err)
+	}
+	m.Labels = Labels{"host": "a"}
+	if m.Key() != `Alloc{host="a"}` {
+		t.Errorf("Key() = %q", m.Key())
+	}
+}